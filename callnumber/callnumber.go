@@ -0,0 +1,189 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package callnumber parses LC, Dewey and local call numbers,
+//and builds keys which sort them in shelf order.
+//Keys can be compared as plain strings.
+package callnumber
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Scheme int
+
+const (
+	Local Scheme = iota
+	LC
+	Dewey
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case LC:
+		return "LC"
+	case Dewey:
+		return "Dewey"
+	}
+	return "Local"
+}
+
+//The separators used in sort keys. sectionSeparator must sort before
+//tokenSeparator, which must sort before any character in a token,
+//so that shorter call numbers sort before longer ones.
+const (
+	sectionSeparator = " "
+	tokenSeparator   = ","
+)
+
+//LC call numbers are shelved first, then Dewey, then local schemes.
+var schemeOrder = map[Scheme]string{LC: "1", Dewey: "2", Local: "3"}
+
+//The LC classes and subclasses. Local call numbers often start with
+//letters too, like FIC, REF or DVD, so only these are taken as LC.
+//Law, K, has too many subclasses to list, so any K class is LC.
+var lcClasses = make(map[string]bool)
+
+func init() {
+	for _, class := range strings.Fields(`
+		A AC AE AG AI AM AN AP AS AY AZ
+		B BC BD BF BH BJ BL BM BP BQ BR BS BT BV BX
+		C CB CC CD CE CJ CN CR CS CT
+		D DA DAW DB DC DD DE DF DG DH DJ DJK DK DL DP DQ DR DS DT DU DX
+		E F
+		G GA GB GC GE GF GN GR GT GV
+		H HA HB HC HD HE HF HG HJ HM HN HQ HS HT HV HX
+		J JA JC JF JJ JK JL JN JQ JS JV JX JZ
+		L LA LB LC LD LE LF LG LH LJ LT
+		M ML MT
+		N NA NB NC ND NE NK NX
+		P PA PB PC PD PE PF PG PH PJ PK PL PM PN PQ PR PS PT PZ
+		Q QA QB QC QD QE QH QK QL QM QP QR
+		R RA RB RC RD RE RF RG RJ RK RL RM RS RT RV RX RZ
+		S SB SD SF SH SK
+		T TA TC TD TE TF TG TH TJ TK TL TN TP TR TS TT TX
+		U UA UB UC UD UE UF UG UH
+		V VA VB VC VD VE VF VG VK VM
+		Z ZA`) {
+		lcClasses[class] = true
+	}
+}
+
+func isLCClass(class string) bool {
+	return lcClasses[class] || class[0] == 'K'
+}
+
+var (
+	//Sierra marks subfields in call numbers like |aJC578.R383|bG67 2007
+	subfieldRE = regexp.MustCompile(`\|[a-z0-9]`)
+	volumeRE   = regexp.MustCompile(`(?:^|\s)(?:V\.|VOL\.?|NO\.|PT\.)\s*(\d+)\b`)
+	copyRE     = regexp.MustCompile(`(?:^|\s)(?:C\.|COP\.|COPY)\s*(\d+)\b`)
+	lcRE       = regexp.MustCompile(`^([A-Z]{1,3})\s*(\d+)(\.\d+)?(.*)$`)
+	deweyRE    = regexp.MustCompile(`^(\d{3})(\.\d+)?(.*)$`)
+	cutterRE   = regexp.MustCompile(`\.([A-Z])`)
+	digitsRE   = regexp.MustCompile(`\d+`)
+)
+
+type CallNumber struct {
+	//The call number as it should be shown to patrons.
+	Display string
+	Scheme  Scheme
+	//The volume and copy numbers, or 0 if there are none.
+	Volume int
+	Copy   int
+
+	key string
+}
+
+//Normalize removes Sierra's subfield markers and extra whitespace.
+func Normalize(raw string) string {
+	return strings.Join(strings.Fields(subfieldRE.ReplaceAllString(raw, " ")), " ")
+}
+
+//Parse works out the scheme, volume and copy of a call number.
+func Parse(raw string) *CallNumber {
+
+	c := new(CallNumber)
+	c.Display = Normalize(raw)
+
+	body := strings.ToUpper(c.Display)
+
+	if match := volumeRE.FindStringSubmatch(body); match != nil {
+		c.Volume, _ = strconv.Atoi(match[1])
+		body = strings.Replace(body, match[0], " ", 1)
+	}
+	if match := copyRE.FindStringSubmatch(body); match != nil {
+		c.Copy, _ = strconv.Atoi(match[1])
+		body = strings.Replace(body, match[0], " ", 1)
+	}
+	body = strings.TrimSpace(body)
+
+	var tokens []string
+	if match := lcRE.FindStringSubmatch(body); match != nil && isLCClass(match[1]) {
+		c.Scheme = LC
+		tokens = append(tokens, match[1], pad(match[2], 6)+match[3])
+		tokens = append(tokens, restTokens(match[4])...)
+	} else if match := deweyRE.FindStringSubmatch(body); match != nil {
+		c.Scheme = Dewey
+		tokens = append(tokens, match[1]+match[2])
+		tokens = append(tokens, restTokens(match[3])...)
+	} else {
+		c.Scheme = Local
+		for _, token := range strings.Fields(body) {
+			//Numbers in local call numbers are compared by value.
+			tokens = append(tokens, digitsRE.ReplaceAllStringFunc(token, func(digits string) string {
+				return pad(digits, 8)
+			}))
+		}
+	}
+
+	//Items are shelved by volume, then by copy. A copy without
+	//a volume is shelved like volume 0, before the volumes.
+	c.key = schemeOrder[c.Scheme] + tokenSeparator + strings.Join(tokens, tokenSeparator)
+	if c.Volume > 0 || c.Copy > 0 {
+		c.key += sectionSeparator + fmt.Sprintf("%06d", c.Volume) + sectionSeparator + fmt.Sprintf("%04d", c.Copy)
+	}
+
+	return c
+}
+
+//restTokens splits the cutters, dates and other parts after
+//the class number. Cutters are decimals, so they are left alone,
+//while plain numbers like dates are padded.
+func restTokens(rest string) []string {
+	var tokens []string
+	for _, token := range strings.Fields(cutterRE.ReplaceAllString(rest, " $1")) {
+		token = strings.Trim(token, ".")
+		if token == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(token); err == nil {
+			token = pad(token, 6)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+//pad adds leading zeros to digits, so numbers up to
+//width digits long compare properly as strings.
+func pad(digits string, width int) string {
+	if len(digits) >= width {
+		return digits
+	}
+	return strings.Repeat("0", width-len(digits)) + digits
+}
+
+//SortKey returns a key which sorts the call number in shelf order.
+func (c *CallNumber) SortKey() string {
+	return c.key
+}
+
+//SortKey parses raw and returns its shelf order key.
+func SortKey(raw string) string {
+	return Parse(raw).SortKey()
+}
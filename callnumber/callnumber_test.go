@@ -0,0 +1,108 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package callnumber
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"|aJC578.R383|bG67 2007":        "JC578.R383 G67 2007",
+		"|aPR6068.O93|bH372 1999   ":    "PR6068.O93 H372 1999",
+		"  |f REF |a 025.04   |b SMI  ": "REF 025.04 SMI",
+		"":                              "",
+	}
+	for raw, display := range tests {
+		if Normalize(raw) != display {
+			t.Errorf("Normalize(%q) returned %q, expected %q", raw, Normalize(raw), display)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw    string
+		scheme Scheme
+		volume int
+		copy   int
+	}{
+		{"|aJC578.R383|bG67 2007", LC, 0, 0},
+		{"QA76.73.G63 D66 2016 v.2 c.3", LC, 2, 3},
+		{"PR6068.V45 1999", LC, 0, 0},
+		{"025.04 SMI", Dewey, 0, 0},
+		{"813.54 K56 vol. 12 copy 2", Dewey, 12, 2},
+		{"FIC SMITH", Local, 0, 0},
+		{"FIC 123", Local, 0, 0},
+		{"REF 45", Local, 0, 0},
+		{"DVD 1023", Local, 0, 0},
+		{"DVD 1023 v.2 c.1", Local, 2, 1},
+		{"VIDEO 1234", Local, 0, 0},
+		{"KFC1000.A1", LC, 0, 0},
+		{"DAW1000.A1", LC, 0, 0},
+	}
+	for _, test := range tests {
+		c := Parse(test.raw)
+		if c.Scheme != test.scheme || c.Volume != test.volume || c.Copy != test.copy {
+			t.Errorf("Parse(%q) returned %v v.%v c.%v, expected %v v.%v c.%v",
+				test.raw, c.Scheme, c.Volume, c.Copy, test.scheme, test.volume, test.copy)
+		}
+	}
+}
+
+func TestSortKeyShelfOrder(t *testing.T) {
+
+	//In shelf order.
+	shelf := []string{
+		"J100.A1",
+		"JC5.A1",
+		"JC578.R38",
+		"JC578.R383 2007",
+		"JC578.R383 G67 2007",
+		"JC578.1.B2",
+		"JC579.A1",
+		"QA76.73.G63 D66 2016",
+		"QA76.73.G63 D66 2016 c.2",
+		"QA76.73.G63 D66 2016 v.1",
+		"QA76.73.G63 D66 2016 v.1 c.2",
+		"QA76.73.G63 D66 2016 v.2",
+		"QA76.73.G63 D66 2016 v.2 c.1",
+		"QA76.73.G63 D66 2016 v.10",
+		"QA76.73.G63 D66 2016 v.10 c.2",
+		"QA761.A1",
+		"025.04 SMI",
+		"025.1 ABC",
+		"813.54 K56",
+		"AV CD 9",
+		"AV CD 10",
+		"DVD 9",
+		"DVD 1023",
+		"FIC 123",
+		"FIC SMITH",
+		"REF 45",
+	}
+
+	//Stepping through by 7, which shares no factor with the
+	//length, takes every call number once, out of order.
+	shuffled := make([]string, len(shelf))
+	for i := range shelf {
+		shuffled[i] = shelf[(i*7+3)%len(shelf)]
+	}
+
+	sort.Sort(byKey(shuffled))
+
+	for i := range shelf {
+		if shuffled[i] != shelf[i] {
+			t.Errorf("Position %v is %q, expected %q", i, shuffled[i], shelf[i])
+		}
+	}
+}
+
+type byKey []string
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Less(i, j int) bool { return SortKey(b[i]) < SortKey(b[j]) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,226 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package citation exports bib records as citations for reference
+//managers, in RIS, BibTeX and CSL-JSON, and as COinS and schema.org
+//metadata which can be embedded in web pages.
+package citation
+
+import (
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//The content types of each format.
+const (
+	RISContentType       string = "application/x-research-info-systems"
+	BibTeXContentType    string = "application/x-bibtex"
+	CSLJSONContentType   string = "application/vnd.citationstyles.csl+json"
+	COinSContentType     string = "text/html"
+	SchemaOrgContentType string = "application/ld+json"
+)
+
+//Kind is the type of a record, with its name in each format.
+type Kind struct {
+	CSL       string
+	RIS       string
+	BibTeX    string
+	SchemaOrg string
+}
+
+var (
+	Book       = Kind{"book", "BOOK", "book", "Book"}
+	Thesis     = Kind{"thesis", "THES", "phdthesis", "Thesis"}
+	Periodical = Kind{"periodical", "JFULL", "misc", "Periodical"}
+	Video      = Kind{"motion_picture", "VIDEO", "misc", "Movie"}
+	Sound      = Kind{"song", "SOUND", "misc", "MusicRecording"}
+	Score      = Kind{"musical_score", "MUSIC", "misc", "MusicComposition"}
+	Map        = Kind{"map", "MAP", "misc", "Map"}
+	Software   = Kind{"software", "COMP", "misc", "SoftwareApplication"}
+	Manuscript = Kind{"manuscript", "MANSCPT", "unpublished", "Manuscript"}
+	Other      = Kind{"document", "GEN", "misc", "CreativeWork"}
+)
+
+//Name is a person, with a family and given name, or an
+//organization or single name, as a Literal.
+type Name struct {
+	Family    string
+	Given     string
+	Literal   string
+	Corporate bool
+}
+
+//String returns the name in display order, like "Robert Kagan".
+func (n Name) String() string {
+	if n.Literal != "" {
+		return n.Literal
+	}
+	return strings.TrimSpace(n.Given + " " + n.Family)
+}
+
+//Inverted returns the name family name first, like "Kagan, Robert".
+func (n Name) Inverted() string {
+	if n.Literal != "" || n.Given == "" {
+		return n.String()
+	}
+	return n.Family + ", " + n.Given
+}
+
+//Record is the citation metadata of a bib.
+type Record struct {
+	BibID      int
+	Kind       Kind
+	Title      string
+	Subtitle   string
+	Authors    []Name
+	Editors    []Name
+	Edition    string
+	Place      string
+	Publisher  string
+	Year       string
+	ISBNs      []string
+	ISSNs      []string
+	OCLCNumber string
+	Language   string
+	Series     string
+	Subjects   []string
+	//The OPAC link for the record, if there is one.
+	URL string
+}
+
+var yearRE = regexp.MustCompile(`\d{4}`)
+
+//New builds the citation metadata of a bib from its MARC record.
+//link is the URL of the record in the OPAC, and can be empty.
+func New(bib *sierraapi.BibRecordIn, link string) *Record {
+
+	detail := bib.Detail()
+
+	r := &Record{
+		BibID:      bib.ID,
+		Kind:       kind(&bib.Marc),
+		Title:      detail.Title,
+		Subtitle:   detail.Subtitle,
+		Edition:    detail.Edition,
+		Place:      detail.PublicationPlace,
+		Publisher:  detail.Publisher,
+		Year:       yearRE.FindString(detail.PublicationDate),
+		ISBNs:      detail.ISBNs,
+		ISSNs:      detail.ISSNs,
+		OCLCNumber: detail.OCLCNumber,
+		Language:   detail.Language,
+		Subjects:   detail.Subjects,
+		URL:        link,
+	}
+	if len(detail.Series) > 0 {
+		r.Series = detail.Series[0]
+	}
+
+	for _, field := range bib.Marc.FieldsByTag("100", "110", "111", "700", "710", "711") {
+		//Added entries with a title are related works.
+		if field.Subfield("t") != "" {
+			continue
+		}
+		name := parseName(field)
+		if name.String() == "" {
+			continue
+		}
+		if isEditor(field) {
+			r.Editors = append(r.Editors, name)
+		} else if !containsName(r.Authors, name) {
+			r.Authors = append(r.Authors, name)
+		}
+	}
+
+	//Records without a MARC record still have Sierra's author.
+	if len(r.Authors) == 0 && len(r.Editors) == 0 && len(detail.Authors) > 0 {
+		r.Authors = append(r.Authors, Name{Literal: detail.Authors[0]})
+	}
+
+	return r
+}
+
+//kind works out the type of record from the leader,
+//and a dissertation note in the 502.
+func kind(m *sierraapi.Marc) Kind {
+	if len(m.Leader) < 8 {
+		return Book
+	}
+	switch m.Leader[6] {
+	case 'a':
+		if m.Leader[7] == 's' {
+			return Periodical
+		}
+		if _, ok := m.Field("502"); ok {
+			return Thesis
+		}
+		return Book
+	case 't':
+		return Manuscript
+	case 'g':
+		return Video
+	case 'i', 'j':
+		return Sound
+	case 'c', 'd':
+		return Score
+	case 'e', 'f':
+		return Map
+	case 'm':
+		return Software
+	}
+	return Other
+}
+
+//parseName splits a personal name with a surname, first indicator 1,
+//into family and given names. Other names are kept whole.
+func parseName(field sierraapi.MarcField) Name {
+	switch field.Tag {
+	case "100", "700":
+		name := sierraapi.CleanPunctuation(field.Subfield("a"))
+		if parts := strings.SplitN(name, ",", 2); field.Ind1 == "1" && len(parts) == 2 {
+			return Name{Family: strings.TrimSpace(parts[0]), Given: strings.TrimSpace(parts[1])}
+		}
+		return Name{Literal: name}
+	}
+	return Name{Literal: sierraapi.CleanPunctuation(field.Text("a", "b")), Corporate: true}
+}
+
+//isEditor checks the relator term, $e, and code, $4.
+func isEditor(field sierraapi.MarcField) bool {
+	for _, term := range field.SubfieldValues("e") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(term)), "editor") {
+			return true
+		}
+	}
+	for _, code := range field.SubfieldValues("4") {
+		if strings.TrimSpace(code) == "edt" {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(names []Name, name Name) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+//FullTitle joins the title and subtitle, like "A Title: A Subtitle".
+func (r *Record) FullTitle() string {
+	if r.Subtitle == "" {
+		return r.Title
+	}
+	return r.Title + ": " + r.Subtitle
+}
+
+//ID is an identifier for the record, unique within the catalogue.
+func (r *Record) ID() string {
+	return "b" + strconv.Itoa(r.BibID)
+}
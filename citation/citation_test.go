@@ -0,0 +1,197 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package citation
+
+import (
+	"encoding/json"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"html"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBibJSON = `{
+	"id": 2536252,
+	"lang": {"code": "eng", "name": "English"},
+	"marc": {
+		"leader": "00000cam  2200000 a 4500",
+		"fields": [
+			{"tag": "001", "data": "ocm12345678"},
+			{"tag": "020", "data": {"ind1": " ", "ind2": " ", "subfields": [{"code": "a", "data": "9780521875646"}]}},
+			{"tag": "100", "data": {"ind1": "1", "ind2": " ", "subfields": [{"code": "a", "data": "Kagan, Robert."}]}},
+			{"tag": "245", "data": {"ind1": "1", "ind2": "0", "subfields": [
+				{"code": "a", "data": "Dangerous nation :"},
+				{"code": "b", "data": "America & the world, 100% /"},
+				{"code": "c", "data": "Robert Kagan."}]}},
+			{"tag": "264", "data": {"ind1": " ", "ind2": "1", "subfields": [
+				{"code": "a", "data": "New York :"},
+				{"code": "b", "data": "Alfred A. Knopf,"},
+				{"code": "c", "data": "c2006."}]}},
+			{"tag": "650", "data": {"ind1": " ", "ind2": "0", "subfields": [{"code": "a", "data": "Imperialism."}]}},
+			{"tag": "700", "data": {"ind1": "1", "ind2": " ", "subfields": [{"code": "a", "data": "Smith, Jane,"}, {"code": "e", "data": "editor."}]}},
+			{"tag": "710", "data": {"ind1": "2", "ind2": " ", "subfields": [{"code": "a", "data": "Carnegie Endowment."}]}}
+		]
+	}
+}`
+
+func testRecord(t *testing.T) *Record {
+	var bib sierraapi.BibRecordIn
+	if err := json.Unmarshal([]byte(testBibJSON), &bib); err != nil {
+		t.Fatal(err)
+	}
+	return New(&bib, "https://catalogue.library.ca/record=b2536252")
+}
+
+func TestNew(t *testing.T) {
+
+	r := testRecord(t)
+
+	if r.Kind != Book || r.FullTitle() != "Dangerous nation: America & the world, 100%" || r.Year != "2006" {
+		t.Errorf("Unexpected record %+v", r)
+	}
+	authors := []Name{{Family: "Kagan", Given: "Robert"}, {Literal: "Carnegie Endowment", Corporate: true}}
+	if !reflect.DeepEqual(r.Authors, authors) {
+		t.Errorf("Unexpected authors %+v", r.Authors)
+	}
+	if !reflect.DeepEqual(r.Editors, []Name{{Family: "Smith", Given: "Jane"}}) {
+		t.Errorf("Unexpected editors %+v", r.Editors)
+	}
+}
+
+func TestKind(t *testing.T) {
+	tests := map[string]Kind{
+		"":                         Book,
+		"00000cas  2200000 a 4500": Periodical,
+		"00000cgm  2200000 a 4500": Video,
+		"00000cjm  2200000 a 4500": Sound,
+		"00000cem  2200000 a 4500": Map,
+		"00000crm  2200000 a 4500": Other,
+	}
+	for leader, expected := range tests {
+		if kind(&sierraapi.Marc{Leader: leader}) != expected {
+			t.Errorf("kind() for leader %q should be %v", leader, expected.CSL)
+		}
+	}
+
+	thesis := &sierraapi.Marc{Leader: "00000cam  2200000 a 4500", Fields: []sierraapi.MarcField{{Tag: "502"}}}
+	if kind(thesis) != Thesis {
+		t.Error("A book with a dissertation note should be a thesis.")
+	}
+}
+
+func TestRIS(t *testing.T) {
+
+	out := string(RIS(testRecord(t)))
+
+	expected := "TY  - BOOK\r\n" +
+		"ID  - b2536252\r\n" +
+		"TI  - Dangerous nation: America & the world, 100%\r\n" +
+		"AU  - Kagan, Robert\r\n" +
+		"AU  - Carnegie Endowment\r\n" +
+		"ED  - Smith, Jane\r\n" +
+		"CY  - New York\r\n" +
+		"PB  - Alfred A. Knopf\r\n" +
+		"PY  - 2006\r\n" +
+		"SN  - 9780521875646\r\n" +
+		"LA  - English\r\n" +
+		"KW  - Imperialism\r\n" +
+		"UR  - https://catalogue.library.ca/record=b2536252\r\n" +
+		"ER  - \r\n"
+	if out != expected {
+		t.Errorf("Unexpected RIS:\n%v", out)
+	}
+}
+
+func TestBibTeX(t *testing.T) {
+
+	out := string(BibTeX(testRecord(t)))
+
+	for _, expected := range []string{
+		"@book{kagan2006,\n",
+		"  title = {Dangerous nation: America \\& the world, 100\\%},\n",
+		"  author = {Kagan, Robert and {Carnegie Endowment}},\n",
+		"  editor = {Smith, Jane},\n",
+		"  year = {2006},\n",
+		"  url = {https://catalogue.library.ca/record=b2536252}\n}\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the BibTeX:\n%v", expected, out)
+		}
+	}
+
+	//Without an author, the key is the record's ID.
+	if out := string(BibTeX(&Record{BibID: 1, Kind: Other})); out != "@misc{b1\n}\n" {
+		t.Errorf("Unexpected BibTeX for an empty record %q", out)
+	}
+}
+
+func TestCSLJSON(t *testing.T) {
+
+	out, err := CSLJSON(testRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var items []map[string]interface{}
+	if err := json.Unmarshal(out, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Expected one item, got %v", string(out))
+	}
+	item := items[0]
+	if item["id"] != "b2536252" || item["type"] != "book" || item["publisher-place"] != "New York" || item["ISBN"] != "9780521875646" {
+		t.Errorf("Unexpected CSL-JSON %v", string(out))
+	}
+	if !reflect.DeepEqual(item["issued"], map[string]interface{}{"date-parts": []interface{}{[]interface{}{2006.0}}}) {
+		t.Errorf("Unexpected issued date %v", item["issued"])
+	}
+	if !strings.Contains(string(out), `"author":[{"family":"Kagan","given":"Robert"},{"literal":"Carnegie Endowment"}]`) {
+		t.Errorf("Unexpected authors %v", string(out))
+	}
+}
+
+func TestCOinS(t *testing.T) {
+
+	out := string(COinS(testRecord(t)))
+
+	prefix, suffix := `<span class="Z3988" title="`, `"></span>`
+	if !strings.HasPrefix(out, prefix) || !strings.HasSuffix(out, suffix) {
+		t.Fatalf("Unexpected COinS %v", out)
+	}
+	v, err := url.ParseQuery(html.UnescapeString(out[len(prefix) : len(out)-len(suffix)]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Get("rft_val_fmt") != "info:ofi/fmt:kev:mtx:book" || v.Get("rft.btitle") != "Dangerous nation: America & the world, 100%" || v.Get("rft.isbn") != "9780521875646" {
+		t.Errorf("Unexpected ContextObject %v", v)
+	}
+	if !reflect.DeepEqual(v["rft_id"], []string{"info:oclcnum/12345678", "https://catalogue.library.ca/record=b2536252"}) {
+		t.Errorf("Unexpected identifiers %v", v["rft_id"])
+	}
+	if strings.Contains(out, "&rft") {
+		t.Error("The ampersands in the title attribute should be escaped.")
+	}
+}
+
+func TestSchemaOrg(t *testing.T) {
+
+	out, err := SchemaOrg(testRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`"@context":"http://schema.org","@type":"Book"`,
+		`"author":[{"@type":"Person","name":"Robert Kagan"},{"@type":"Organization","name":"Carnegie Endowment"}]`,
+		`"publisher":{"@type":"Organization","name":"Alfred A. Knopf"}`,
+		`"isbn":["9780521875646"]`,
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("Expected %v in the JSON-LD, got %v", expected, string(out))
+		}
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package citation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//RIS writes the record in the RIS format used by EndNote and Zotero.
+func RIS(r *Record) []byte {
+
+	var b bytes.Buffer
+	line := func(tag, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%v  - %v\r\n", tag, value)
+		}
+	}
+
+	line("TY", r.Kind.RIS)
+	line("ID", r.ID())
+	line("TI", r.FullTitle())
+	for _, author := range r.Authors {
+		line("AU", author.Inverted())
+	}
+	for _, editor := range r.Editors {
+		line("ED", editor.Inverted())
+	}
+	line("ET", r.Edition)
+	line("CY", r.Place)
+	line("PB", r.Publisher)
+	line("PY", r.Year)
+	line("T3", r.Series)
+	for _, isbn := range r.ISBNs {
+		line("SN", isbn)
+	}
+	for _, issn := range r.ISSNs {
+		line("SN", issn)
+	}
+	line("LA", r.Language)
+	for _, subject := range r.Subjects {
+		line("KW", subject)
+	}
+	line("UR", r.URL)
+	b.WriteString("ER  - \r\n")
+
+	return b.Bytes()
+}
+
+//BibTeX writes the record as a BibTeX entry.
+func BibTeX(r *Record) []byte {
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "@%v{%v", r.Kind.BibTeX, r.bibTeXKey())
+
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, ",\n  %v = {%v}", name, escapeBibTeX(value))
+		}
+	}
+	names := func(names []Name) string {
+		var inverted []string
+		for _, name := range names {
+			if name.Literal != "" {
+				//Braces keep organizations from being split into parts.
+				inverted = append(inverted, "{"+escapeBibTeX(name.Literal)+"}")
+			} else {
+				inverted = append(inverted, escapeBibTeX(name.Inverted()))
+			}
+		}
+		return strings.Join(inverted, " and ")
+	}
+
+	field("title", r.FullTitle())
+	if len(r.Authors) > 0 {
+		fmt.Fprintf(&b, ",\n  author = {%v}", names(r.Authors))
+	}
+	if len(r.Editors) > 0 {
+		fmt.Fprintf(&b, ",\n  editor = {%v}", names(r.Editors))
+	}
+	field("edition", r.Edition)
+	field("address", r.Place)
+	field("publisher", r.Publisher)
+	field("year", r.Year)
+	field("series", r.Series)
+	field("isbn", strings.Join(r.ISBNs, ", "))
+	field("issn", strings.Join(r.ISSNs, ", "))
+	field("language", r.Language)
+	field("keywords", strings.Join(r.Subjects, ", "))
+	field("url", r.URL)
+	b.WriteString("\n}\n")
+
+	return b.Bytes()
+}
+
+//bibTeXKey is the first author's family name and the year, like kagan2006,
+//falling back to the record's ID.
+func (r *Record) bibTeXKey() string {
+	var key string
+	if len(r.Authors) > 0 {
+		name := r.Authors[0].Family
+		if name == "" {
+			name = r.Authors[0].Literal
+		}
+		for _, c := range strings.ToLower(name) {
+			if c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)) {
+				key += string(c)
+			}
+		}
+	}
+	if key == "" {
+		return r.ID()
+	}
+	return key + r.Year
+}
+
+var bibTeXEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`&`, `\&`,
+	`%`, `\%`,
+	`$`, `\$`,
+	`#`, `\#`,
+	`_`, `\_`,
+	`~`, `\textasciitilde{}`,
+	`^`, `\textasciicircum{}`,
+)
+
+func escapeBibTeX(s string) string {
+	return bibTeXEscaper.Replace(s)
+}
+
+type cslName struct {
+	Family  string `json:"family,omitempty"`
+	Given   string `json:"given,omitempty"`
+	Literal string `json:"literal,omitempty"`
+}
+
+type cslDate struct {
+	DateParts [][]int `json:"date-parts"`
+}
+
+type cslItem struct {
+	ID              string    `json:"id"`
+	Type            string    `json:"type"`
+	Title           string    `json:"title"`
+	Author          []cslName `json:"author,omitempty"`
+	Editor          []cslName `json:"editor,omitempty"`
+	Edition         string    `json:"edition,omitempty"`
+	Publisher       string    `json:"publisher,omitempty"`
+	PublisherPlace  string    `json:"publisher-place,omitempty"`
+	Issued          *cslDate  `json:"issued,omitempty"`
+	CollectionTitle string    `json:"collection-title,omitempty"`
+	ISBN            string    `json:"ISBN,omitempty"`
+	ISSN            string    `json:"ISSN,omitempty"`
+	Language        string    `json:"language,omitempty"`
+	Keyword         string    `json:"keyword,omitempty"`
+	URL             string    `json:"URL,omitempty"`
+}
+
+//CSLJSON writes the record as a CSL-JSON list with one item,
+//as used by Zotero and citeproc processors.
+func CSLJSON(r *Record) ([]byte, error) {
+
+	cslNames := func(names []Name) []cslName {
+		var out []cslName
+		for _, name := range names {
+			out = append(out, cslName{name.Family, name.Given, name.Literal})
+		}
+		return out
+	}
+
+	item := cslItem{
+		ID:              r.ID(),
+		Type:            r.Kind.CSL,
+		Title:           r.FullTitle(),
+		Author:          cslNames(r.Authors),
+		Editor:          cslNames(r.Editors),
+		Edition:         r.Edition,
+		Publisher:       r.Publisher,
+		PublisherPlace:  r.Place,
+		CollectionTitle: r.Series,
+		ISBN:            strings.Join(r.ISBNs, " "),
+		ISSN:            strings.Join(r.ISSNs, " "),
+		Language:        r.Language,
+		Keyword:         strings.Join(r.Subjects, ", "),
+		URL:             r.URL,
+	}
+	if year, err := strconv.Atoi(r.Year); err == nil {
+		item.Issued = &cslDate{[][]int{{year}}}
+	}
+
+	return json.Marshal([]cslItem{item})
+}
+
+//COinS writes the record as an OpenURL ContextObject in a span, which
+//Zotero and other reference managers find in web pages.
+//Books use the book format, periodicals the journal format,
+//and everything else Dublin Core.
+func COinS(r *Record) []byte {
+
+	v := url.Values{}
+	v.Set("ctx_ver", "Z39.88-2004")
+
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+
+	switch r.Kind {
+	case Book, Thesis:
+		v.Set("rft_val_fmt", "info:ofi/fmt:kev:mtx:book")
+		v.Set("rft.genre", "book")
+		set("rft.btitle", r.FullTitle())
+		set("rft.place", r.Place)
+		set("rft.pub", r.Publisher)
+		set("rft.edition", r.Edition)
+		set("rft.series", r.Series)
+		if len(r.ISBNs) > 0 {
+			v.Set("rft.isbn", r.ISBNs[0])
+		}
+		set("rft.date", r.Year)
+		for _, author := range r.Authors {
+			v.Add("rft.au", author.Inverted())
+		}
+	case Periodical:
+		v.Set("rft_val_fmt", "info:ofi/fmt:kev:mtx:journal")
+		v.Set("rft.genre", "journal")
+		set("rft.jtitle", r.FullTitle())
+		if len(r.ISSNs) > 0 {
+			v.Set("rft.issn", r.ISSNs[0])
+		}
+		set("rft.date", r.Year)
+	default:
+		v.Set("rft_val_fmt", "info:ofi/fmt:kev:mtx:dc")
+		set("rft.title", r.FullTitle())
+		set("rft.type", r.Kind.SchemaOrg)
+		set("rft.publisher", r.Publisher)
+		set("rft.date", r.Year)
+		set("rft.language", r.Language)
+		for _, author := range r.Authors {
+			v.Add("rft.creator", author.Inverted())
+		}
+	}
+
+	if r.OCLCNumber != "" {
+		v.Add("rft_id", "info:oclcnum/"+r.OCLCNumber)
+	}
+	if r.URL != "" {
+		v.Add("rft_id", r.URL)
+	}
+
+	return []byte(fmt.Sprintf(`<span class="Z3988" title="%v"></span>`, html.EscapeString(v.Encode())))
+}
+
+type schemaThing struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type schemaRecord struct {
+	Context       string        `json:"@context"`
+	Type          string        `json:"@type"`
+	ID            string        `json:"@id,omitempty"`
+	Name          string        `json:"name"`
+	Author        []schemaThing `json:"author,omitempty"`
+	Editor        []schemaThing `json:"editor,omitempty"`
+	BookEdition   string        `json:"bookEdition,omitempty"`
+	Publisher     *schemaThing  `json:"publisher,omitempty"`
+	DatePublished string        `json:"datePublished,omitempty"`
+	ISBN          []string      `json:"isbn,omitempty"`
+	ISSN          []string      `json:"issn,omitempty"`
+	InLanguage    string        `json:"inLanguage,omitempty"`
+	Keywords      string        `json:"keywords,omitempty"`
+	URL           string        `json:"url,omitempty"`
+}
+
+//SchemaOrg writes the record as schema.org JSON-LD, for a
+//<script type="application/ld+json"> element in a record page.
+func SchemaOrg(r *Record) ([]byte, error) {
+
+	people := func(names []Name) []schemaThing {
+		var out []schemaThing
+		for _, name := range names {
+			t := "Person"
+			if name.Corporate {
+				t = "Organization"
+			}
+			out = append(out, schemaThing{t, name.String()})
+		}
+		return out
+	}
+
+	record := schemaRecord{
+		Context:       "http://schema.org",
+		Type:          r.Kind.SchemaOrg,
+		ID:            r.URL,
+		Name:          r.FullTitle(),
+		Author:        people(r.Authors),
+		Editor:        people(r.Editors),
+		DatePublished: r.Year,
+		ISBN:          r.ISBNs,
+		ISSN:          r.ISSNs,
+		InLanguage:    r.Language,
+		Keywords:      strings.Join(r.Subjects, ", "),
+		URL:           r.URL,
+	}
+	if r.Kind == Book || r.Kind == Thesis {
+		record.BookEdition = r.Edition
+	}
+	if r.Publisher != "" {
+		record.Publisher = &schemaThing{"Organization", r.Publisher}
+	}
+
+	return json.Marshal(record)
+}
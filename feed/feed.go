@@ -0,0 +1,192 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package feed renders lists of bib records as RSS 2.0 and Atom 1.0 feeds.
+package feed
+
+import (
+	"encoding/xml"
+	"fmt"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//The placeholder in a record link template which is replaced with the bib ID.
+const BibIDPlaceholder string = "{bibID}"
+
+type Config struct {
+	//The title of the feed.
+	Title string
+
+	//The URL the feed is served from.
+	Self string
+
+	//A template for the OPAC URL of each record, like
+	//https://catalogue.library.ca/record=b{bibID}
+	//If empty, the feed entries won't have links.
+	RecordLinkTemplate string
+}
+
+//RecordLink returns the OPAC URL of the bib, or an empty string
+//if there is no template.
+func (c *Config) RecordLink(bibID int) string {
+	if c.RecordLinkTemplate == "" {
+		return ""
+	}
+	return strings.Replace(c.RecordLinkTemplate, BibIDPlaceholder, strconv.Itoa(bibID), -1)
+}
+
+//recordID returns a permanent, unique ID for the bib. It's the
+//OPAC link if there is one, otherwise a tag URI (RFC 4151).
+func (c *Config) recordID(bibID int) string {
+	if link := c.RecordLink(bibID); link != "" {
+		return link
+	}
+	host := "localhost"
+	if parsed, err := url.Parse(c.Self); err == nil && parsed.Host != "" {
+		host = parsed.Host
+	}
+	return fmt.Sprintf("tag:%v,2014:bib/%v", host, bibID)
+}
+
+func description(bib sierraapi.BibRecordOut) string {
+	if len(bib.ISBNs) == 0 {
+		return bib.TitleAndAuthor
+	}
+	return fmt.Sprintf("%v ISBN: %v", bib.TitleAndAuthor, strings.Join(bib.ISBNs, ", "))
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link,omitempty"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+//RSS renders the bibs as an RSS 2.0 feed. updated is when the list was last refreshed.
+func RSS(bibs sierraapi.BibRecordsOut, updated time.Time, c *Config) ([]byte, error) {
+
+	feed := rss{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         c.Title,
+			Link:          c.Self,
+			Description:   c.Title,
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+			AtomLink:      atomLink{Href: c.Self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+
+	for _, bib := range bibs {
+		item := rssItem{
+			Title:       bib.TitleAndAuthor,
+			Link:        c.RecordLink(bib.BibID),
+			Description: description(bib),
+			PubDate:     bib.CreatedDate.UTC().Format(time.RFC1123Z),
+			GUID:        rssGUID{IsPermaLink: c.RecordLinkTemplate != "", Value: c.recordID(bib.BibID)},
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Link    *atomLink  `xml:"link,omitempty"`
+	Summary string     `xml:"summary"`
+	ISBNs   []atomISBN `xml:"category"`
+}
+
+//ISBNs are included as categories, so they can be picked out by feed readers.
+type atomISBN struct {
+	Term   string `xml:"term,attr"`
+	Scheme string `xml:"scheme,attr"`
+}
+
+//Atom renders the bibs as an Atom 1.0 feed. updated is when the list was last refreshed.
+func Atom(bibs sierraapi.BibRecordsOut, updated time.Time, c *Config) ([]byte, error) {
+
+	feed := atomFeed{
+		Title:   c.Title,
+		ID:      c.Self,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: c.Title},
+		Link:    atomLink{Href: c.Self, Rel: "self", Type: "application/atom+xml"},
+	}
+
+	for _, bib := range bibs {
+		entry := atomEntry{
+			Title:   bib.TitleAndAuthor,
+			ID:      c.recordID(bib.BibID),
+			Updated: bib.CreatedDate.UTC().Format(time.RFC3339),
+			Summary: description(bib),
+		}
+		if link := c.RecordLink(bib.BibID); link != "" {
+			entry.Link = &atomLink{Href: link, Rel: "alternate", Type: "text/html"}
+		}
+		for _, isbn := range bib.ISBNs {
+			entry.ISBNs = append(entry.ISBNs, atomISBN{Term: isbn, Scheme: "urn:isbn"})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
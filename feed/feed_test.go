@@ -0,0 +1,130 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package feed
+
+import (
+	"encoding/xml"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBibs = sierraapi.BibRecordsOut{
+	sierraapi.BibRecordOut{
+		BibID:          7777777,
+		TitleAndAuthor: "A Title & More /An Author.",
+		ISBNs:          []string{"1111111111113", "11111111111"},
+		CreatedDate:    time.Date(2015, 1, 22, 8, 0, 0, 0, time.UTC),
+	},
+}
+
+var testConfig = &Config{
+	Title:              "New Items",
+	Self:               "https://tyro.library.ca/new.rss",
+	RecordLinkTemplate: "https://catalogue.library.ca/record=b{bibID}",
+}
+
+func TestRecordLink(t *testing.T) {
+
+	if testConfig.RecordLink(7777777) != "https://catalogue.library.ca/record=b7777777" {
+		t.Error("RecordLink() didn't fill in the template.")
+	}
+
+	noLinks := &Config{Self: "https://tyro.library.ca/new.atom"}
+	if noLinks.RecordLink(7777777) != "" {
+		t.Error("RecordLink() should be empty without a template.")
+	}
+	if noLinks.recordID(7777777) != "tag:tyro.library.ca,2014:bib/7777777" {
+		t.Errorf("recordID() should fall back to a tag URI, got %v", noLinks.recordID(7777777))
+	}
+}
+
+func TestRSS(t *testing.T) {
+
+	out, err := RSS(testBibs, time.Date(2015, 1, 23, 0, 0, 0, 0, time.UTC), testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(out), xml.Header) {
+		t.Error("RSS should start with an XML header.")
+	}
+
+	var parsed struct {
+		Version string `xml:"version,attr"`
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title   string `xml:"title"`
+				Link    string `xml:"link"`
+				PubDate string `xml:"pubDate"`
+				GUID    string `xml:"guid"`
+				Desc    string `xml:"description"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(out, &parsed); err != nil {
+		t.Fatalf("RSS isn't valid XML, %v", err)
+	}
+
+	if parsed.Version != "2.0" || parsed.Channel.Title != "New Items" || len(parsed.Channel.Items) != 1 {
+		t.Fatalf("Unexpected RSS %+v", parsed)
+	}
+	item := parsed.Channel.Items[0]
+	if item.Title != "A Title & More /An Author." {
+		t.Errorf("Wrong item title %v", item.Title)
+	}
+	if item.Link != "https://catalogue.library.ca/record=b7777777" || item.GUID != item.Link {
+		t.Errorf("Wrong item link %v", item.Link)
+	}
+	if item.PubDate != "Thu, 22 Jan 2015 08:00:00 +0000" {
+		t.Errorf("Wrong item pubDate %v", item.PubDate)
+	}
+	if !strings.Contains(item.Desc, "1111111111113, 11111111111") {
+		t.Errorf("Item description should include the ISBNs, got %v", item.Desc)
+	}
+}
+
+func TestAtom(t *testing.T) {
+
+	out, err := Atom(testBibs, time.Date(2015, 1, 23, 0, 0, 0, 0, time.UTC), testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string   `xml:"id"`
+		Updated string   `xml:"updated"`
+		Entries []struct {
+			ID      string `xml:"id"`
+			Title   string `xml:"title"`
+			Updated string `xml:"updated"`
+			Link    struct {
+				Href string `xml:"href,attr"`
+			} `xml:"link"`
+			Categories []struct {
+				Term string `xml:"term,attr"`
+			} `xml:"category"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(out, &parsed); err != nil {
+		t.Fatalf("Atom isn't valid XML, %v", err)
+	}
+
+	if parsed.ID != "https://tyro.library.ca/new.rss" || parsed.Updated != "2015-01-23T00:00:00Z" || len(parsed.Entries) != 1 {
+		t.Fatalf("Unexpected Atom feed %+v", parsed)
+	}
+	entry := parsed.Entries[0]
+	if entry.ID != "https://catalogue.library.ca/record=b7777777" || entry.Link.Href != entry.ID {
+		t.Errorf("Wrong entry id %v", entry.ID)
+	}
+	if entry.Updated != "2015-01-22T08:00:00Z" {
+		t.Errorf("Wrong entry updated %v", entry.Updated)
+	}
+	if len(entry.Categories) != 2 || entry.Categories[0].Term != "1111111111113" {
+		t.Errorf("Entry should include the ISBNs, got %+v", entry.Categories)
+	}
+}
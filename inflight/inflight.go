@@ -0,0 +1,55 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package inflight coalesces concurrent calls for the same key,
+//so that only one upstream request is outstanding at a time.
+//Every caller waiting on a key receives the same result.
+package inflight
+
+import (
+	"sync"
+)
+
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+type Group struct {
+	lock  sync.Mutex
+	calls map[string]*call
+}
+
+func NewGroup() *Group {
+	g := new(Group)
+	g.calls = make(map[string]*call)
+
+	return g
+}
+
+//Do runs fn and returns its results. If a call with the same key
+//is already running, Do waits for it and returns its results instead.
+//shared reports whether the results came from another caller's fn.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		<-c.done
+		return c.value, c.err, true
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(c.done)
+	}()
+
+	c.value, c.err = fn()
+	return c.value, c.err, false
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package inflight
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+
+	g := NewGroup()
+
+	value, err, shared := g.Do("key", func() (interface{}, error) {
+		return "value", nil
+	})
+	if err != nil {
+		t.Error("Do() should not have returned an error.")
+	}
+	if value.(string) != "value" {
+		t.Error("Do() returned the wrong value.")
+	}
+	if shared {
+		t.Error("A single call should not be shared.")
+	}
+
+	_, err, _ = g.Do("key", func() (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	if err == nil {
+		t.Error("Do() should have returned fn's error.")
+	}
+}
+
+func TestDoCoalescesConcurrentCalls(t *testing.T) {
+
+	g := NewGroup()
+
+	var lock sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _, _ := g.Do("key", fn)
+			results <- value
+		}()
+	}
+
+	//Give the goroutines time to pile up behind the first call.
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if calls != 1 {
+		t.Errorf("Expected fn to run once, it ran %v times.", calls)
+	}
+	for value := range results {
+		if value.(string) != "value" {
+			t.Error("Every caller should get the same value.")
+		}
+	}
+}
+
+func TestDoDifferentKeys(t *testing.T) {
+
+	g := NewGroup()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	fn := func() (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	}
+
+	go g.Do("one", fn)
+	go g.Do("two", fn)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("Calls for different keys should not wait on each other.")
+		}
+	}
+	close(release)
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package isbn cleans and validates ISBNs, and converts
+//between the ISBN-10 and ISBN-13 forms.
+package isbn
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalid  = errors.New("Invalid ISBN.")
+	ErrNoISBN10 = errors.New("Only ISBN-13s starting with 978 have an ISBN-10.")
+)
+
+//ISBN is an ISBN as it appears in a record, like
+//"0-521-87564-1 (pbk. : alk. paper)"
+type ISBN struct {
+	//The number as it was given, without hyphens or spaces.
+	Number string
+	//Both forms, if the number is valid. ISBN-13s starting
+	//with 979 don't have an ISBN-10.
+	ISBN10 string
+	ISBN13 string
+	//The qualifier, like "pbk." or "hardcover".
+	Qualifier string
+	//Whether the number has a valid checksum.
+	Valid bool
+}
+
+//Parse reads an ISBN and its qualifier, like "9780521875646 (hbk.)"
+//The number is the first word, the qualifier is in parentheses.
+func Parse(value string) ISBN {
+
+	var out ISBN
+
+	value = strings.TrimSpace(value)
+	if open := strings.Index(value, "("); open >= 0 {
+		qualifier := value[open+1:]
+		if end := strings.Index(qualifier, ")"); end >= 0 {
+			qualifier = qualifier[:end]
+		}
+		out.Qualifier = strings.TrimSpace(qualifier)
+		value = value[:open]
+	}
+
+	if fields := strings.Fields(value); len(fields) > 0 {
+		out.Number = Clean(fields[0])
+	}
+
+	if isbn13, err := To13(out.Number); err == nil {
+		out.Valid = true
+		out.ISBN13 = isbn13
+		out.ISBN10, _ = To10(isbn13)
+	}
+
+	return out
+}
+
+//Clean removes hyphens and spaces, and capitalizes a final x.
+func Clean(s string) string {
+	s = strings.Replace(s, "-", "", -1)
+	s = strings.Replace(s, " ", "", -1)
+	return strings.ToUpper(s)
+}
+
+//IsValid reports whether s is an ISBN-10 or ISBN-13 with a valid checksum.
+func IsValid(s string) bool {
+	s = Clean(s)
+	switch len(s) {
+	case 10:
+		return isDigits(s[:9]) && (isDigits(s[9:]) || s[9] == 'X') && checkDigit10(s[:9]) == s[9]
+	case 13:
+		return isDigits(s) && checkDigit13(s[:12]) == s[12]
+	}
+	return false
+}
+
+//To13 converts a valid ISBN to its ISBN-13 form.
+func To13(s string) (string, error) {
+	s = Clean(s)
+	if !IsValid(s) {
+		return "", ErrInvalid
+	}
+	if len(s) == 13 {
+		return s, nil
+	}
+	body := "978" + s[:9]
+	return body + string(checkDigit13(body)), nil
+}
+
+//To10 converts a valid ISBN to its ISBN-10 form.
+func To10(s string) (string, error) {
+	s = Clean(s)
+	if !IsValid(s) {
+		return "", ErrInvalid
+	}
+	if len(s) == 10 {
+		return s, nil
+	}
+	if !strings.HasPrefix(s, "978") {
+		return "", ErrNoISBN10
+	}
+	body := s[3:12]
+	return body + string(checkDigit10(body)), nil
+}
+
+//Equal reports whether a and b are the same ISBN, in either form.
+func Equal(a, b string) bool {
+	a13, err := To13(a)
+	if err != nil {
+		return false
+	}
+	b13, err := To13(b)
+	return err == nil && a13 == b13
+}
+
+//checkDigit10 computes the check digit for the first nine digits of an ISBN-10.
+func checkDigit10(body string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(body[i]-'0') * (10 - i)
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return strconv.Itoa(check)[0]
+}
+
+//checkDigit13 computes the check digit for the first twelve digits of an ISBN-13.
+func checkDigit13(body string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		digit := int(body[i] - '0')
+		if i%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	return strconv.Itoa((10 - sum%10) % 10)[0]
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
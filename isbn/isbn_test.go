@@ -0,0 +1,78 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package isbn
+
+import (
+	"testing"
+)
+
+func TestIsValid(t *testing.T) {
+	tests := map[string]bool{
+		"0521875641":        true,
+		"0-521-87564-1":     true,
+		"9780521875646":     true,
+		"978-0-521-87564-6": true,
+		"080442957X":        true,
+		"080442957x":        true,
+		"9791032305690":     true,
+		"0521875642":        false,
+		"9780521875647":     false,
+		"X804429570":        false,
+		"052187564":         false,
+		"97805218756A6":     false,
+		"":                  false,
+	}
+	for s, valid := range tests {
+		if IsValid(s) != valid {
+			t.Errorf("IsValid(%q) should be %v", s, valid)
+		}
+	}
+}
+
+func TestConversions(t *testing.T) {
+	tests := []struct {
+		isbn10, isbn13 string
+	}{
+		{"0521875641", "9780521875646"},
+		{"080442957X", "9780804429573"},
+		{"0306406152", "9780306406157"},
+	}
+	for _, test := range tests {
+		if out, err := To13(test.isbn10); err != nil || out != test.isbn13 {
+			t.Errorf("To13(%q) returned %q, %v, expected %q", test.isbn10, out, err, test.isbn13)
+		}
+		if out, err := To10(test.isbn13); err != nil || out != test.isbn10 {
+			t.Errorf("To10(%q) returned %q, %v, expected %q", test.isbn13, out, err, test.isbn10)
+		}
+		if !Equal(test.isbn10, test.isbn13) {
+			t.Errorf("%v and %v should be equal", test.isbn10, test.isbn13)
+		}
+	}
+
+	if _, err := To10("9791032305690"); err != ErrNoISBN10 {
+		t.Errorf("A 979 ISBN shouldn't have an ISBN-10, got %v", err)
+	}
+	if _, err := To13("0521875642"); err != ErrInvalid {
+		t.Errorf("An invalid ISBN shouldn't be converted, got %v", err)
+	}
+	if Equal("0521875641", "9780306406157") || Equal("bad", "bad") {
+		t.Error("Different or invalid ISBNs shouldn't be equal.")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]ISBN{
+		"0-521-87564-1 (pbk. : alk. paper)": {"0521875641", "0521875641", "9780521875646", "pbk. : alk. paper", true},
+		"9780521875646 (hardcover)":         {"9780521875646", "0521875641", "9780521875646", "hardcover", true},
+		"9791032305690":                     {"9791032305690", "", "9791032305690", "", true},
+		"0521875642 (v. 1)":                 {"0521875642", "", "", "v. 1", false},
+		" (pbk.)":                           {"", "", "", "pbk.", false},
+	}
+	for in, expected := range tests {
+		if out := Parse(in); out != expected {
+			t.Errorf("Parse(%q) returned %+v, expected %+v", in, out, expected)
+		}
+	}
+}
@@ -10,12 +10,23 @@ like item status.
 package main
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/cudevmaxwell/tyro/callnumber"
+	"github.com/cudevmaxwell/tyro/citation"
+	"github.com/cudevmaxwell/tyro/feed"
+	"github.com/cudevmaxwell/tyro/inflight"
 	l "github.com/cudevmaxwell/tyro/loglevel"
+	"github.com/cudevmaxwell/tyro/marc"
+	"github.com/cudevmaxwell/tyro/newbibs"
+	"github.com/cudevmaxwell/tyro/reports"
+	"github.com/cudevmaxwell/tyro/responsecache"
+	"github.com/cudevmaxwell/tyro/session"
+	"github.com/cudevmaxwell/tyro/shelf"
 	"github.com/cudevmaxwell/tyro/sierraapi"
 	"github.com/cudevmaxwell/tyro/tokenstore"
 	"log"
@@ -42,6 +53,61 @@ const (
 
 	//The default Access-Control-Allow-Origin header (CORS)
 	DefaultACAOHeader string = "*"
+
+	//The most BibIDs which can be asked for at once at /status/bibs
+	MaxBatchBibIDs int = 250
+
+	//The default number of seconds between refreshes of the /new snapshot
+	DefaultNewRefresh int = 600
+
+	//The default largest limit which can be asked for at the /new endpoint
+	DefaultNewMaxLimit int = 100
+
+	//The default number of days to look back for new items matching a filter
+	DefaultNewMaxDays int = 30
+
+	//The default title of the RSS and Atom feeds
+	DefaultFeedTitle string = "New Items"
+
+	//The default number of seconds a patron session lasts
+	DefaultSessionTTL int = 3600
+
+	//The largest request body Tyro will read, in bytes
+	MaxRequestBodySize int64 = 1 << 20
+
+	//The default number of seconds to cache /status/ responses
+	DefaultCacheTTL int = 30
+
+	//The default number of seconds a stale /status/ response can be served while it is refreshed
+	DefaultCacheStale int = 300
+
+	//The default number of seconds between harvests of changed items for the shelf index.
+	//The first harvest pages through every item, so /browse/ is off unless asked for.
+	DefaultBrowseRefresh int = 0
+
+	//The most bibs returned by a /lookup/, and the most candidates
+	//checked against their MARC records to find them
+	MaxLookupResults    int = 50
+	MaxLookupCandidates int = 1000
+
+	//The default and largest number of results on each page of a /search
+	DefaultSearchLimit int = 20
+	MaxSearchLimit     int = 100
+
+	//The default and largest number of records on each page of a /query
+	DefaultQueryLimit int = 50
+	MaxQueryLimit     int = 500
+
+	//The number of seconds between checks of the courses file for changes
+	DefaultCoursesRefresh int = 300
+
+	//The runs of each report kept on disk, and the most records in a run
+	DefaultReportKeep int = 10
+	MaxReportRows     int = 10000
+
+	//The default and largest number of records on each side of a bib at /browse/
+	DefaultBrowseSize int = 5
+	MaxBrowseSize     int = 25
 )
 
 var (
@@ -54,6 +120,29 @@ var (
 	headerACAO   = flag.String("acaoheader", DefaultACAOHeader, "Access-Control-Allow-Origin Header for CORS. Multiple origins separated by ;")
 	raw          = flag.Bool("raw", DefaultRawAccess, "Allow access to the raw Sierra API under /raw/")
 	newLimit     = flag.Int("newlimit", 16, "The number of items to serve from the /new endpoint.")
+	newMaxLimit  = flag.Int("newmaxlimit", DefaultNewMaxLimit, "The largest limit which can be asked for at the /new endpoint.")
+	newMaxDays   = flag.Int("newmaxdays", DefaultNewMaxDays, "The number of days to look back for new items at the /new endpoint, with or without filters.")
+	feedTitle    = flag.String("feedtitle", DefaultFeedTitle, "The title of the RSS and Atom feeds of new items.")
+	opacLink     = flag.String("opaclink", "", "A template for links to records in the OPAC, used in the RSS and Atom feeds and citations. {bibID} is replaced with the record's BibID.")
+	newRefresh   = flag.Int("newrefresh", DefaultNewRefresh, "The number of seconds between refreshes of the list of items served from the /new endpoint. Must be 1 or more.")
+	cacheTTL     = flag.Int("cachettl", DefaultCacheTTL, "The number of seconds responses from the /status/, /bib/, /lookup/, /query and /courses/ endpoints are cached. 0 disables the cache.")
+	cacheStale   = flag.Int("cachestale", DefaultCacheStale, "The number of seconds a cached response can be served past its TTL while it is refreshed.")
+	itemStatuses = flag.String("itemstatuses", "", "A JSON file mapping Sierra item status codes to public labels and availability classes.")
+	locations    = flag.String("locations", "", "A JSON file mapping Sierra location codes to public names, branches, floors and maps.")
+	queries      = flag.String("queries", "", "A JSON file of named queries served from /query/[name].")
+	adhocQueries = flag.Bool("adhocqueries", false, "Allow any query to be run at /query?q=[query]")
+	reportsFile  = flag.String("reports", "", "A JSON file of saved queries to run on a schedule, served from /reports/[name].")
+	reportDir    = flag.String("reportdir", "reports", "The directory the runs of each report are kept in.")
+	reportKeep   = flag.Int("reportkeep", DefaultReportKeep, "The number of runs of each report to keep.")
+	reportToken  = flag.String("reporttoken", "", "The token staff need to read /reports, sent as Authorization: Bearer [token] or ?token=[token]. Required if -reports is set.")
+	coursesFile  = flag.String("courses", "", "A JSON file of course reserves, with their instructors and items, served from /courses/. Sierra's API has no course records, so this file is kept by hand, not exported from Sierra.")
+	courseReload = flag.Int("coursesrefresh", DefaultCoursesRefresh, "The number of seconds between checks of the -courses file, which is reloaded when it changes. 0 turns off reloading.")
+
+	sessionSecret = flag.String("sessionsecret", "", "The secret used to sign patron session tokens. The /patron/ endpoints are only served if this is set.")
+	sessionTTL    = flag.Int("sessionttl", DefaultSessionTTL, "The number of seconds a patron session lasts.")
+	maxRenewals   = flag.Int("maxrenewals", 0, "The number of times a checkout can be renewed, used to flag renewable checkouts. 0 means no limit.")
+
+	browseRefresh = flag.Int("browserefresh", DefaultBrowseRefresh, "The number of seconds between harvests of changed items for the /browse/ shelf index. 0, the default, turns off /browse/.")
 
 	logFileLocation = flag.String("logfile", l.DefaultLogFileLocation, "Log file. By default, log messages will be printed to stdout.")
 	logMaxSize      = flag.Int("logmaxsize", l.DefaultLogMaxSize, "The maximum size of log files before they are rotated, in megabytes.")
@@ -62,6 +151,31 @@ var (
 	logLevel        = flag.String("loglevel", "warn", "The maximum log level which will be logged. error < warn < info < debug < trace. For example, trace will log everything, info will log info, warn, and error.")
 
 	tokenStore = tokenstore.NewTokenStore()
+
+	inFlight = inflight.NewGroup()
+
+	sessionSigner = session.NewSigner("", time.Duration(DefaultSessionTTL)*time.Second)
+
+	newBibs = newbibs.NewSnapshot()
+
+	shelfIndex = shelf.NewIndex()
+
+	filteredNewCache = responsecache.NewCache(time.Duration(DefaultNewRefresh)*time.Second, time.Duration(DefaultNewRefresh)*time.Second)
+
+	statusCache = responsecache.NewCache(time.Duration(DefaultCacheTTL)*time.Second, time.Duration(DefaultCacheStale)*time.Second)
+
+	//The other endpoints have their own caches, so the
+	//counters at /stats are kept for each of them.
+	bibCache     = responsecache.NewCache(time.Duration(DefaultCacheTTL)*time.Second, time.Duration(DefaultCacheStale)*time.Second)
+	lookupCache  = responsecache.NewCache(time.Duration(DefaultCacheTTL)*time.Second, time.Duration(DefaultCacheStale)*time.Second)
+	queryCache   = responsecache.NewCache(time.Duration(DefaultCacheTTL)*time.Second, time.Duration(DefaultCacheStale)*time.Second)
+	coursesCache = responsecache.NewCache(time.Duration(DefaultCacheTTL)*time.Second, time.Duration(DefaultCacheStale)*time.Second)
+
+	savedQueries = map[string]sierraapi.SavedQuery{}
+
+	savedReports = map[string]reports.Report{}
+
+	reportStore = reports.NewStore("reports", DefaultReportKeep)
 )
 
 func init() {
@@ -77,7 +191,7 @@ func init() {
 		})
 
 		fmt.Fprintln(os.Stderr, "If a certificate file is provided, Tyro will attempt to use HTTPS.")
-		fmt.Fprintln(os.Stderr, "The Access-Control-Allow-Origin header for CORS is only set for the /status/bib/[bibID], /status/item/[itemID] and /new endpoints.")
+		fmt.Fprintln(os.Stderr, "The Access-Control-Allow-Origin header for CORS is only set for the /status/bib/[bibID], /status/bibs, /status/item/[itemID], /bib/[bibID], /lookup/, /search, /query, /courses/, /new, /browse/ and /patron/ endpoints.")
 	}
 }
 
@@ -102,6 +216,9 @@ func main() {
 	l.Log("Connecting to API URL: "+*apiURL, l.InfoMessage)
 	l.Log("Using ACAO header: "+*headerACAO, l.InfoMessage)
 	l.Log(fmt.Sprintf("Allowing access to raw Sierra API: %v", *raw), l.InfoMessage)
+	l.Log("Using OPAC link template: "+*opacLink, l.InfoMessage)
+	l.Log(fmt.Sprintf("Refreshing the /new list every %v seconds", *newRefresh), l.InfoMessage)
+	l.Log(fmt.Sprintf("Caching /status/ responses for %v seconds, serving stale for %v seconds", *cacheTTL, *cacheStale), l.InfoMessage)
 
 	if *clientKey == "" {
 		log.Fatal("FATAL: A client key is required to authenticate against the Sierra API.")
@@ -109,6 +226,10 @@ func main() {
 		log.Fatal("FATAL: A client secret is required to authenticate against the Sierra API.")
 	}
 
+	if *newRefresh < 1 {
+		log.Fatal("FATAL: The /new list can be refreshed at most once a second, -newrefresh must be 1 or more.")
+	}
+
 	if *headerACAO == "*" {
 		l.Log("Using \"*\" for \"Access-Control-Allow-Origin\" header. API will be public!", l.WarnMessage)
 	}
@@ -119,6 +240,55 @@ func main() {
 		l.Log("Using Private Key File: "+*keyFile, l.InfoMessage)
 	}
 
+	if *itemStatuses != "" {
+		l.Log("Loading item statuses from: "+*itemStatuses, l.InfoMessage)
+		if err := sierraapi.LoadItemStatuses(*itemStatuses); err != nil {
+			log.Fatal("FATAL: Unable to load item statuses. ", err)
+		}
+	}
+
+	if *locations != "" {
+		l.Log("Loading locations from: "+*locations, l.InfoMessage)
+		if err := sierraapi.LoadLocations(*locations); err != nil {
+			log.Fatal("FATAL: Unable to load locations. ", err)
+		}
+	}
+
+	if *queries != "" {
+		l.Log("Loading saved queries from: "+*queries, l.InfoMessage)
+		loaded, err := sierraapi.LoadSavedQueries(*queries)
+		if err != nil {
+			log.Fatal("FATAL: Unable to load saved queries. ", err)
+		}
+		savedQueries = loaded
+	}
+
+	if *coursesFile != "" {
+		l.Log("Loading courses from: "+*coursesFile, l.InfoMessage)
+		if err := sierraapi.LoadCourses(*coursesFile); err != nil {
+			log.Fatal("FATAL: Unable to load courses. ", err)
+		}
+	}
+
+	if *adhocQueries {
+		l.Log("Allowing any query to be run at /query", l.WarnMessage)
+	}
+
+	if *reportsFile != "" {
+		l.Log("Loading reports from: "+*reportsFile, l.InfoMessage)
+		loaded, err := reports.Load(*reportsFile)
+		if err != nil {
+			log.Fatal("FATAL: Unable to load reports. ", err)
+		}
+		if *reportKeep < 1 {
+			log.Fatal("FATAL: At least one run of each report needs to be kept.")
+		}
+		if *reportToken == "" {
+			log.Fatal("FATAL: Reports are for staff, a -reporttoken is needed to serve them.")
+		}
+		savedReports = loaded
+	}
+
 	parsedURL, err := parseURLandJoinToPath(*apiURL, sierraapi.TokenRequestEndpoint)
 	if err != nil {
 		log.Fatal("FATAL: Unable to parse API URL.")
@@ -127,11 +297,69 @@ func main() {
 	tokenStore.Refresher(parsedURL.String(), *clientKey, *clientSecret)
 	defer close(tokenStore.Refresh)
 
+	statusCache = responsecache.NewCache(time.Duration(*cacheTTL)*time.Second, time.Duration(*cacheStale)*time.Second)
+	bibCache = responsecache.NewCache(time.Duration(*cacheTTL)*time.Second, time.Duration(*cacheStale)*time.Second)
+	lookupCache = responsecache.NewCache(time.Duration(*cacheTTL)*time.Second, time.Duration(*cacheStale)*time.Second)
+	queryCache = responsecache.NewCache(time.Duration(*cacheTTL)*time.Second, time.Duration(*cacheStale)*time.Second)
+	coursesCache = responsecache.NewCache(time.Duration(*cacheTTL)*time.Second, time.Duration(*cacheStale)*time.Second)
+
+	newBibs.Poller(time.Duration(*newRefresh)*time.Second, fetchNewBibs)
+	filteredNewCache = responsecache.NewCache(time.Duration(*newRefresh)*time.Second, time.Duration(*newRefresh)*time.Second)
+	defer close(newBibs.Refresh)
+
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/status/", statusHandler)
 	http.HandleFunc("/status/item/", statusItemHandler)
 	http.HandleFunc("/status/bib/", statusBibHandler)
+	http.HandleFunc("/status/bibs", statusBibsHandler)
+	http.HandleFunc("/bib/", bibHandler)
+	http.HandleFunc("/lookup/", lookupHandler)
+	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/query", queryHandler)
+	http.HandleFunc("/query/", queryHandler)
+	if *coursesFile != "" {
+		if *courseReload > 0 {
+			stopCourses := make(chan struct{})
+			sierraapi.WatchCourses(*coursesFile, time.Duration(*courseReload)*time.Second, stopCourses)
+			defer close(stopCourses)
+		}
+		http.HandleFunc("/courses", coursesHandler)
+		http.HandleFunc("/courses/", coursesHandler)
+	}
+	if len(savedReports) > 0 {
+		l.Log(fmt.Sprintf("Running %v reports, keeping %v runs of each in %v", len(savedReports), *reportKeep, *reportDir), l.InfoMessage)
+		reportStore = reports.NewStore(*reportDir, *reportKeep)
+		for name, report := range savedReports {
+			reportStore.Scheduler(name, report, runReport)
+		}
+		defer close(reportStore.Stop)
+		http.HandleFunc("/reports", reportsHandler)
+		http.HandleFunc("/reports/", reportsHandler)
+	}
 	http.HandleFunc("/new", newBibsHandler)
+	http.HandleFunc("/new.rss", newBibsHandler)
+	http.HandleFunc("/new.atom", newBibsHandler)
+	http.HandleFunc("/stats", statsHandler)
+	if *browseRefresh > 0 {
+		l.Log(fmt.Sprintf("Serving /browse/, harvesting changed items every %v seconds.", *browseRefresh), l.InfoMessage)
+		shelfIndex.Harvester(time.Duration(*browseRefresh)*time.Second, harvestShelf)
+		defer close(shelfIndex.Refresh)
+		http.HandleFunc("/browse/", browseHandler)
+	} else {
+		l.Log("The /browse/ endpoint is turned off.", l.InfoMessage)
+	}
+	if *sessionSecret != "" {
+		l.Log("Serving the /patron/ endpoints.", l.InfoMessage)
+		sessionSigner = session.NewSigner(*sessionSecret, time.Duration(*sessionTTL)*time.Second)
+		http.HandleFunc("/patron/validate", patronValidateHandler)
+		http.HandleFunc("/patron/checkouts", patronCheckoutsHandler)
+		http.HandleFunc("/patron/checkouts/renew", patronRenewHandler)
+		http.HandleFunc("/patron/holds", patronHoldsHandler)
+		http.HandleFunc("/patron/holds/", patronHoldHandler)
+		http.HandleFunc("/patron/fines", patronFinesHandler)
+	} else {
+		l.Log("No session secret set, the /patron/ endpoints are turned off.", l.InfoMessage)
+	}
 	if *raw {
 		l.Log("Allowing access to raw Sierra API.", l.WarnMessage)
 		rawProxy := httputil.NewSingleHostReverseProxy(&url.URL{})
@@ -173,12 +401,6 @@ func statusItemHandler(w http.ResponseWriter, r *http.Request) {
 
 	setACAOHeader(w, r, *headerACAO)
 
-	token, err := getTokenOrError(w, r)
-	if err != nil {
-		l.Log(err, l.ErrorMessage)
-		return
-	}
-
 	itemID := strings.Split(r.URL.Path[len("/status/item/"):], "/")[0]
 	if itemID == "" {
 		http.Error(w, "Error, you need to provide an ItemID. /status/item/[ItemID]", http.StatusBadRequest)
@@ -198,44 +420,38 @@ func statusItemHandler(w http.ResponseWriter, r *http.Request) {
 	q.Set("deleted", "false")
 	parsedAPIURL.RawQuery = q.Encode()
 
-	resp, err := sierraapi.SendRequestToAPI(parsedAPIURL.String(), token, w, r)
-	if err != nil {
-		l.Log(fmt.Sprintf("Internal Server Error at /status/item/, %v", err), l.ErrorMessage)
-		return
-	}
-	if resp.StatusCode == http.StatusUnauthorized {
-		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
-		tokenStore.Refresh <- struct{}{}
-		l.Log("Token is out of date.", l.ErrorMessage)
-		return
+	fetch := func(token string) (interface{}, error) {
+		response, err := getJSON(parsedAPIURL.String(), token, r, func() interface{} { return new(sierraapi.ItemRecordIn) })
+		if err != nil {
+			return nil, err
+		}
+		return response.(*sierraapi.ItemRecordIn).Convert(), nil
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		http.Error(w, "No item records for that ItemID.", http.StatusNotFound)
-		l.Log(fmt.Sprintf("No items records match ItemID %v", itemID), l.TraceMessage)
+
+	if cached, ok := getCached(statusCache, parsedAPIURL.String(), fetch); ok {
+		sendJSON(w, cached, "/status/item/")
 		return
 	}
 
-	var responseJSON sierraapi.ItemRecordIn
-
-	err = json.NewDecoder(resp.Body).Decode(&responseJSON)
-	defer resp.Body.Close()
+	token, err := getTokenOrError(w, r)
 	if err != nil {
-		http.Error(w, "JSON Decoding Error", http.StatusInternalServerError)
-		l.Log(fmt.Sprintf("Internal Server Error at /status/item/ handler, JSON Decoding Error: %v", err), l.WarnMessage)
+		l.Log(err, l.ErrorMessage)
 		return
 	}
 
-	finalJSON, err := json.Marshal(responseJSON.Convert())
+	response, err := fetch(token)
+	if err == sierraapi.ErrNotFound {
+		http.Error(w, "No item records for that ItemID.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("No items records match ItemID %v", itemID), l.TraceMessage)
+		return
+	}
 	if err != nil {
-		http.Error(w, "JSON Encoding Error", http.StatusInternalServerError)
-		l.Log(fmt.Sprintf("Internal Server Error at /status/item/ handler, JSON Encoding Error: %v", err), l.WarnMessage)
+		handleAPIError(w, err, "/status/item/")
 		return
 	}
 
-	l.Log(fmt.Sprintf("Sending response at /status/item handler: %v", responseJSON.Convert()), l.TraceMessage)
-
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	w.Write(finalJSON)
+	statusCache.Set(parsedAPIURL.String(), response)
+	sendJSON(w, response, "/status/item/")
 
 }
 
@@ -243,246 +459,2440 @@ func statusBibHandler(w http.ResponseWriter, r *http.Request) {
 
 	setACAOHeader(w, r, *headerACAO)
 
-	token, err := getTokenOrError(w, r)
-	if err != nil {
-		l.Log(err, l.ErrorMessage)
-		return
-	}
-
-	bibID := strings.Split(r.URL.Path[len("/status/bib/"):], "/")[0]
+	bibID, ok := normalizeBibID(strings.Split(r.URL.Path[len("/status/bib/"):], "/")[0])
 
-	if bibID == "" {
+	if !ok {
 		http.Error(w, "Error, you need to provide a BibID. /status/bib/[BidID]", http.StatusBadRequest)
-		l.Log("Bad Request at /status/bib/ handler, no BidID provided.", l.TraceMessage)
+		l.Log("Bad Request at /status/bib/ handler, no valid BidID provided.", l.TraceMessage)
 		return
 	}
 
-	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.ItemRequestEndpoint)
+	parsedAPIURL, err := bibStatusURL(bibID)
 	if err != nil {
 		http.Error(w, "Server Error.", http.StatusInternalServerError)
 		l.Log("Internal Server Error at /status/bib/ handler, unable to parse url.", l.DebugMessage)
 		return
 	}
 
-	q := parsedAPIURL.Query()
-	q.Set("bibIds", bibID)
-	q.Set("deleted", "false")
-	q.Set("suppressed", "false")
-	parsedAPIURL.RawQuery = q.Encode()
+	cacheKey := parsedAPIURL.String()
+	fetch := bibStatusFetcher(parsedAPIURL.String(), r)
 
-	resp, err := sierraapi.SendRequestToAPI(parsedAPIURL.String(), token, w, r)
-	if err != nil {
-		l.Log(fmt.Sprintf("Internal Server Error at /status/bib/, %v", err), l.ErrorMessage)
-		return
-	}
-	if resp.StatusCode == http.StatusUnauthorized {
-		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
-		tokenStore.Refresh <- struct{}{}
-		l.Log("Token is out of date.", l.ErrorMessage)
-		return
+	if r.FormValue("summary") == "true" {
+		cacheKey += "#summary"
+		fetch = bibSummaryFetcher(bibID, fetch, r)
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		http.Error(w, "No item records for that BibID.", http.StatusNotFound)
-		l.Log(fmt.Sprintf("No items records match BibID %v", bibID), l.TraceMessage)
+
+	if cached, ok := getCached(statusCache, cacheKey, fetch); ok {
+		sendJSON(w, cached, "/status/bib/")
 		return
 	}
 
-	var responseJSON sierraapi.ItemRecordsIn
-
-	err = json.NewDecoder(resp.Body).Decode(&responseJSON)
-	defer resp.Body.Close()
+	token, err := getTokenOrError(w, r)
 	if err != nil {
-		http.Error(w, "JSON Decoding Error", http.StatusInternalServerError)
-		l.Log(fmt.Sprintf("Internal Server Error at /status/bib/ handler, JSON Decoding Error: %v", err), l.WarnMessage)
+		l.Log(err, l.ErrorMessage)
 		return
 	}
 
-	finalJSON, err := json.Marshal(responseJSON.Convert())
+	response, err := fetch(token)
+	if err == sierraapi.ErrNotFound {
+		http.Error(w, "No item records for that BibID.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("No items records match BibID %v", bibID), l.TraceMessage)
+		return
+	}
 	if err != nil {
-		http.Error(w, "JSON Encoding Error", http.StatusInternalServerError)
-		l.Log(fmt.Sprintf("Internal Server Error at /status/bib/ handler, JSON Encoding Error: %v", err), l.WarnMessage)
+		handleAPIError(w, err, "/status/bib/")
 		return
 	}
 
-	l.Log(fmt.Sprintf("Sending response at /status/bib/ handler: %v", responseJSON.Convert()), l.TraceMessage)
-
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	w.Write(finalJSON)
+	statusCache.Set(cacheKey, response)
+	sendJSON(w, response, "/status/bib/")
 
 }
 
-func newBibsHandler(w http.ResponseWriter, r *http.Request) {
+func statusBibsHandler(w http.ResponseWriter, r *http.Request) {
 
 	setACAOHeader(w, r, *headerACAO)
 
-	entries := make(map[int]sierraapi.BibRecordOut)
+	if handlePreflight(w, r, "GET, POST") {
+		return
+	}
 
-	entries, err := getNewItems(entries, time.Now(), w, r)
+	bibIDs, err := parseBibIDs(r)
 	if err != nil {
+		http.Error(w, "Error, unable to read the list of BibIDs.", http.StatusBadRequest)
+		l.Log(fmt.Sprintf("Bad Request at /status/bibs handler, %v", err), l.TraceMessage)
+		return
+	}
+	if len(bibIDs) == 0 {
+		http.Error(w, "Error, you need to provide a list of BibIDs. /status/bibs?ids=[BibID],[BibID]", http.StatusBadRequest)
+		l.Log("Bad Request at /status/bibs handler, no BibIDs provided.", l.TraceMessage)
+		return
+	}
+	if len(bibIDs) > MaxBatchBibIDs {
+		http.Error(w, fmt.Sprintf("Error, no more than %v BibIDs can be requested at once.", MaxBatchBibIDs), http.StatusBadRequest)
+		l.Log(fmt.Sprintf("Bad Request at /status/bibs handler, %v BibIDs provided.", len(bibIDs)), l.TraceMessage)
 		return
 	}
 
-	var response sierraapi.BibRecordsOut
+	response := make(map[string]*sierraapi.ItemRecordsOut)
+	keys := make(map[string]string)
+	var uncached []string
 
-	for _, entry := range entries {
-		response = append(response, entry)
+	for _, bibID := range bibIDs {
+		parsedAPIURL, err := bibStatusURL(bibID)
+		if err != nil {
+			http.Error(w, "Server Error.", http.StatusInternalServerError)
+			l.Log("Internal Server Error at /status/bibs handler, unable to parse url.", l.DebugMessage)
+			return
+		}
+		keys[bibID] = parsedAPIURL.String()
+
+		if cached, ok := getCached(statusCache, keys[bibID], bibStatusFetcher(keys[bibID], r)); ok {
+			response[bibID] = cached.(*sierraapi.ItemRecordsOut)
+		} else {
+			uncached = append(uncached, bibID)
+		}
 	}
 
-	sort.Sort(sort.Reverse(response))
+	if len(uncached) > 0 {
+		token, err := getTokenOrError(w, r)
+		if err != nil {
+			l.Log(err, l.ErrorMessage)
+			return
+		}
 
-	finalJSON, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, "JSON Encoding Error", http.StatusInternalServerError)
-		l.Log(fmt.Sprintf("Internal Server Error at /new handler, JSON Encoding Error: %v", err), l.WarnMessage)
-		return
+		fetched, err := getItemsForBibs(uncached, token, r)
+		if err != nil {
+			handleAPIError(w, err, "/status/bibs")
+			return
+		}
+
+		for _, bibID := range uncached {
+			//A bib without items is a 404 at /status/bib/, so don't cache it.
+			if len(fetched[bibID].Entries) > 0 {
+				statusCache.Set(keys[bibID], fetched[bibID])
+			}
+			response[bibID] = fetched[bibID]
+		}
 	}
 
-	l.Log(fmt.Sprintf("Sending response at /new handler: %v", response), l.TraceMessage)
+	sendJSON(w, response, "/status/bibs")
+}
 
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8 ")
-	w.Write(finalJSON)
+//normalizeBibID turns a BibID like 2401597, b2401597 or b24015973,
+//with its check digit, into the number Sierra uses for the bib.
+func normalizeBibID(raw string) (string, bool) {
+	bibID := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(raw), "."))
+	if strings.HasPrefix(bibID, "b") {
+		bibID = bibID[1:]
+		if len(bibID) == 8 {
+			bibID = bibID[:7]
+		}
+	}
+	id, err := strconv.Atoi(bibID)
+	if err != nil || id < 1 {
+		return "", false
+	}
+	return strconv.Itoa(id), true
 }
 
-func getNumberOfEntries(date time.Time, w http.ResponseWriter, r *http.Request) (int, error) {
+//parseBibIDs reads the list of BibIDs from a /status/bibs request,
+//either from a JSON body like {"bibIds":[1,2]}, or from the
+//ids form value, separated by commas. Each BibID is normalized.
+func parseBibIDs(r *http.Request) ([]string, error) {
 
-	type totalResponse struct {
-		Total int `json:"total"`
-	}
+	var raw []string
 
-	token, err := getTokenOrError(w, r)
-	if err != nil {
-		l.Log(err, l.ErrorMessage)
-		return 0, err
+	if r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			BibIDs []json.Number `json:"bibIds"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			return nil, err
+		}
+		for _, bibID := range body.BibIDs {
+			raw = append(raw, bibID.String())
+		}
+	} else {
+		raw = strings.Split(r.FormValue("ids"), ",")
 	}
 
-	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
-	if err != nil {
-		http.Error(w, "Server Error.", http.StatusInternalServerError)
-		l.Log("Internal Server Error at /new handler, unable to parse url.", l.DebugMessage)
-		return 0, err
+	seen := make(map[string]bool)
+	var bibIDs []string
+	for _, bibID := range raw {
+		if strings.TrimSpace(bibID) == "" {
+			continue
+		}
+		normalized, ok := normalizeBibID(bibID)
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a BibID", bibID)
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			bibIDs = append(bibIDs, normalized)
+		}
 	}
 
-	q := parsedAPIURL.Query()
-	q.Set("limit", "1")
-	q.Set("offset", "0")
-	q.Set("deleted", "false")
-	q.Set("suppressed", "false")
-	q.Set("createdDate", fmt.Sprintf("[%v,%v]", date.AddDate(0, 0, -1).Format(time.RFC3339), date.Format(time.RFC3339)))
-	q.Set("fields", "default")
-	parsedAPIURL.RawQuery = q.Encode()
+	return bibIDs, nil
+}
 
-	resp, err := sierraapi.SendRequestToAPI(parsedAPIURL.String(), token, w, r)
-	if err != nil {
-		l.Log(fmt.Sprintf("Internal Server Error at /new, %v", err), l.ErrorMessage)
-		return 0, err
-	}
-	if resp.StatusCode == http.StatusUnauthorized {
-		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
-		tokenStore.Refresh <- struct{}{}
-		l.Log("Token is out of date.", l.ErrorMessage)
-		return 0, errors.New("Unauthorized")
+//getItemsForBibs fetches the items attached to many bibs, MaxBibIDsPerRequest
+//bibs at a time, following Sierra's paging until every item is retrieved.
+//Every BibID asked for is in the returned map, even if it has no items.
+func getItemsForBibs(bibIDs []string, token string, r *http.Request) (map[string]*sierraapi.ItemRecordsOut, error) {
+
+	byBib := make(map[string]*sierraapi.ItemRecordsIn)
+	for _, bibID := range bibIDs {
+		byBib[bibID] = new(sierraapi.ItemRecordsIn)
 	}
 
-	var response totalResponse
+	for start := 0; start < len(bibIDs); start += sierraapi.MaxBibIDsPerRequest {
+		end := start + sierraapi.MaxBibIDsPerRequest
+		if end > len(bibIDs) {
+			end = len(bibIDs)
+		}
+
+		for offset := 0; ; offset += sierraapi.ItemsPerPage {
+			parsedAPIURL, err := bibStatusURL(strings.Join(bibIDs[start:end], ","))
+			if err != nil {
+				return nil, err
+			}
+			q := parsedAPIURL.Query()
+			q.Set("limit", strconv.Itoa(sierraapi.ItemsPerPage))
+			q.Set("offset", strconv.Itoa(offset))
+			parsedAPIURL.RawQuery = q.Encode()
+
+			response, err := getJSON(parsedAPIURL.String(), token, r, func() interface{} { return new(sierraapi.ItemRecordsIn) })
+			if err == sierraapi.ErrNotFound {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
 
-	err = json.NewDecoder(resp.Body).Decode(&response)
+			page := response.(*sierraapi.ItemRecordsIn)
+			for _, item := range page.Entries {
+				for _, bibID := range item.BibIDs {
+					if records, ok := byBib[bibID.String()]; ok {
+						records.Entries = append(records.Entries, item)
+					}
+				}
+			}
 
-	return response.Total, nil
+			if len(page.Entries) < sierraapi.ItemsPerPage {
+				break
+			}
+		}
+	}
 
+	//A bib without items has an empty list, not null.
+	out := make(map[string]*sierraapi.ItemRecordsOut)
+	for bibID, records := range byBib {
+		out[bibID] = records.Convert()
+		if out[bibID].Entries == nil {
+			out[bibID].Entries = []sierraapi.ItemRecordOut{}
+		}
+	}
+	return out, nil
 }
 
-func getNewItems(alreadyProcessed map[int]sierraapi.BibRecordOut, date time.Time, w http.ResponseWriter, r *http.Request) (map[int]sierraapi.BibRecordOut, error) {
+func bibHandler(w http.ResponseWriter, r *http.Request) {
 
-	token, err := getTokenOrError(w, r)
-	if err != nil {
-		l.Log(err, l.ErrorMessage)
-		return nil, err
-	}
+	setACAOHeader(w, r, *headerACAO)
 
-	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
-	if err != nil {
-		http.Error(w, "Server Error.", http.StatusInternalServerError)
-		l.Log("Internal Server Error at /new handler, unable to parse url.", l.DebugMessage)
-		return nil, err
+	name := strings.Split(r.URL.Path[len("/bib/"):], "/")[0]
+	extension := path.Ext(name)
+	bibID := strings.TrimSuffix(name, extension)
+
+	if _, err := strconv.Atoi(bibID); err != nil {
+		http.Error(w, "Error, you need to provide a BibID. /bib/[BidID]", http.StatusBadRequest)
+		l.Log("Bad Request at /bib/ handler, no valid BidID provided.", l.TraceMessage)
+		return
 	}
 
-	total, err := getNumberOfEntries(date, w, r)
-	if err != nil {
-		return nil, err
+	format, ok := bibFormat(extension, r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "Error, unknown format. Use .xml, .mrc, .marcjson, .ris, .bib, .csljson, .coins or .jsonld", http.StatusNotFound)
+		l.Log(fmt.Sprintf("Bad Request at /bib/ handler, unknown format %v", extension), l.TraceMessage)
+		return
+	}
+	if extension == "" {
+		w.Header().Set("Vary", "Accept")
 	}
-	offset := 0
-	needOneMoreDay := false
 
-	if total >= *newLimit {
-		offset = total - *newLimit
-	} else {
-		needOneMoreDay = true
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint, bibID)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /bib/ handler, unable to parse url.", l.DebugMessage)
+		return
 	}
 
 	q := parsedAPIURL.Query()
-	q.Set("offset", strconv.Itoa(offset))
-	q.Set("deleted", "false")
-	q.Set("createdDate", fmt.Sprintf("[%v,%v]", date.AddDate(0, 0, -1).Format(time.RFC3339), date.Format(time.RFC3339)))
-	q.Set("fields", "marc,default")
-	q.Set("suppressed", "false")
+	q.Set("fields", "default,marc")
 	parsedAPIURL.RawQuery = q.Encode()
 
-	resp, err := sierraapi.SendRequestToAPI(parsedAPIURL.String(), token, w, r)
-	if err != nil {
-		l.Log(fmt.Sprintf("Internal Server Error at /new, %v", err), l.ErrorMessage)
-		return nil, err
-	}
-	if resp.StatusCode == http.StatusUnauthorized {
-		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
-		tokenStore.Refresh <- struct{}{}
-		l.Log("Token is out of date.", l.ErrorMessage)
-		return nil, err
+	//The bib is cached as it came from Sierra, so each format can be made from it.
+	cacheKey := parsedAPIURL.String()
+	fetch := func(token string) (interface{}, error) {
+		response, err := getJSON(cacheKey, token, r, func() interface{} { return new(sierraapi.BibRecordIn) })
+		if err != nil {
+			return nil, err
+		}
+		bib := response.(*sierraapi.BibRecordIn)
+		if bib.Deleted || bib.Suppressed {
+			return nil, sierraapi.ErrNotFound
+		}
+		return bib, nil
 	}
 
-	var response sierraapi.BibRecordsIn
+	if cached, ok := getCached(bibCache, cacheKey, fetch); ok {
+		sendBib(w, cached.(*sierraapi.BibRecordIn), format)
+		return
+	}
 
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
 
-	defer resp.Body.Close()
+	response, err := fetch(token)
+	if err == sierraapi.ErrNotFound {
+		http.Error(w, "No bib record with that BibID.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("No bib record matches BibID %v", bibID), l.TraceMessage)
+		return
+	}
 	if err != nil {
-		http.Error(w, "JSON Decoding Error", http.StatusInternalServerError)
-		l.Log(fmt.Sprintf("Internal Server Error at /new handler, JSON Decoding Error: %v", err), l.WarnMessage)
-		return nil, err
+		handleAPIError(w, err, "/bib/")
+		return
 	}
 
-	entries := response.Convert()
+	bibCache.Set(cacheKey, response)
+	sendBib(w, response.(*sierraapi.BibRecordIn), format)
 
-	for _, entry := range *entries {
-		alreadyProcessed[entry.BibID] = entry
-	}
+}
 
-	if needOneMoreDay {
-		return getNewItems(alreadyProcessed, date.Add(time.Duration(1435)*time.Minute*-1), w, r)
-	} else {
-		return alreadyProcessed, nil
-	}
+//The formats of /bib/ responses, by extension.
+var bibFormats = map[string]string{
+	".xml":      marc.XMLContentType,
+	".mrc":      marc.ISO2709ContentType,
+	".marcjson": marc.JSONContentType,
+	".ris":      citation.RISContentType,
+	".bib":      citation.BibTeXContentType,
+	".csljson":  citation.CSLJSONContentType,
+	".coins":    citation.COinSContentType,
+	".jsonld":   citation.SchemaOrgContentType,
+}
 
+//The formats of /bib/ responses which can be asked for in the Accept header.
+//COinS is left out, browsers ask for text/html.
+var bibAcceptFormats = []string{
+	marc.XMLContentType,
+	marc.ISO2709ContentType,
+	marc.JSONContentType,
+	citation.RISContentType,
+	citation.BibTeXContentType,
+	citation.CSLJSONContentType,
+	citation.SchemaOrgContentType,
 }
 
-func rawRewriter(r *http.Request) {
+//bibFormat picks the format of a /bib/ response from the extension,
+//or if there is none, the Accept header. "" is the simplified JSON record.
+func bibFormat(extension, accept string) (string, bool) {
+	if extension != "" {
+		format, ok := bibFormats[extension]
+		return format, ok
+	}
+	for _, contentType := range bibAcceptFormats {
+		for _, accepted := range strings.Split(accept, ",") {
+			if strings.TrimSpace(strings.Split(accepted, ";")[0]) == contentType {
+				return contentType, true
+			}
+		}
+	}
+	return "", true
+}
 
-	token, err := tokenStore.Get()
-	if err != nil {
-		l.Log("Error at /raw/ handler, token not yet generated.", l.DebugMessage)
+//sendBib writes the bib as a simplified JSON record, its MARC record, or a citation in format.
+func sendBib(w http.ResponseWriter, bib *sierraapi.BibRecordIn, format string) {
+
+	config := &feed.Config{RecordLinkTemplate: *opacLink}
+	cite := func() *citation.Record { return citation.New(bib, config.RecordLink(bib.ID)) }
+
+	var out []byte
+	var err error
+	contentType := format + ";charset=UTF-8"
+	switch format {
+	case marc.XMLContentType:
+		out, err = marc.XML(&bib.Marc)
+	case marc.ISO2709ContentType:
+		out, err = marc.ISO2709(&bib.Marc)
+		contentType = format
+	case marc.JSONContentType:
+		out, err = marc.JSON(&bib.Marc)
+	case citation.RISContentType:
+		out = citation.RIS(cite())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"b%v.ris\"", bib.ID))
+	case citation.BibTeXContentType:
+		out = citation.BibTeX(cite())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"b%v.bib\"", bib.ID))
+	case citation.CSLJSONContentType:
+		out, err = citation.CSLJSON(cite())
+	case citation.COinSContentType:
+		out = citation.COinS(cite())
+	case citation.SchemaOrgContentType:
+		out, err = citation.SchemaOrg(cite())
+	default:
+		sendJSON(w, bib.Detail(), "/bib/")
+		return
 	}
 
-	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, r.URL.Path[len("/raw/"):])
 	if err != nil {
-		log.Fatalf("FATAL: %v", err)
+		w.Header().Del("Content-Disposition")
+		http.Error(w, "Encoding Error", http.StatusInternalServerError)
+		l.Log(fmt.Sprintf("Internal Server Error at /bib/ handler, %v Encoding Error for bib %v: %v", format, bib.ID, err), l.WarnMessage)
+		return
 	}
 
-	parsedAPIURL.RawQuery = r.URL.RawQuery
+	l.Log(fmt.Sprintf("Sending %v for bib %v at /bib/ handler", format, bib.ID), l.TraceMessage)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out)
+}
 
-	r.URL = parsedAPIURL
+//LookupOut is the bibs found by a /lookup/, with their
+//records and item statuses if they were asked for.
+type LookupOut struct {
+	Type   string
+	Value  string
+	BibIDs []int
+	Bibs   []*sierraapi.BibDetailOut            `json:",omitempty"`
+	Status map[string]*sierraapi.ItemRecordsOut `json:",omitempty"`
+}
 
-	err = sierraapi.SetAuthorizationHeaders(r, r, token)
-	if err != nil {
-		l.Log("The remote address in an incoming request is not set properly", l.DebugMessage)
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	parts := strings.Split(strings.Trim(r.URL.Path[len("/lookup/"):], "/"), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		http.Error(w, "Error, use /lookup/isbn/[ISBN], /lookup/issn/[ISSN], /lookup/oclc/[OCLC number] or /lookup/barcode/[barcode]", http.StatusBadRequest)
+		l.Log(fmt.Sprintf("Bad Request at /lookup/ handler, bad path %v", r.URL.Path), l.TraceMessage)
+		return
+	}
+	kind, value := parts[0], parts[1]
+
+	if kind != "barcode" {
+		lookup, ok := sierraapi.Lookups[kind]
+		if !ok {
+			http.Error(w, "Error, you can look up bibs by isbn, issn, oclc or barcode.", http.StatusNotFound)
+			l.Log(fmt.Sprintf("Bad Request at /lookup/ handler, unknown type %v", kind), l.TraceMessage)
+			return
+		}
+		if value, ok = lookup.Normalize(value); !ok {
+			http.Error(w, fmt.Sprintf("Error, %v is not a valid %v.", parts[1], strings.ToUpper(kind)), http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /lookup/ handler, invalid %v %v", kind, parts[1]), l.TraceMessage)
+			return
+		}
+	}
+
+	include := make(map[string]bool)
+	for _, i := range splitList(r.FormValue("include")) {
+		include[i] = true
+	}
+
+	cacheKey := fmt.Sprintf("/lookup/%v/%v?include=bib:%v,status:%v", kind, value, include["bib"], include["status"])
+	fetch := func(token string) (interface{}, error) {
+		return getLookup(kind, value, include["bib"], include["status"], token, r)
+	}
+
+	if cached, ok := getCached(lookupCache, cacheKey, fetch); ok {
+		sendJSON(w, cached, "/lookup/")
+		return
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+
+	response, err := fetch(token)
+	if err == sierraapi.ErrNotFound {
+		http.Error(w, "No bibs match.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("No bibs match %v %v", kind, value), l.TraceMessage)
+		return
+	}
+	if err != nil {
+		handleAPIError(w, err, "/lookup/")
+		return
+	}
+
+	lookupCache.Set(cacheKey, response)
+	sendJSON(w, response, "/lookup/")
+}
+
+//getLookup resolves a standard number or barcode to bib IDs,
+//and fetches their records and item statuses if asked.
+//It returns ErrNotFound if no bibs match.
+func getLookup(kind, value string, withBibs, withStatus bool, token string, r *http.Request) (*LookupOut, error) {
+
+	out := &LookupOut{Type: kind, Value: value}
+
+	var bibIDs []int
+	var err error
+	if kind == "barcode" {
+		bibIDs, err = getBibIDsForBarcode(value, token, r)
+	} else {
+		var bibs []*sierraapi.BibRecordIn
+		bibs, err = getBibsForLookup(sierraapi.Lookups[kind], value, token, r)
+		for _, bib := range bibs {
+			bibIDs = append(bibIDs, bib.ID)
+			if withBibs {
+				out.Bibs = append(out.Bibs, bib.Detail())
+			}
+		}
+		//The bibs have been fetched already.
+		withBibs = false
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bibIDs) == 0 {
+		return nil, sierraapi.ErrNotFound
+	}
+	out.BibIDs = bibIDs
+
+	if withBibs {
+		bibs, err := getBibs(bibIDs, token, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, bib := range bibs {
+			out.Bibs = append(out.Bibs, bib.Detail())
+		}
+	}
+
+	if withStatus {
+		var ids []string
+		for _, id := range bibIDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		out.Status, err = getItemsForBibs(ids, token, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+//runQuery posts a query to endpoint, and returns the IDs of the matching records.
+func runQuery(endpoint string, query interface{}, limit int, token string, r *http.Request) ([]int, error) {
+	return runQueryPage(endpoint, query, 0, limit, token, r)
+}
+
+//runQueryPage returns the IDs of one page of the records matching a query.
+func runQueryPage(endpoint string, query interface{}, offset, limit int, token string, r *http.Request) ([]int, error) {
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	sierraapi.SetPaging(parsedAPIURL, offset, limit)
+
+	var results sierraapi.QueryResultsIn
+	err = sierraapi.SendJSON("POST", parsedAPIURL.String(), token, r, query, &results)
+	if err == sierraapi.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results.IDs(), nil
+}
+
+//getBibsForLookup finds the bibs with a standard number, leaving out
+//the ones which don't really have it, and any suppressed or deleted.
+//Sierra's "has" matches more than the number, so the candidates are
+//checked a page at a time, until MaxLookupResults bibs match or
+//MaxLookupCandidates have been checked.
+func getBibsForLookup(lookup sierraapi.Lookup, value, token string, r *http.Request) ([]*sierraapi.BibRecordIn, error) {
+
+	query := sierraapi.AnyOf(lookup.Queries(value)...)
+
+	var matches []*sierraapi.BibRecordIn
+	for offset := 0; offset < MaxLookupCandidates && len(matches) < MaxLookupResults; offset += MaxLookupResults {
+
+		ids, err := runQueryPage(sierraapi.BibQueryEndpoint, query, offset, MaxLookupResults, token, r)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		bibs, err := getBibs(ids, token, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, bib := range bibs {
+			if lookup.Matches(bib, value) && len(matches) < MaxLookupResults {
+				matches = append(matches, bib)
+			}
+		}
+
+		if len(ids) < MaxLookupResults {
+			break
+		}
+	}
+	return matches, nil
+}
+
+//getBibIDsForBarcode finds the bibs of the items with a barcode.
+func getBibIDsForBarcode(barcode, token string, r *http.Request) ([]int, error) {
+
+	itemIDs, err := runQuery(sierraapi.ItemQueryEndpoint, sierraapi.BarcodeQuery(barcode), MaxLookupResults, token, r)
+	if err != nil || len(itemIDs) == 0 {
+		return nil, err
+	}
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.ItemRequestEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := parsedAPIURL.Query()
+	q.Set("id", chunkIDs(itemIDs, len(itemIDs))[0])
+	q.Set("limit", strconv.Itoa(len(itemIDs)))
+	q.Set("fields", "id,bibIds")
+	q.Set("deleted", "false")
+	q.Set("suppressed", "false")
+	parsedAPIURL.RawQuery = q.Encode()
+
+	var items sierraapi.ItemRecordsIn
+	err = sierraapi.GetJSON(parsedAPIURL.String(), token, r, &items)
+	if err == sierraapi.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var bibIDs []int
+	seen := make(map[int]bool)
+	for _, item := range items.Entries {
+		for _, bibID := range item.BibIDs {
+			id, err := strconv.Atoi(bibID.String())
+			if err == nil && !seen[id] {
+				seen[id] = true
+				bibIDs = append(bibIDs, id)
+			}
+		}
+	}
+	return bibIDs, nil
+}
+
+//getBibs fetches the bibs with their MARC records, leaving out any suppressed or deleted.
+func getBibs(ids []int, token string, r *http.Request) ([]*sierraapi.BibRecordIn, error) {
+
+	var bibs []*sierraapi.BibRecordIn
+	for _, chunk := range chunkIDs(ids, sierraapi.MaxBibIDsPerRequest) {
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		q := parsedAPIURL.Query()
+		q.Set("id", chunk)
+		q.Set("limit", strconv.Itoa(sierraapi.MaxBibIDsPerRequest))
+		q.Set("fields", "default,marc")
+		q.Set("deleted", "false")
+		q.Set("suppressed", "false")
+		parsedAPIURL.RawQuery = q.Encode()
+
+		var response sierraapi.BibRecordsIn
+		err = sierraapi.GetJSON(parsedAPIURL.String(), token, r, &response)
+		if err == sierraapi.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range response.Entries {
+			if bib := &response.Entries[i]; !bib.Deleted && !bib.Suppressed {
+				bibs = append(bibs, bib)
+			}
+		}
+	}
+	return bibs, nil
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query == "" {
+		http.Error(w, "Error, you need to provide a search. /search?q=[search]", http.StatusBadRequest)
+		l.Log("Bad Request at /search handler, no search provided.", l.TraceMessage)
+		return
+	}
+
+	field := r.FormValue("field")
+	if field == "" {
+		field = "keyword"
+	}
+	index, ok := sierraapi.SearchIndexes[field]
+	if !ok {
+		http.Error(w, "Error, field must be keyword, title, author or subject.", http.StatusBadRequest)
+		l.Log(fmt.Sprintf("Bad Request at /search handler, unknown field %v", field), l.TraceMessage)
+		return
+	}
+
+	offset, limit := 0, DefaultSearchLimit
+	if r.FormValue("offset") != "" {
+		requestedOffset, err := strconv.Atoi(r.FormValue("offset"))
+		if err != nil || requestedOffset < 0 {
+			http.Error(w, "Error, offset must be zero or a positive number.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /search handler, bad offset %v", r.FormValue("offset")), l.TraceMessage)
+			return
+		}
+		offset = requestedOffset
+	}
+	if r.FormValue("limit") != "" {
+		requestedLimit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || requestedLimit < 1 {
+			http.Error(w, "Error, limit must be a positive number.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /search handler, bad limit %v", r.FormValue("limit")), l.TraceMessage)
+			return
+		}
+		limit = requestedLimit
+		if limit > MaxSearchLimit {
+			limit = MaxSearchLimit
+		}
+	}
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibSearchEndpoint)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /search handler, unable to parse url.", l.DebugMessage)
+		return
+	}
+	q := parsedAPIURL.Query()
+	q.Set("text", query)
+	if index != "" {
+		q.Set("index", index)
+	}
+	q.Set("fields", "default,marc")
+	parsedAPIURL.RawQuery = q.Encode()
+	sierraapi.SetPaging(parsedAPIURL, offset, limit)
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+
+	response, err := getJSON(parsedAPIURL.String(), token, r, func() interface{} { return new(sierraapi.BibSearchResultsIn) })
+	//Sierra returns a 404 when there are no results, or the offset is past the end.
+	if err == sierraapi.ErrNotFound {
+		response, err = &sierraapi.BibSearchResultsIn{Start: offset}, nil
+	}
+	if err != nil {
+		handleAPIError(w, err, "/search")
+		return
+	}
+
+	sendJSON(w, response.(*sierraapi.BibSearchResultsIn).Convert(query, field, limit), "/search")
+}
+
+//SavedQueryOut describes a saved query, in the list at /query
+type SavedQueryOut struct {
+	Name        string
+	Description string
+	Query       string
+	Record      string
+}
+
+type bySavedQueryName []SavedQueryOut
+
+func (b bySavedQueryName) Len() int           { return len(b) }
+func (b bySavedQueryName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b bySavedQueryName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/query"), "/")
+	query := strings.TrimSpace(r.FormValue("q"))
+
+	var parsed *sierraapi.ParsedQuery
+	switch {
+	case name != "":
+		saved, ok := savedQueries[name]
+		if !ok {
+			http.Error(w, "Error, no saved query with that name.", http.StatusNotFound)
+			l.Log(fmt.Sprintf("Bad Request at /query handler, unknown saved query %v", name), l.TraceMessage)
+			return
+		}
+		query, parsed = saved.Query, saved.Parsed
+	case query != "":
+		if !*adhocQueries {
+			http.Error(w, "Error, only saved queries can be run. /query/[name]", http.StatusForbidden)
+			l.Log("Forbidden at /query handler, ad hoc queries are turned off.", l.TraceMessage)
+			return
+		}
+		var err error
+		parsed, err = sierraapi.ParseQuery(query)
+		if err != nil {
+			http.Error(w, "Error, "+err.Error(), http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /query handler, unable to parse query %v, %v", query, err), l.TraceMessage)
+			return
+		}
+	default:
+		list := []SavedQueryOut{}
+		for name, saved := range savedQueries {
+			list = append(list, SavedQueryOut{Name: name, Description: saved.Description, Query: saved.Query, Record: saved.Parsed.Record})
+		}
+		sort.Sort(bySavedQueryName(list))
+		sendJSON(w, list, "/query")
+		return
+	}
+
+	offset, limit := 0, DefaultQueryLimit
+	if r.FormValue("offset") != "" {
+		requestedOffset, err := strconv.Atoi(r.FormValue("offset"))
+		if err != nil || requestedOffset < 0 {
+			http.Error(w, "Error, offset must be zero or a positive number.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /query handler, bad offset %v", r.FormValue("offset")), l.TraceMessage)
+			return
+		}
+		offset = requestedOffset
+	}
+	if r.FormValue("limit") != "" {
+		requestedLimit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || requestedLimit < 1 {
+			http.Error(w, "Error, limit must be a positive number.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /query handler, bad limit %v", r.FormValue("limit")), l.TraceMessage)
+			return
+		}
+		limit = requestedLimit
+		if limit > MaxQueryLimit {
+			limit = MaxQueryLimit
+		}
+	}
+
+	body, err := json.Marshal(parsed.JSON)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log(fmt.Sprintf("Internal Server Error at /query handler, unable to encode query %v, %v", query, err), l.DebugMessage)
+		return
+	}
+
+	cacheKey := fmt.Sprintf("query %v %v %v %v %s", name, parsed.Record, offset, limit, body)
+	fetch := queryFetcher(name, query, parsed, offset, limit, r)
+
+	if cached, ok := getCached(queryCache, cacheKey, fetch); ok {
+		sendJSON(w, cached, "/query")
+		return
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+
+	response, err := fetch(token)
+	if err != nil {
+		handleAPIError(w, err, "/query")
+		return
+	}
+
+	queryCache.Set(cacheKey, response)
+	sendJSON(w, response, "/query")
+}
+
+//queryFetcher runs a query, and fetches one page of the matching records.
+func queryFetcher(name, query string, parsed *sierraapi.ParsedQuery, offset, limit int, r *http.Request) func(token string) (interface{}, error) {
+	return func(token string) (interface{}, error) {
+
+		endpoint := sierraapi.BibQueryEndpoint
+		if parsed.Record == "item" {
+			endpoint = sierraapi.ItemQueryEndpoint
+		}
+
+		//One more ID than the page holds is asked for, to see if there's a next page.
+		ids, err := runQueryPage(endpoint, parsed.JSON, offset, limit+1, token, r)
+		if err != nil {
+			return nil, err
+		}
+		more := len(ids) > limit
+		if more {
+			ids = ids[:limit]
+		}
+
+		out := sierraapi.NewQueryResults(name, query, parsed.Record, offset, limit, more)
+
+		if parsed.Record == "item" {
+			items, err := getItems(ids, token, r)
+			if err != nil {
+				return nil, err
+			}
+			out.Entries = sierraapi.ConvertQueryItems(items)
+			return out, nil
+		}
+
+		bibs, err := getBibs(ids, token, r)
+		if err != nil {
+			return nil, err
+		}
+		entries := sierraapi.BibRecordsOut{}
+		for _, bib := range bibs {
+			entries = append(entries, *bib.Convert())
+		}
+		out.Entries = entries
+		return out, nil
+	}
+}
+
+//getItems fetches the items, leaving out any suppressed or deleted.
+func getItems(ids []int, token string, r *http.Request) (*sierraapi.ItemRecordsIn, error) {
+
+	items := new(sierraapi.ItemRecordsIn)
+	for _, chunk := range chunkIDs(ids, sierraapi.MaxBibIDsPerRequest) {
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.ItemRequestEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		q := parsedAPIURL.Query()
+		q.Set("id", chunk)
+		q.Set("limit", strconv.Itoa(sierraapi.MaxBibIDsPerRequest))
+		q.Set("deleted", "false")
+		q.Set("suppressed", "false")
+		parsedAPIURL.RawQuery = q.Encode()
+
+		var response sierraapi.ItemRecordsIn
+		err = sierraapi.GetJSON(parsedAPIURL.String(), token, r, &response)
+		if err == sierraapi.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items.Entries = append(items.Entries, response.Entries...)
+	}
+	return items, nil
+}
+
+//ReportOut describes a report, in the list at /reports
+type ReportOut struct {
+	Name        string
+	Description string
+	Query       string
+	Record      string
+	Every       string
+	Runs        []string
+}
+
+type byReportName []ReportOut
+
+func (b byReportName) Len() int           { return len(b) }
+func (b byReportName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byReportName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+
+	//Reports are for staff, so they need the report token,
+	//and the Access-Control-Allow-Origin header isn't set.
+	token := r.FormValue("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(*reportToken)) != 1 {
+		http.Error(w, "Error, reports need the report token.", http.StatusUnauthorized)
+		l.Log(fmt.Sprintf("Unauthorized request at /reports handler for %v", r.URL.Path), l.WarnMessage)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports"), "/"), "/")
+
+	if parts[0] == "" {
+		list := []ReportOut{}
+		for name, report := range savedReports {
+			runs, err := reportStore.Runs(name)
+			if err != nil {
+				l.Log(fmt.Sprintf("Unable to list the runs of report %v, %v", name, err), l.WarnMessage)
+			}
+			if runs == nil {
+				runs = []string{}
+			}
+			list = append(list, ReportOut{Name: name, Description: report.Description, Query: report.Query, Record: report.Parsed.Record, Every: report.Every, Runs: runs})
+		}
+		sort.Sort(byReportName(list))
+		sendJSON(w, list, "/reports")
+		return
+	}
+
+	//The newest run is /reports/[name], an older one is /reports/[name]/[runID]
+	//Either can end in .csv or .json
+	last := parts[len(parts)-1]
+	ext := path.Ext(last)
+	if ext == "" {
+		ext = ".json"
+	}
+	parts[len(parts)-1] = strings.TrimSuffix(last, path.Ext(last))
+
+	name, runID := parts[0], ""
+	if len(parts) == 2 {
+		runID = parts[1]
+	}
+
+	if _, ok := savedReports[name]; !ok || len(parts) > 2 || (ext != ".json" && ext != ".csv") {
+		http.Error(w, "Error, no report with that name. /reports/[name], /reports/[name].csv or /reports/[name]/[runID].csv", http.StatusNotFound)
+		l.Log(fmt.Sprintf("Bad Request at /reports handler, unknown report %v", r.URL.Path), l.TraceMessage)
+		return
+	}
+
+	//The JSON of the run says whether it was truncated, which
+	//the CSV can't, so it's read first to set X-Report-Truncated.
+	b, err := reportStore.Read(name, runID, ".json")
+	var run reports.Run
+	if err == nil {
+		err = json.Unmarshal(b, &run)
+	}
+	if err == nil && ext == ".csv" {
+		b, err = reportStore.Read(name, run.ID, ext)
+	}
+	if err == reports.ErrNoRuns {
+		http.Error(w, "Error, that run of the report isn't available. Reports are run in the background, check /reports for the runs.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("No run of report %v matches %v", name, r.URL.Path), l.TraceMessage)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log(fmt.Sprintf("Internal Server Error at /reports handler, unable to read report %v, %v", name, err), l.ErrorMessage)
+		return
+	}
+
+	if run.Truncated {
+		w.Header().Set("X-Report-Truncated", "true")
+	}
+	if ext == ".csv" {
+		w.Header().Set("Content-Type", reports.CSVContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	} else {
+		w.Header().Set("Content-Type", reports.JSONContentType)
+	}
+	w.Write(b)
+}
+
+//runReport runs a report's query with Tyro's own token, and
+//fetches every record it finds, up to MaxReportRows. One more
+//row than that is asked for, so a truncated run can be marked.
+func runReport(report reports.Report) (*reports.Table, error) {
+
+	token, err := tokenStore.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := sierraapi.BibQueryEndpoint
+	if report.Parsed.Record == "item" {
+		endpoint = sierraapi.ItemQueryEndpoint
+	}
+
+	var ids []int
+	for len(ids) <= MaxReportRows {
+		limit := MaxQueryLimit
+		if left := MaxReportRows + 1 - len(ids); left < limit {
+			limit = left
+		}
+		page, err := runQueryPage(endpoint, report.Parsed.JSON, len(ids), limit, token, nil)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+		if len(page) < limit {
+			break
+		}
+	}
+	truncated := len(ids) > MaxReportRows
+	if truncated {
+		l.Log(fmt.Sprintf("The report %q found more than %v records, only the first %v are kept.", report.Query, MaxReportRows, MaxReportRows), l.WarnMessage)
+		ids = ids[:MaxReportRows]
+	}
+
+	if report.Parsed.Record == "item" {
+		items, err := getItems(ids, token, nil)
+		if err != nil {
+			return nil, err
+		}
+		converted := sierraapi.ConvertQueryItems(items)
+
+		var bibIDs []int
+		for _, item := range converted {
+			if len(item.BibIDs) > 0 {
+				bibIDs = append(bibIDs, item.BibIDs[0])
+			}
+		}
+		titles := getBibTitles(bibIDs, token, nil)
+
+		table := &reports.Table{Columns: []string{"ItemID", "BibID", "Title", "CallNumber", "Location", "LocationCode", "Status", "DueDate"}, Truncated: truncated}
+		for _, item := range converted {
+			bibID, title := "", ""
+			if len(item.BibIDs) > 0 {
+				bibID, title = strconv.Itoa(item.BibIDs[0]), titles[item.BibIDs[0]]
+			}
+			dueDate := ""
+			if !item.DueDate.IsZero() {
+				dueDate = item.DueDate.Format("2006-01-02")
+			}
+			table.Rows = append(table.Rows, []string{strconv.Itoa(item.ItemID), bibID, title, item.CallNumber, item.Location, item.LocationCode, item.Status, dueDate})
+		}
+		return table, nil
+	}
+
+	bibs, err := getBibs(ids, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	table := &reports.Table{Columns: []string{"BibID", "Title", "Responsibility", "Publisher", "PublicationDate", "ISBN"}, Truncated: truncated}
+	for _, bib := range bibs {
+		out := bib.Convert()
+		isbn := ""
+		if len(out.ISBNs) > 0 {
+			isbn = out.ISBNs[0]
+		}
+		table.Rows = append(table.Rows, []string{strconv.Itoa(out.BibID), out.Title, out.Responsibility, out.Publisher, out.PublicationDate, isbn})
+	}
+	return table, nil
+}
+
+func coursesHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	courseID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/courses"), "/")
+
+	if courseID == "" {
+		sendJSON(w, sierraapi.Courses(r.FormValue("instructor")), "/courses")
+		return
+	}
+
+	course, ok := sierraapi.LookupCourse(courseID)
+	if !ok {
+		http.Error(w, "Error, no course with that ID. /courses/[courseID]", http.StatusNotFound)
+		l.Log(fmt.Sprintf("Bad Request at /courses handler, unknown course %v", courseID), l.TraceMessage)
+		return
+	}
+
+	cacheKey := "course " + courseID
+	fetch := courseFetcher(course, r)
+
+	if cached, ok := getCached(coursesCache, cacheKey, fetch); ok {
+		sendJSON(w, cached, "/courses")
+		return
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+
+	response, err := fetch(token)
+	if err != nil {
+		handleAPIError(w, err, "/courses")
+		return
+	}
+
+	coursesCache.Set(cacheKey, response)
+	sendJSON(w, response, "/courses")
+}
+
+//courseFetcher fetches the live status and titles of the items on reserve for a course.
+func courseFetcher(course *sierraapi.CourseOut, r *http.Request) func(token string) (interface{}, error) {
+	return func(token string) (interface{}, error) {
+
+		items, err := getItems(course.ItemIDs, token, r)
+		if err != nil {
+			return nil, err
+		}
+		converted := sierraapi.ConvertQueryItems(items)
+
+		var bibIDs []int
+		for _, item := range converted {
+			bibIDs = append(bibIDs, item.BibIDs...)
+		}
+		titles := getBibTitles(bibIDs, token, r)
+
+		//Copy the course, so the loaded one isn't changed.
+		out := *course
+		out.Items = []sierraapi.CourseItemOut{}
+		for _, item := range converted {
+			courseItem := sierraapi.CourseItemOut{QueryItemOut: item}
+			if len(item.BibIDs) > 0 {
+				courseItem.Title = titles[item.BibIDs[0]]
+			}
+			out.Items = append(out.Items, courseItem)
+		}
+		return &out, nil
+	}
+}
+
+//bibStatusURL builds the Sierra API URL for the items attached to bibID.
+//It is also the cache key for the /status/bib/[bibID] response.
+func bibStatusURL(bibID string) (*url.URL, error) {
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.ItemRequestEndpoint)
+	if err != nil {
+		return parsedAPIURL, err
+	}
+
+	q := parsedAPIURL.Query()
+	q.Set("bibIds", bibID)
+	q.Set("deleted", "false")
+	q.Set("suppressed", "false")
+	parsedAPIURL.RawQuery = q.Encode()
+
+	return parsedAPIURL, nil
+}
+
+//bibStatusFetcher returns a function which fetches and converts
+//the items at apiURL, for use with getCached.
+func bibStatusFetcher(apiURL string, r *http.Request) func(token string) (interface{}, error) {
+	return func(token string) (interface{}, error) {
+		response, err := getJSON(apiURL, token, r, func() interface{} { return new(sierraapi.ItemRecordsIn) })
+		if err != nil {
+			return nil, err
+		}
+		return response.(*sierraapi.ItemRecordsIn).Convert(), nil
+	}
+}
+
+//bibSummaryFetcher wraps a bibStatusFetcher, adding a summary
+//of the items and the number of holds on the bib.
+func bibSummaryFetcher(bibID string, fetch func(token string) (interface{}, error), r *http.Request) func(token string) (interface{}, error) {
+	return func(token string) (interface{}, error) {
+		response, err := fetch(token)
+		if err != nil {
+			return nil, err
+		}
+
+		//Copy the response, it may be shared with other requests.
+		items := *response.(*sierraapi.ItemRecordsOut)
+		items.Summary = items.Summarize()
+
+		holdsURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint, bibID, "holds")
+		if err != nil {
+			return nil, err
+		}
+
+		//The summary is still useful without the number of holds.
+		holds, err := getJSON(sierraapi.TotalURL(holdsURL).String(), token, r, func() interface{} { return new(sierraapi.TotalIn) })
+		if err == nil {
+			items.Summary.Holds = holds.(*sierraapi.TotalIn).Total
+		} else if err != sierraapi.ErrNotFound {
+			l.Log(fmt.Sprintf("Unable to count holds on bib %v, %v", bibID, err), l.WarnMessage)
+		}
+
+		return &items, nil
+	}
+}
+
+//getCached looks for a cached response.
+//Stale responses are returned, and refreshed in the background using fetch.
+func getCached(cache *responsecache.Cache, key string, fetch func(token string) (interface{}, error)) (interface{}, bool) {
+	cached, fresh, ok := cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if !fresh {
+		cache.Revalidate(key, func() (interface{}, error) {
+			token, err := tokenStore.Get()
+			if err != nil {
+				return nil, err
+			}
+			return fetch(token)
+		})
+	}
+	return cached, true
+}
+
+func patronValidateHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	if handlePreflight(w, r, "POST") {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Error, credentials must be POSTed to /patron/validate.", http.StatusMethodNotAllowed)
+		l.Log(fmt.Sprintf("Bad Request at /patron/validate handler, method %v", r.Method), l.TraceMessage)
+		return
+	}
+
+	var credentials struct {
+		Barcode string `json:"barcode"`
+		PIN     string `json:"pin"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&credentials)
+		if err != nil {
+			http.Error(w, "Error, unable to read the barcode and PIN.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /patron/validate handler, %v", err), l.TraceMessage)
+			return
+		}
+	} else {
+		credentials.Barcode = r.FormValue("barcode")
+		credentials.PIN = r.FormValue("pin")
+	}
+
+	if credentials.Barcode == "" || credentials.PIN == "" {
+		http.Error(w, "Error, you need to provide a barcode and PIN.", http.StatusBadRequest)
+		l.Log("Bad Request at /patron/validate handler, no barcode or PIN provided.", l.TraceMessage)
+		return
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+
+	validateURL, err := parseURLandJoinToPath(*apiURL, sierraapi.PatronValidateEndpoint)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /patron/validate handler, unable to parse url.", l.DebugMessage)
+		return
+	}
+
+	err = sierraapi.SendJSON("POST", validateURL.String(), token, r, credentials, nil)
+	if apiErr, ok := err.(*sierraapi.APIError); ok && apiErr.HTTPStatus == http.StatusBadRequest {
+		http.Error(w, "Invalid barcode or PIN.", http.StatusUnauthorized)
+		l.Log(fmt.Sprintf("Failed patron validation for barcode %v, %v", credentials.Barcode, apiErr), l.InfoMessage)
+		return
+	}
+	if err != nil {
+		handleAPIError(w, err, "/patron/validate")
+		return
+	}
+
+	findURL, err := parseURLandJoinToPath(*apiURL, sierraapi.PatronFindEndpoint)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /patron/validate handler, unable to parse url.", l.DebugMessage)
+		return
+	}
+
+	q := findURL.Query()
+	q.Set("barcode", credentials.Barcode)
+	q.Set("fields", "id")
+	findURL.RawQuery = q.Encode()
+
+	var patron struct {
+		ID int `json:"id"`
+	}
+	err = sierraapi.GetJSON(findURL.String(), token, r, &patron)
+	if err != nil {
+		handleAPIError(w, err, "/patron/validate")
+		return
+	}
+
+	sessionToken, expires := sessionSigner.Sign(patron.ID)
+
+	l.Log(fmt.Sprintf("Patron %v validated.", patron.ID), l.TraceMessage)
+	sendJSON(w, struct {
+		Token   string
+		Expires time.Time
+	}{sessionToken, expires}, "/patron/validate")
+}
+
+func patronCheckoutsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var response sierraapi.CheckoutsIn
+	token, ok := getPatronRecords(w, r, "checkouts", "GET", &response)
+	if !ok {
+		return
+	}
+
+	out := response.Convert(*maxRenewals)
+
+	var itemIDs []int
+	for _, checkout := range out.Entries {
+		itemIDs = append(itemIDs, checkout.ItemID)
+	}
+	titles := getItemTitles(itemIDs, token, r)
+	for i := range out.Entries {
+		out.Entries[i].Title = titles[out.Entries[i].ItemID]
+	}
+
+	sendJSON(w, out, "/patron/checkouts")
+}
+
+func patronRenewHandler(w http.ResponseWriter, r *http.Request) {
+
+	patronID, token, ok := getPatronSession(w, r, "/patron/checkouts/renew", "POST")
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Error, renewals must be POSTed to /patron/checkouts/renew.", http.StatusMethodNotAllowed)
+		l.Log(fmt.Sprintf("Bad Request at /patron/checkouts/renew handler, method %v", r.Method), l.TraceMessage)
+		return
+	}
+
+	var request struct {
+		CheckoutIDs []int `json:"checkoutIds"`
+		All         bool  `json:"all"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&request)
+		if err != nil {
+			http.Error(w, "Error, unable to read the renewal request.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /patron/checkouts/renew handler, %v", err), l.TraceMessage)
+			return
+		}
+	} else {
+		for _, id := range splitList(r.FormValue("checkoutIds")) {
+			checkoutID, err := strconv.Atoi(id)
+			if err != nil {
+				http.Error(w, "Error, checkoutIds must be numbers.", http.StatusBadRequest)
+				l.Log(fmt.Sprintf("Bad Request at /patron/checkouts/renew handler, %v", err), l.TraceMessage)
+				return
+			}
+			request.CheckoutIDs = append(request.CheckoutIDs, checkoutID)
+		}
+		request.All = r.FormValue("all") == "true"
+	}
+
+	if !request.All && len(request.CheckoutIDs) == 0 {
+		http.Error(w, "Error, you need to provide checkoutIds, or all.", http.StatusBadRequest)
+		l.Log("Bad Request at /patron/checkouts/renew handler, no checkouts provided.", l.TraceMessage)
+		return
+	}
+
+	//The patron's checkouts are fetched first, so patrons
+	//can only renew their own items.
+	var response sierraapi.CheckoutsIn
+	if !fetchPatronRecords(w, r, patronID, token, "checkouts", &response) {
+		return
+	}
+
+	if request.All {
+		request.CheckoutIDs = nil
+	}
+
+	checkouts := make(map[int]sierraapi.CheckoutOut)
+	var itemIDs []int
+	for _, checkout := range response.Convert(*maxRenewals).Entries {
+		checkouts[checkout.CheckoutID] = checkout
+		itemIDs = append(itemIDs, checkout.ItemID)
+		if request.All {
+			request.CheckoutIDs = append(request.CheckoutIDs, checkout.CheckoutID)
+		}
+	}
+	titles := getItemTitles(itemIDs, token, r)
+
+	out := new(sierraapi.RenewalsOut)
+	renewed := make(map[int]bool)
+	expired := false
+	for _, checkoutID := range request.CheckoutIDs {
+
+		if renewed[checkoutID] {
+			continue
+		}
+		renewed[checkoutID] = true
+
+		result := sierraapi.RenewalOut{CheckoutID: checkoutID}
+
+		checkout, found := checkouts[checkoutID]
+		if !found {
+			result.Message = "Not checked out to you."
+			out.Entries = append(out.Entries, result)
+			continue
+		}
+		result.ItemID = checkout.ItemID
+		result.Title = titles[checkout.ItemID]
+		result.Due = checkout.Due
+		result.DueDate = checkout.DueDate
+
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.PatronRequestEndpoint, "checkouts", strconv.Itoa(checkoutID), "renewal")
+		if err != nil {
+			http.Error(w, "Server Error.", http.StatusInternalServerError)
+			l.Log("Internal Server Error at /patron/checkouts/renew handler, unable to parse url.", l.DebugMessage)
+			return
+		}
+
+		//Once the token has expired, the rest can't be renewed, but
+		//the renewals already done are still reported.
+		if expired {
+			result.Message = "Unable to renew, please try again later."
+			out.Entries = append(out.Entries, result)
+			continue
+		}
+
+		var renewal sierraapi.CheckoutIn
+		err = sierraapi.SendJSON("POST", parsedAPIURL.String(), token, r, nil, &renewal)
+		if err == sierraapi.ErrUnauthorized {
+			expired = true
+			tokenStore.Refresh <- struct{}{}
+			l.Log(fmt.Sprintf("Token is out of date, unable to renew checkout %v", checkoutID), l.ErrorMessage)
+			result.Message = "Unable to renew, please try again later."
+		} else if apiErr, ok := err.(*sierraapi.APIError); ok && apiErr.Refused() {
+			result.Message = apiErr.Description
+			l.Log(fmt.Sprintf("Renewal of checkout %v refused, %v", checkoutID, apiErr), l.InfoMessage)
+		} else if err != nil {
+			result.Message = "Unable to renew, please try again later."
+			l.Log(fmt.Sprintf("Unable to renew checkout %v, %v", checkoutID, err), l.WarnMessage)
+		} else {
+			result.Renewed = true
+			result.Due = sierraapi.FormatDueDate(renewal.DueDate)
+			result.DueDate = renewal.DueDate
+		}
+		out.Entries = append(out.Entries, result)
+	}
+
+	sendJSON(w, out, "/patron/checkouts/renew")
+}
+
+func patronHoldsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == "POST" {
+		patronPlaceHoldHandler(w, r)
+		return
+	}
+
+	var response sierraapi.HoldsIn
+	token, ok := getPatronRecords(w, r, "holds", "GET, POST", &response)
+	if !ok {
+		return
+	}
+
+	out := response.Convert()
+
+	var bibIDs, itemIDs []int
+	for _, hold := range out.Entries {
+		if hold.RecordType == "i" {
+			itemIDs = append(itemIDs, hold.RecordID)
+		} else {
+			bibIDs = append(bibIDs, hold.RecordID)
+		}
+	}
+	bibTitles := getBibTitles(bibIDs, token, r)
+	itemTitles := getItemTitles(itemIDs, token, r)
+	for i, hold := range out.Entries {
+		if hold.RecordType == "i" {
+			out.Entries[i].Title = itemTitles[hold.RecordID]
+		} else {
+			out.Entries[i].Title = bibTitles[hold.RecordID]
+		}
+	}
+
+	sendJSON(w, out, "/patron/holds")
+}
+
+func patronPlaceHoldHandler(w http.ResponseWriter, r *http.Request) {
+
+	patronID, token, ok := getPatronSession(w, r, "/patron/holds", "GET, POST")
+	if !ok {
+		return
+	}
+
+	var hold sierraapi.HoldRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&hold)
+		if err != nil {
+			http.Error(w, "Error, unable to read the hold request.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /patron/holds handler, %v", err), l.TraceMessage)
+			return
+		}
+	} else {
+		hold.RecordType = r.FormValue("recordType")
+		hold.RecordNumber, _ = strconv.Atoi(r.FormValue("recordNumber"))
+		hold.PickupLocation = r.FormValue("pickupLocation")
+	}
+
+	if (hold.RecordType != "b" && hold.RecordType != "i") || hold.RecordNumber <= 0 || strings.TrimSpace(hold.PickupLocation) == "" {
+		http.Error(w, "Error, you need to provide a recordType (b or i), a recordNumber and a pickupLocation.", http.StatusBadRequest)
+		l.Log(fmt.Sprintf("Bad Request at /patron/holds handler, incomplete hold request %+v", hold), l.TraceMessage)
+		return
+	}
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.PatronRequestEndpoint, strconv.Itoa(patronID), "holds", "requests")
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /patron/holds handler, unable to parse url.", l.DebugMessage)
+		return
+	}
+
+	err = sierraapi.SendJSON("POST", parsedAPIURL.String(), token, r, hold, nil)
+	if apiErr, ok := err.(*sierraapi.APIError); ok && apiErr.Refused() {
+		http.Error(w, "Unable to place hold. "+apiErr.Description, http.StatusConflict)
+		l.Log(fmt.Sprintf("Hold for patron %v refused, %v", patronID, apiErr), l.InfoMessage)
+		return
+	}
+	if apiErr, ok := err.(*sierraapi.APIError); ok && apiErr.Rejected() {
+		http.Error(w, "Unable to place hold. Check the record and pickup location, and try again.", http.StatusBadRequest)
+		l.Log(fmt.Sprintf("Hold for patron %v rejected, %v", patronID, apiErr), l.InfoMessage)
+		return
+	}
+	if err != nil {
+		handleAPIError(w, err, "/patron/holds")
+		return
+	}
+
+	l.Log(fmt.Sprintf("Patron %v placed a hold on %v%v.", patronID, hold.RecordType, hold.RecordNumber), l.TraceMessage)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func patronHoldHandler(w http.ResponseWriter, r *http.Request) {
+
+	patronID, token, ok := getPatronSession(w, r, "/patron/holds/", "DELETE")
+	if !ok {
+		return
+	}
+
+	if r.Method != "DELETE" {
+		http.Error(w, "Error, holds can only be cancelled with DELETE.", http.StatusMethodNotAllowed)
+		l.Log(fmt.Sprintf("Bad Request at /patron/holds/ handler, method %v", r.Method), l.TraceMessage)
+		return
+	}
+
+	holdID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/patron/holds/"))
+	if err != nil || holdID <= 0 {
+		http.Error(w, "Error, you need to provide a HoldID.", http.StatusBadRequest)
+		l.Log("Bad Request at /patron/holds/ handler, no HoldID provided.", l.TraceMessage)
+		return
+	}
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.PatronRequestEndpoint, "holds", strconv.Itoa(holdID))
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /patron/holds/ handler, unable to parse url.", l.DebugMessage)
+		return
+	}
+
+	//Sierra will cancel any hold, so check it belongs to this patron first.
+	//Someone else's hold is reported as not found.
+	var hold sierraapi.HoldIn
+	err = sierraapi.GetJSON(parsedAPIURL.String(), token, r, &hold)
+	if err == sierraapi.ErrNotFound || (err == nil && sierraapi.IDFromLink(hold.Patron) != patronID) {
+		http.Error(w, "Hold not found.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("Patron %v tried to cancel hold %v, which is not theirs.", patronID, holdID), l.InfoMessage)
+		return
+	}
+	if err != nil {
+		handleAPIError(w, err, "/patron/holds/")
+		return
+	}
+
+	err = sierraapi.SendJSON("DELETE", parsedAPIURL.String(), token, r, nil, nil)
+	if err != nil {
+		handleAPIError(w, err, "/patron/holds/")
+		return
+	}
+
+	l.Log(fmt.Sprintf("Patron %v cancelled hold %v.", patronID, holdID), l.TraceMessage)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func patronFinesHandler(w http.ResponseWriter, r *http.Request) {
+
+	var response sierraapi.FinesIn
+	token, ok := getPatronRecords(w, r, "fines", "GET", &response)
+	if !ok {
+		return
+	}
+
+	out := response.Convert()
+
+	var itemIDs []int
+	for _, fine := range out.Entries {
+		if fine.ItemID != 0 {
+			itemIDs = append(itemIDs, fine.ItemID)
+		}
+	}
+	titles := getItemTitles(itemIDs, token, r)
+	for i := range out.Entries {
+		out.Entries[i].Title = titles[out.Entries[i].ItemID]
+	}
+
+	sendJSON(w, out, "/patron/fines")
+}
+
+//getPatronSession sets the CORS headers, answers preflight requests, and
+//checks the patron's session. It returns the patron's ID and an API token.
+//If it returns false, a response has already been sent to the client.
+func getPatronSession(w http.ResponseWriter, r *http.Request, handler, methods string) (int, string, bool) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	if handlePreflight(w, r, methods) {
+		return 0, "", false
+	}
+
+	patronID, err := getPatronOrError(w, r)
+	if err != nil {
+		l.Log(fmt.Sprintf("Unauthorized at %v handler, %v", handler, err), l.TraceMessage)
+		return 0, "", false
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return 0, "", false
+	}
+
+	return patronID, token, true
+}
+
+//getPatronRecords fetches the logged in patron's checkouts, holds or fines
+//into v. If it returns false, a response has already been sent to the client.
+func getPatronRecords(w http.ResponseWriter, r *http.Request, kind, methods string, v interface{}) (string, bool) {
+
+	patronID, token, ok := getPatronSession(w, r, "/patron/"+kind, methods)
+	if !ok {
+		return "", false
+	}
+
+	return token, fetchPatronRecords(w, r, patronID, token, kind, v)
+}
+
+//fetchPatronRecords fetches a patron's checkouts, holds or fines into v.
+//If it returns false, an error has already been sent to the client.
+func fetchPatronRecords(w http.ResponseWriter, r *http.Request, patronID int, token, kind string, v interface{}) bool {
+
+	handler := "/patron/" + kind
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.PatronRequestEndpoint, strconv.Itoa(patronID), kind)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log(fmt.Sprintf("Internal Server Error at %v handler, unable to parse url.", handler), l.DebugMessage)
+		return false
+	}
+
+	q := parsedAPIURL.Query()
+	q.Set("limit", strconv.Itoa(sierraapi.PatronRecordsLimit))
+	parsedAPIURL.RawQuery = q.Encode()
+
+	//Patron records are private, so they don't go through getJSON.
+	err = sierraapi.GetJSON(parsedAPIURL.String(), token, r, v)
+	if err != nil && err != sierraapi.ErrNotFound {
+		handleAPIError(w, err, handler)
+		return false
+	}
+
+	return true
+}
+
+//getItemTitles looks up the titles of the items' bibs, keyed on ItemID.
+//Titles are nice to have, so errors are logged rather than returned.
+func getItemTitles(itemIDs []int, token string, r *http.Request) map[int]string {
+
+	titles := make(map[int]string)
+	itemBibs := make(map[int]int)
+	var bibIDs []int
+
+	for _, chunk := range chunkIDs(itemIDs, sierraapi.MaxBibIDsPerRequest) {
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.ItemRequestEndpoint)
+		if err != nil {
+			l.Log(err, l.ErrorMessage)
+			return titles
+		}
+		q := parsedAPIURL.Query()
+		q.Set("id", chunk)
+		q.Set("fields", "id,bibIds")
+		q.Set("limit", strconv.Itoa(sierraapi.MaxBibIDsPerRequest))
+		parsedAPIURL.RawQuery = q.Encode()
+
+		response, err := getJSON(parsedAPIURL.String(), token, r, func() interface{} { return new(sierraapi.ItemRecordsIn) })
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to look up items %v, %v", chunk, err), l.WarnMessage)
+			continue
+		}
+		for _, item := range response.(*sierraapi.ItemRecordsIn).Entries {
+			itemID, _ := strconv.Atoi(item.ID.String())
+			if len(item.BibIDs) > 0 {
+				bibID, _ := strconv.Atoi(item.BibIDs[0].String())
+				itemBibs[itemID] = bibID
+				bibIDs = append(bibIDs, bibID)
+			}
+		}
+	}
+
+	bibTitles := getBibTitles(bibIDs, token, r)
+	for itemID, bibID := range itemBibs {
+		titles[itemID] = bibTitles[bibID]
+	}
+	return titles
+}
+
+//getBibTitles looks up the titles of the bibs, keyed on BibID.
+//Titles are nice to have, so errors are logged rather than returned.
+func getBibTitles(bibIDs []int, token string, r *http.Request) map[int]string {
+
+	titles := make(map[int]string)
+
+	for _, chunk := range chunkIDs(bibIDs, sierraapi.MaxBibIDsPerRequest) {
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
+		if err != nil {
+			l.Log(err, l.ErrorMessage)
+			return titles
+		}
+		q := parsedAPIURL.Query()
+		q.Set("id", chunk)
+		q.Set("fields", "id,title")
+		q.Set("limit", strconv.Itoa(sierraapi.MaxBibIDsPerRequest))
+		parsedAPIURL.RawQuery = q.Encode()
+
+		response, err := getJSON(parsedAPIURL.String(), token, r, func() interface{} { return new(sierraapi.BibRecordsIn) })
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to look up bibs %v, %v", chunk, err), l.WarnMessage)
+			continue
+		}
+		for _, bib := range response.(*sierraapi.BibRecordsIn).Entries {
+			titles[bib.ID] = bib.Title
+		}
+	}
+
+	return titles
+}
+
+//chunkIDs joins the IDs into comma separated lists of at most size IDs,
+//dropping duplicates and zeros.
+func chunkIDs(ids []int, size int) []string {
+	seen := make(map[int]bool)
+	var chunks []string
+	var chunk []string
+	for _, id := range ids {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		chunk = append(chunk, strconv.Itoa(id))
+		if len(chunk) == size {
+			chunks = append(chunks, strings.Join(chunk, ","))
+			chunk = nil
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, strings.Join(chunk, ","))
+	}
+	return chunks
+}
+
+//getPatronOrError checks the session token in the request's
+//Authorization header, and returns the patron's ID.
+func getPatronOrError(w http.ResponseWriter, r *http.Request) (int, error) {
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		http.Error(w, "Error, you need to log in at /patron/validate.", http.StatusUnauthorized)
+		return 0, errors.New("No session token in request.")
+	}
+
+	patronID, err := sessionSigner.Verify(strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil {
+		http.Error(w, "Error, your session is not valid. Log in again at /patron/validate.", http.StatusUnauthorized)
+		return 0, err
+	}
+
+	return patronID, nil
+}
+
+//handlePreflight answers CORS preflight requests.
+//It returns true if the request was a preflight.
+func handlePreflight(w http.ResponseWriter, r *http.Request, methods string) bool {
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	return true
+}
+
+func browseHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	bibID := strings.Split(r.URL.Path[len("/browse/"):], "/")[0]
+
+	id, err := strconv.Atoi(bibID)
+	if err != nil || id <= 0 {
+		http.Error(w, "Error, you need to provide a BibID. /browse/[BibID]", http.StatusBadRequest)
+		l.Log("Bad Request at /browse/ handler, no BibID provided.", l.TraceMessage)
+		return
+	}
+
+	n := DefaultBrowseSize
+	if r.FormValue("n") != "" {
+		n, err = strconv.Atoi(r.FormValue("n"))
+		if err != nil || n < 1 || n > MaxBrowseSize {
+			http.Error(w, fmt.Sprintf("Error, n must be a number from 1 to %v.", MaxBrowseSize), http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /browse/ handler, bad n %v", r.FormValue("n")), l.TraceMessage)
+			return
+		}
+	}
+
+	parsedAPIURL, err := bibStatusURL(bibID)
+	if err != nil {
+		http.Error(w, "Server Error.", http.StatusInternalServerError)
+		l.Log("Internal Server Error at /browse/ handler, unable to parse url.", l.DebugMessage)
+		return
+	}
+
+	//The bib's items are the same as at /status/bib/, so share the cache.
+	fetch := bibStatusFetcher(parsedAPIURL.String(), r)
+	response, ok := getCached(statusCache, parsedAPIURL.String(), fetch)
+	if !ok {
+		token, err := getTokenOrError(w, r)
+		if err != nil {
+			l.Log(err, l.ErrorMessage)
+			return
+		}
+
+		response, err = fetch(token)
+		if err == sierraapi.ErrNotFound {
+			http.Error(w, "No item records for that BibID.", http.StatusNotFound)
+			l.Log(fmt.Sprintf("No items records match BibID %v", bibID), l.TraceMessage)
+			return
+		}
+		if err != nil {
+			handleAPIError(w, err, "/browse/")
+			return
+		}
+		statusCache.Set(parsedAPIURL.String(), response)
+	}
+
+	//Items are in shelf order, so the first item places the bib.
+	items := response.(*sierraapi.ItemRecordsOut).Entries
+	if len(items) == 0 || items[0].CallNumber == "" {
+		http.Error(w, "No call number for that BibID.", http.StatusNotFound)
+		l.Log(fmt.Sprintf("No call number for BibID %v", bibID), l.TraceMessage)
+		return
+	}
+
+	before, after, err := shelfIndex.Near(items[0].CallNumberSort, id, n)
+	if err != nil {
+		http.Error(w, "The shelf index is not ready yet, please try again later.", http.StatusServiceUnavailable)
+		l.Log(err, l.InfoMessage)
+		return
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+	describeShelfEntries(before, token, r)
+	describeShelfEntries(after, token, r)
+
+	sendJSON(w, struct {
+		BibID      int
+		CallNumber string
+		Before     []shelf.Entry
+		After      []shelf.Entry
+	}{id, items[0].CallNumber, before, after}, "/browse/")
+}
+
+//harvestShelf finds the items changed since since, or every item if since
+//is zero, and looks up their bibs for the shelf index.
+func harvestShelf(since time.Time) ([]shelf.Entry, []int, error) {
+
+	token, err := getToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, removed, err := getShelfEntries(since, token)
+	if err == sierraapi.ErrUnauthorized {
+		tokenStore.Refresh <- struct{}{}
+	}
+	return entries, removed, err
+}
+
+//getShelfEntries places every item with a call number on the shelf, or if
+//since isn't zero, the items changed since then. Only the fields the sort
+//needs are fetched. Changed items which were suppressed or lost their call
+//number, and items deleted since then, are returned as removed.
+func getShelfEntries(since time.Time, token string) ([]shelf.Entry, []int, error) {
+
+	var entries []shelf.Entry
+	var removed []int
+
+	q := url.Values{}
+	q.Set("fields", "id,bibIds,callNumber,suppressed")
+	q.Set("deleted", "false")
+	if since.IsZero() {
+		q.Set("suppressed", "false")
+	} else {
+		q.Set("updatedDate", fmt.Sprintf("[%v,]", since.Format(time.RFC3339)))
+	}
+
+	err := pageItems(q, token, func(item sierraapi.ItemRecordIn) {
+		itemID, _ := strconv.Atoi(item.ID.String())
+		if item.Suppressed || len(item.BibIDs) == 0 || strings.TrimSpace(item.CallNumber) == "" {
+			removed = append(removed, itemID)
+			return
+		}
+		bibID, _ := strconv.Atoi(item.BibIDs[0].String())
+		callNumber := callnumber.Parse(item.CallNumber)
+		entries = append(entries, shelf.Entry{
+			BibID:      bibID,
+			ItemID:     itemID,
+			CallNumber: callNumber.Display,
+			SortKey:    callNumber.SortKey(),
+		})
+	})
+	if err != nil || since.IsZero() {
+		return entries, removed, err
+	}
+
+	//Sierra only keeps the day an item was deleted.
+	q = url.Values{}
+	q.Set("fields", "id")
+	q.Set("deleted", "true")
+	q.Set("deletedDate", fmt.Sprintf("[%v,]", since.Format("2006-01-02")))
+
+	err = pageItems(q, token, func(item sierraapi.ItemRecordIn) {
+		itemID, _ := strconv.Atoi(item.ID.String())
+		removed = append(removed, itemID)
+	})
+	return entries, removed, err
+}
+
+//pageItems calls each for every item matching q, a page at a time.
+func pageItems(q url.Values, token string, each func(item sierraapi.ItemRecordIn)) error {
+
+	for offset := 0; ; offset += sierraapi.ItemsPerPage {
+
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.ItemRequestEndpoint)
+		if err != nil {
+			return err
+		}
+		parsedAPIURL.RawQuery = q.Encode()
+		sierraapi.SetPaging(parsedAPIURL, offset, sierraapi.ItemsPerPage)
+
+		response, err := getJSON(parsedAPIURL.String(), token, nil, func() interface{} { return new(sierraapi.ItemRecordsIn) })
+		if err == sierraapi.ErrNotFound {
+			//Sierra returns a 404 past the last page.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		items := response.(*sierraapi.ItemRecordsIn).Entries
+		for _, item := range items {
+			each(item)
+		}
+
+		if len(items) < sierraapi.ItemsPerPage {
+			return nil
+		}
+	}
+}
+
+//describeShelfEntries fills in the title, author and ISBN of the entries.
+//The bibs are looked up when they're served, so harvests stay small.
+func describeShelfEntries(entries []shelf.Entry, token string, r *http.Request) {
+
+	var bibIDs []int
+	for _, entry := range entries {
+		bibIDs = append(bibIDs, entry.BibID)
+	}
+
+	bibs := make(map[int]*sierraapi.BibRecordIn)
+	for _, chunk := range chunkIDs(bibIDs, sierraapi.MaxBibIDsPerRequest) {
+		parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
+		if err != nil {
+			l.Log(err, l.ErrorMessage)
+			return
+		}
+		q := parsedAPIURL.Query()
+		q.Set("id", chunk)
+		q.Set("fields", "id,title,author,marc")
+		q.Set("limit", strconv.Itoa(sierraapi.MaxBibIDsPerRequest))
+		parsedAPIURL.RawQuery = q.Encode()
+
+		response, err := getJSON(parsedAPIURL.String(), token, r, func() interface{} { return new(sierraapi.BibRecordsIn) })
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to look up bibs %v, %v", chunk, err), l.WarnMessage)
+			continue
+		}
+		found := response.(*sierraapi.BibRecordsIn).Entries
+		for i := range found {
+			bibs[found[i].ID] = &found[i]
+		}
+	}
+
+	for i, entry := range entries {
+		bib, found := bibs[entry.BibID]
+		if !found {
+			continue
+		}
+		entries[i].Title = bib.Title
+		entries[i].Author = bib.Author
+		if isbns := bib.Convert().ISBNs; len(isbns) > 0 {
+			entries[i].ISBN = isbns[0]
+		}
+	}
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	l.Log("Stats Handler visited.", l.TraceMessage)
+	sendJSON(w, struct {
+		StatusCache      responsecache.Stats
+		BibCache         responsecache.Stats
+		LookupCache      responsecache.Stats
+		QueryCache       responsecache.Stats
+		CoursesCache     responsecache.Stats
+		FilteredNewCache responsecache.Stats
+	}{statusCache.Stats(), bibCache.Stats(), lookupCache.Stats(), queryCache.Stats(), coursesCache.Stats(), filteredNewCache.Stats()}, "/stats")
+}
+
+func newBibsHandler(w http.ResponseWriter, r *http.Request) {
+
+	setACAOHeader(w, r, *headerACAO)
+
+	filter := &sierraapi.BibFilter{
+		Locations:     splitList(r.FormValue("location")),
+		MaterialTypes: splitList(r.FormValue("mattype")),
+		BibLevels:     splitList(r.FormValue("biblevel")),
+		Languages:     splitList(r.FormValue("lang")),
+	}
+
+	limit := *newLimit
+	if r.FormValue("limit") != "" {
+		requestedLimit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || requestedLimit < 1 {
+			http.Error(w, "Error, limit must be a positive number.", http.StatusBadRequest)
+			l.Log(fmt.Sprintf("Bad Request at /new handler, bad limit %v", r.FormValue("limit")), l.TraceMessage)
+			return
+		}
+		limit = requestedLimit
+		if limit > *newMaxLimit {
+			limit = *newMaxLimit
+		}
+	}
+
+	if filter.IsEmpty() && limit <= *newLimit {
+		response, refreshed, err := newBibs.Get()
+		if err != nil {
+			http.Error(w, "The list of new items is still being generated. Try request again.", http.StatusServiceUnavailable)
+			l.Log(err, l.DebugMessage)
+			return
+		}
+
+		if len(response) > limit {
+			response = response[:limit]
+		}
+
+		sendNewBibs(w, r, response, refreshed)
+		return
+	}
+
+	//Filtered lists aren't in the snapshot, so they are
+	//fetched from Sierra and cached until the next snapshot refresh.
+	key := url.Values{
+		"location": filter.Locations,
+		"mattype":  filter.MaterialTypes,
+		"biblevel": filter.BibLevels,
+		"lang":     filter.Languages,
+		"limit":    []string{strconv.Itoa(limit)},
+	}.Encode()
+
+	fetch := func(token string) (interface{}, error) {
+		response, err := getFilteredNewBibs(filter, limit, token)
+		return &filteredNewBibs{response, time.Now()}, err
+	}
+
+	if cached, ok := getCached(filteredNewCache, key, fetch); ok {
+		sendNewBibs(w, r, cached.(*filteredNewBibs).Bibs, cached.(*filteredNewBibs).Refreshed)
+		return
+	}
+
+	token, err := getTokenOrError(w, r)
+	if err != nil {
+		l.Log(err, l.ErrorMessage)
+		return
+	}
+
+	response, err := fetch(token)
+	if err != nil {
+		handleAPIError(w, err, "/new")
+		return
+	}
+
+	filteredNewCache.Set(key, response)
+	sendNewBibs(w, r, response.(*filteredNewBibs).Bibs, response.(*filteredNewBibs).Refreshed)
+}
+
+//A filtered list of new bibs, and when it was fetched from Sierra.
+type filteredNewBibs struct {
+	Bibs      sierraapi.BibRecordsOut
+	Refreshed time.Time
+}
+
+//sendNewBibs writes the list of new bibs as JSON, RSS or Atom.
+//The format comes from the /new.rss or /new.atom URL, or the Accept header.
+func sendNewBibs(w http.ResponseWriter, r *http.Request, bibs sierraapi.BibRecordsOut, refreshed time.Time) {
+
+	w.Header().Set("Last-Modified", refreshed.UTC().Format(http.TimeFormat))
+	if r.URL.Path == "/new" {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	accept := r.Header.Get("Accept")
+	config := &feed.Config{
+		Title:              *feedTitle,
+		Self:               requestURL(r),
+		RecordLinkTemplate: *opacLink,
+	}
+
+	var out []byte
+	var err error
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".rss") || (r.URL.Path == "/new" && strings.Contains(accept, "application/rss+xml")):
+		w.Header().Set("Content-Type", "application/rss+xml;charset=UTF-8")
+		out, err = feed.RSS(bibs, refreshed, config)
+	case strings.HasSuffix(r.URL.Path, ".atom") || (r.URL.Path == "/new" && strings.Contains(accept, "application/atom+xml")):
+		w.Header().Set("Content-Type", "application/atom+xml;charset=UTF-8")
+		out, err = feed.Atom(bibs, refreshed, config)
+	default:
+		sendJSON(w, bibs, "/new")
+		return
+	}
+
+	if err != nil {
+		w.Header().Del("Content-Type")
+		http.Error(w, "XML Encoding Error", http.StatusInternalServerError)
+		l.Log(fmt.Sprintf("Internal Server Error at /new handler, XML Encoding Error: %v", err), l.WarnMessage)
+		return
+	}
+
+	l.Log(fmt.Sprintf("Sending feed at %v handler: %v", r.URL.Path, bibs), l.TraceMessage)
+	w.Write(out)
+}
+
+//requestURL rebuilds the full URL the client used to reach Tyro.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%v://%v%v", scheme, r.Host, r.URL.RequestURI())
+}
+
+//getFilteredNewBibs walks backwards from today, one day at a time,
+//collecting the newest bibs which pass the filter. Locations are
+//passed on to Sierra, the other fixed fields are checked here.
+//It gives up after -newmaxdays days.
+func getFilteredNewBibs(filter *sierraapi.BibFilter, limit int, token string) (sierraapi.BibRecordsOut, error) {
+
+	found := make(map[int]sierraapi.BibRecordOut)
+	date := time.Now()
+
+	for day := 0; day < *newMaxDays && len(found) < limit; day++ {
+
+		for offset := 0; ; offset += sierraapi.BibsPerPage {
+			parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
+			if err != nil {
+				return nil, err
+			}
+
+			q := parsedAPIURL.Query()
+			q.Set("limit", strconv.Itoa(sierraapi.BibsPerPage))
+			q.Set("offset", strconv.Itoa(offset))
+			q.Set("deleted", "false")
+			q.Set("suppressed", "false")
+			q.Set("createdDate", fmt.Sprintf("[%v,%v]", date.AddDate(0, 0, -1).Format(time.RFC3339), date.Format(time.RFC3339)))
+			q.Set("fields", "marc,default")
+			if len(filter.Locations) > 0 {
+				q.Set("locations", strings.Join(filter.Locations, ","))
+			}
+			parsedAPIURL.RawQuery = q.Encode()
+
+			response, err := getJSON(parsedAPIURL.String(), token, nil, func() interface{} { return new(sierraapi.BibRecordsIn) })
+			if err == sierraapi.ErrNotFound {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			page := response.(*sierraapi.BibRecordsIn)
+			for _, entry := range page.Entries {
+				if filter.Matches(&entry) {
+					found[entry.ID] = *entry.Convert()
+				}
+			}
+
+			if len(page.Entries) < sierraapi.BibsPerPage {
+				break
+			}
+		}
+
+		date = date.AddDate(0, 0, -1)
+	}
+
+	response := sierraapi.BibRecordsOut{}
+	for _, entry := range found {
+		response = append(response, entry)
+	}
+
+	sort.Sort(sort.Reverse(response))
+
+	if len(response) > limit {
+		response = response[:limit]
+	}
+
+	return response, nil
+}
+
+//splitList splits a comma separated list of codes,
+//dropping empty entries.
+func splitList(list string) []string {
+	var codes []string
+	for _, code := range strings.Split(list, ",") {
+		code = strings.TrimSpace(code)
+		if code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+//fetchNewBibs finds the newest bibs for the /new snapshot.
+func fetchNewBibs() (sierraapi.BibRecordsOut, error) {
+
+	token, err := getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := getNewItems(token)
+	if err == sierraapi.ErrUnauthorized {
+		tokenStore.Refresh <- struct{}{}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var response sierraapi.BibRecordsOut
+
+	for _, entry := range entries {
+		response = append(response, entry)
+	}
+
+	sort.Sort(sort.Reverse(response))
+
+	if len(response) > *newLimit {
+		response = response[:*newLimit]
+	}
+
+	return response, nil
+}
+
+func getNumberOfEntries(date time.Time, token string) (int, error) {
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	q := parsedAPIURL.Query()
+	q.Set("deleted", "false")
+	q.Set("suppressed", "false")
+	q.Set("createdDate", fmt.Sprintf("[%v,%v]", date.AddDate(0, 0, -1).Format(time.RFC3339), date.Format(time.RFC3339)))
+	q.Set("fields", "default")
+	parsedAPIURL.RawQuery = q.Encode()
+
+	response, err := getJSON(sierraapi.TotalURL(parsedAPIURL).String(), token, nil, func() interface{} { return new(sierraapi.TotalIn) })
+	if err != nil {
+		return 0, err
+	}
+
+	return response.(*sierraapi.TotalIn).Total, nil
+
+}
+
+//getNewItems walks backwards from today, one day at a time, collecting
+//the newest -newlimit bibs. Only the newest bibs of each day are fetched.
+//It gives up after -newmaxdays days, so a catalogue with no recent
+//bibs doesn't keep it walking back forever.
+func getNewItems(token string) (map[int]sierraapi.BibRecordOut, error) {
+
+	found := make(map[int]sierraapi.BibRecordOut)
+	date := time.Now()
+
+	for day := 0; day < *newMaxDays && len(found) < *newLimit; day++ {
+
+		total, err := getNumberOfEntries(date, token)
+		if err != nil && err != sierraapi.ErrNotFound {
+			return nil, err
+		}
+
+		//The newest bibs of the day are at the end.
+		wanted := *newLimit - len(found)
+		offset := 0
+		if total > wanted {
+			offset = total - wanted
+		}
+
+		if total > 0 {
+			parsedAPIURL, err := parseURLandJoinToPath(*apiURL, sierraapi.BibRequestEndpoint)
+			if err != nil {
+				return nil, err
+			}
+
+			q := parsedAPIURL.Query()
+			q.Set("offset", strconv.Itoa(offset))
+			q.Set("limit", strconv.Itoa(total-offset))
+			q.Set("deleted", "false")
+			q.Set("createdDate", fmt.Sprintf("[%v,%v]", date.AddDate(0, 0, -1).Format(time.RFC3339), date.Format(time.RFC3339)))
+			q.Set("fields", "marc,default")
+			q.Set("suppressed", "false")
+			parsedAPIURL.RawQuery = q.Encode()
+
+			response, err := getJSON(parsedAPIURL.String(), token, nil, func() interface{} { return new(sierraapi.BibRecordsIn) })
+			if err != nil && err != sierraapi.ErrNotFound {
+				return nil, err
+			}
+			if err == nil {
+				for _, entry := range *response.(*sierraapi.BibRecordsIn).Convert() {
+					found[entry.BibID] = entry
+				}
+			}
+		}
+
+		date = date.AddDate(0, 0, -1)
+	}
+
+	return found, nil
+}
+
+func rawRewriter(r *http.Request) {
+
+	token, err := tokenStore.Get()
+	if err != nil {
+		l.Log("Error at /raw/ handler, token not yet generated.", l.DebugMessage)
+	}
+
+	parsedAPIURL, err := parseURLandJoinToPath(*apiURL, r.URL.Path[len("/raw/"):])
+	if err != nil {
+		log.Fatalf("FATAL: %v", err)
+	}
+
+	parsedAPIURL.RawQuery = r.URL.RawQuery
+
+	r.URL = parsedAPIURL
+
+	err = sierraapi.SetAuthorizationHeaders(r, r, token)
+	if err != nil {
+		l.Log("The remote address in an incoming request is not set properly", l.DebugMessage)
 	}
 
 	l.Log(fmt.Sprintf("Sending proxied request: %v", r), l.TraceMessage)
@@ -523,9 +2933,20 @@ func parseURLandJoinToPath(URL string, toJoin ...string) (*url.URL, error) {
 
 func getTokenOrError(w http.ResponseWriter, r *http.Request) (string, error) {
 
-	token, err := tokenStore.Get()
+	token, err := getToken()
 	if err != nil {
 		http.Error(w, "Token Error.", http.StatusInternalServerError)
+	}
+
+	return token, err
+}
+
+//getToken gets the current token from the TokenStore,
+//waiting for it to be initialized if Tyro has just started.
+func getToken() (string, error) {
+
+	token, err := tokenStore.Get()
+	if err != nil {
 		return token, err
 	}
 	if token == tokenstore.UninitialedTokenValue {
@@ -535,11 +2956,9 @@ func getTokenOrError(w http.ResponseWriter, r *http.Request) (string, error) {
 			tokenStore.Initialized <- struct{}{}
 			token, err = tokenStore.Get()
 			if err != nil {
-				http.Error(w, "Token Error.", http.StatusInternalServerError)
 				return token, err
 			}
 		case <-time.After(time.Second * 30):
-			http.Error(w, "Token Error.", http.StatusInternalServerError)
 			return token, errors.New("Unable to get token from TokenStore")
 		}
 	}
@@ -560,3 +2979,46 @@ func setACAOHeader(w http.ResponseWriter, r *http.Request, headerConfig string)
 		}
 	}
 }
+
+//getJSON fetches apiURL from the Sierra API, decoding the response
+//into the value returned by newValue. Concurrent calls for the same
+//URL share a single upstream request, and receive the same decoded value,
+//which must not be modified.
+func getJSON(apiURL, token string, r *http.Request, newValue func() interface{}) (interface{}, error) {
+	response, err, shared := inFlight.Do(apiURL, func() (interface{}, error) {
+		v := newValue()
+		err := sierraapi.GetJSON(apiURL, token, r, v)
+		return v, err
+	})
+	if shared {
+		l.Log(fmt.Sprintf("Shared in-flight request to %v", apiURL), l.TraceMessage)
+	}
+	return response, err
+}
+
+//handleAPIError writes an error response for an error returned by sierraapi.GetJSON.
+func handleAPIError(w http.ResponseWriter, err error, handler string) {
+	if err == sierraapi.ErrUnauthorized {
+		http.Error(w, "Token is out of date, or is refreshing. Try request again.", http.StatusInternalServerError)
+		tokenStore.Refresh <- struct{}{}
+		l.Log("Token is out of date.", l.ErrorMessage)
+		return
+	}
+	http.Error(w, "Error querying Sierra API.", http.StatusInternalServerError)
+	l.Log(fmt.Sprintf("Internal Server Error at %v handler, %v", handler, err), l.ErrorMessage)
+}
+
+//sendJSON encodes v and writes it to the client.
+func sendJSON(w http.ResponseWriter, v interface{}, handler string) {
+	finalJSON, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "JSON Encoding Error", http.StatusInternalServerError)
+		l.Log(fmt.Sprintf("Internal Server Error at %v handler, JSON Encoding Error: %v", handler, err), l.WarnMessage)
+		return
+	}
+
+	l.Log(fmt.Sprintf("Sending response at %v handler: %v", handler, v), l.TraceMessage)
+
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Write(finalJSON)
+}
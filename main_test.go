@@ -5,14 +5,24 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	l "github.com/cudevmaxwell/tyro/loglevel"
+	"github.com/cudevmaxwell/tyro/newbibs"
+	"github.com/cudevmaxwell/tyro/reports"
+	"github.com/cudevmaxwell/tyro/responsecache"
+	"github.com/cudevmaxwell/tyro/session"
+	"github.com/cudevmaxwell/tyro/shelf"
+	"github.com/cudevmaxwell/tyro/sierraapi"
 	"github.com/cudevmaxwell/tyro/tokenstore"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -253,7 +263,7 @@ func TestStatusBibHandlerBadURLParse(t *testing.T) {
 
 }
 
-func TestRawHandlerTestRewrite(t *testing.T) {
+func TestStatusBibHandlerCachesResponse(t *testing.T) {
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
@@ -264,204 +274,2102 @@ func TestRawHandlerTestRewrite(t *testing.T) {
 	tokenStore.Refresher(ts.URL, "", "")
 	defer close(tokenStore.Refresh)
 
-	req, err := http.NewRequest("GET", "/raw/?bibIds=1234", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
+	upstreamRequests := 0
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		fmt.Fprintln(w, `{"entries":[{"id":2536252,"location":{"code":"flr4 ","name":"Floor 4 Books"},"status":{"code":"-","display":"IN LIBRARY"},"callNumber":"|aJC578.R383|bG67 2007"}]}`)
+	}))
+	defer ts2.Close()
 
 	oldAPIURL := *apiURL
-	*apiURL = "http://apiurl.com/test/"
+	*apiURL = ts2.URL
 	defer func() { *apiURL = oldAPIURL }()
 
-	rawRewriter(req)
+	oldStatusCache := statusCache
+	statusCache = responsecache.NewCache(time.Minute, time.Minute)
+	defer func() { statusCache = oldStatusCache }()
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "/status/bib/2401597", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		statusBibHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Status handler didn't return %v when provided with a good response.", http.StatusOK)
+		}
+		if !strings.Contains(w.Body.String(), "JC578.R383 G67 2007") {
+			t.Error("Status handler didn't return the item's call number.")
+		}
+	}
 
-	if req.URL.String() != "http://apiurl.com/test?bibIds=1234" {
-		t.Error("The raw handler is not correctly rewriting the url")
+	if upstreamRequests != 1 {
+		t.Errorf("Expected 1 request to the Sierra API, got %v", upstreamRequests)
 	}
 
+	stats := statusCache.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
 }
 
-func TestOverrideUnsetFlagsFromEnvVars(t *testing.T) {
+func TestStatusBibHandlerSummary(t *testing.T) {
 
-	oldAddress := os.Getenv(EnvPrefix + "ADDRESS")
-	defer os.Setenv(EnvPrefix+"ADDRESS", oldAddress)
-	newAddress := ":7654"
-	os.Setenv(EnvPrefix+"ADDRESS", newAddress)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
 
-	overrideUnsetFlagsFromEnvironmentVariables()
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
 
-	if *address != ":7654" {
-		t.Error("Didn't override unset flags.")
-	}
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			fmt.Fprintln(w, `{"entries":[
+				{"id":1,"location":{"code":"flr4","name":"Floor 4 Books"},"status":{"code":"-","display":"AVAILABLE"}},
+				{"id":2,"location":{"code":"flr4","name":"Floor 4 Books"},"status":{"code":"-","display":"AVAILABLE","duedate":"2014-11-13T09:00:00Z"}},
+				{"id":3,"location":{"code":"res","name":"Reserves"},"status":{"code":"m","display":"MISSING"}}]}`)
+		case "/bibs/2401597/holds":
+			fmt.Fprintln(w, `{"total":4,"entries":[]}`)
+		default:
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer ts2.Close()
 
-}
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
 
-func TestParseURLandJoinToPath(t *testing.T) {
+	oldStatusCache := statusCache
+	statusCache = responsecache.NewCache(time.Minute, time.Minute)
+	defer func() { statusCache = oldStatusCache }()
+
+	get := func(path string) sierraapi.ItemRecordsOut {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		statusBibHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Status handler returned %v for %v", w.Code, path)
+		}
+		var response sierraapi.ItemRecordsOut
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
 
-	goodURL := "http://test.com"
-	endpoint := "test"
-	badURL := ":"
+	//The plain response, cached first, shouldn't gain a summary.
+	if response := get("/status/bib/2401597"); response.Summary != nil || len(response.Entries) != 3 {
+		t.Errorf("Unexpected response without a summary %+v", response)
+	}
 
-	parsedURL, err := parseURLandJoinToPath(goodURL, endpoint)
-	if err != nil {
-		t.Error("The parse should not have failed.")
+	response := get("/status/bib/2401597?summary=true")
+	summary := response.Summary
+	if summary == nil || len(response.Entries) != 3 {
+		t.Fatalf("Expected a summary and the entries, got %+v", response)
 	}
-	if parsedURL.String() != "http://test.com/test" {
-		t.Error("Bad join")
+	if summary.Total != 3 || summary.Available != 1 || summary.Holds != 4 || summary.EarliestDue != "Due November 13, 2014" {
+		t.Errorf("Unexpected summary %+v", summary)
 	}
-
-	_, err = parseURLandJoinToPath(badURL, endpoint)
-	if err == nil {
-		t.Error("Parse should have failed")
+	if len(summary.Locations) != 2 || summary.Locations[0].Location != "Floor 4 Books" || summary.Locations[0].Total != 2 {
+		t.Errorf("Unexpected locations in summary %+v", summary.Locations)
 	}
 
+	if response := get("/status/bib/2401597"); response.Summary != nil {
+		t.Error("The summary shouldn't leak into the cached response without one.")
+	}
 }
 
-func TestGetTokenOrErrorFailTokenStoreInitialized(t *testing.T) {
+func TestBibHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
 
 	tokenStore = tokenstore.NewTokenStore()
-	tokenStore.Refresher(":", "", "")
+	tokenStore.Refresher(ts.URL, "", "")
 	defer close(tokenStore.Refresh)
 
-	r, err := http.NewRequest("GET", "", nil)
-	if err != nil {
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fields") != "default,marc" {
+			t.Errorf("Expected the MARC record to be asked for, got %v", r.URL.RawQuery)
+		}
+		switch r.URL.Path {
+		case "/bibs/2401597":
+			fmt.Fprintln(w, `{"id":2401597,"lang":{"code":"eng","name":"English"},"materialType":{"code":"a","value":"BOOK"},
+				"marc":{"leader":"","fields":[
+					{"tag":"245","data":{"ind1":"1","ind2":"0","subfields":[{"code":"a","data":"A Title /"},{"code":"c","data":"An Author."}]}},
+					{"tag":"856","data":{"ind1":"4","ind2":"0","subfields":[{"code":"u","data":"https://example.com/1"},{"code":"z","data":"Online access"}]}}]}}`)
+		case "/bibs/2401598":
+			fmt.Fprintln(w, `{"id":2401598,"suppressed":true}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldBibCache, oldStatusCache := bibCache, statusCache
+	bibCache, statusCache = responsecache.NewCache(time.Minute, time.Minute), responsecache.NewCache(time.Minute, time.Minute)
+	defer func() { bibCache, statusCache = oldBibCache, oldStatusCache }()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		bibHandler(w, req)
+		return w
+	}
+
+	w := get("/bib/2401597")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Bib handler returned %v", w.Code)
+	}
+	var response sierraapi.BibDetailOut
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
 		t.Fatal(err)
 	}
-	w := httptest.NewRecorder()
+	if response.BibID != 2401597 || response.Title != "A Title" || response.Responsibility != "An Author" || response.Language != "English" || response.MaterialType != "BOOK" {
+		t.Errorf("Unexpected response %+v", response)
+	}
+	if len(response.URLs) != 1 || response.URLs[0].Text != "Online access" {
+		t.Errorf("Unexpected URLs %+v", response.URLs)
+	}
 
-	<-tokenStore.Initialized
+	formats := map[string]string{
+		"/bib/2401597.xml":      "application/marcxml+xml;charset=UTF-8",
+		"/bib/2401597.mrc":      "application/marc",
+		"/bib/2401597.marcjson": "application/marc+json;charset=UTF-8",
+		"/bib/2401597.ris":      "application/x-research-info-systems;charset=UTF-8",
+		"/bib/2401597.bib":      "application/x-bibtex;charset=UTF-8",
+		"/bib/2401597.csljson":  "application/vnd.citationstyles.csl+json;charset=UTF-8",
+		"/bib/2401597.coins":    "text/html;charset=UTF-8",
+		"/bib/2401597.jsonld":   "application/ld+json;charset=UTF-8",
+	}
+	for path, contentType := range formats {
+		if w := get(path); w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("Bib handler returned %v %v for %v, expected %v", w.Code, w.Header().Get("Content-Type"), path, contentType)
+		}
+	}
 
-	if _, err := getTokenOrError(w, r); err == nil {
-		t.Error("Should have failed with unparseable URL.")
+	req, err := http.NewRequest("GET", "/bib/2401597", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html, application/marcxml+xml;q=0.9")
+	w = httptest.NewRecorder()
+	bibHandler(w, req)
+	if !strings.Contains(w.Body.String(), `<subfield code="a">A Title /</subfield>`) || w.Header().Get("Vary") != "Accept" {
+		t.Errorf("Expected MARCXML for the Accept header, got %v", w.Body.String())
 	}
 
-	if w.Code != http.StatusInternalServerError {
-		t.Error("Should have returned a InternalServerError")
+	//Browsers ask for text/html, which shouldn't give them COinS.
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w = httptest.NewRecorder()
+	bibHandler(w, req)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("Expected the JSON record for a browser, got %v", w.Header().Get("Content-Type"))
+	}
+
+	for path, code := range map[string]int{
+		"/bib/2401597.pdf": http.StatusNotFound,
+		"/bib/2401598":     http.StatusNotFound,
+		"/bib/2401599":     http.StatusNotFound,
+		"/bib/":            http.StatusBadRequest,
+		"/bib/abc":         http.StatusBadRequest,
+	} {
+		if w := get(path); w.Code != code {
+			t.Errorf("Bib handler returned %v for %v, expected %v", w.Code, path, code)
+		}
 	}
 
+	//Bib responses are counted apart from /status/ responses.
+	if bibCache.Stats().Misses == 0 || bibCache.Stats().Hits == 0 || statusCache.Stats() != (responsecache.Stats{}) {
+		t.Errorf("Unexpected cache counters, bib %+v, status %+v", bibCache.Stats(), statusCache.Stats())
+	}
 }
 
-func TestGetTokenOrErrorFailTokenStoreUninitialized(t *testing.T) {
+func TestStatusBibHandlerCoalescesConcurrentRequests(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
 
 	tokenStore = tokenstore.NewTokenStore()
-	tokenStore.Refresher(":", "", "")
+	tokenStore.Refresher(ts.URL, "", "")
 	defer close(tokenStore.Refresh)
 
-	r, err := http.NewRequest("GET", "", nil)
-	if err != nil {
-		t.Fatal(err)
+	var lock sync.Mutex
+	upstreamRequests := 0
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		upstreamRequests++
+		lock.Unlock()
+		time.Sleep(time.Millisecond * 200)
+		fmt.Fprintln(w, `{"entries":[{"id":2536252,"location":{"code":"flr4 ","name":"Floor 4 Books"},"status":{"code":"-","display":"IN LIBRARY"},"callNumber":"|aJC578.R383|bG67 2007"}]}`)
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	//Turn off the cache, so only the coalescing is tested.
+	oldStatusCache := statusCache
+	statusCache = responsecache.NewCache(0, 0)
+	defer func() { statusCache = oldStatusCache }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "/status/bib/2401597", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			w := httptest.NewRecorder()
+			statusBibHandler(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Status handler didn't return %v when provided with a good response.", http.StatusOK)
+			}
+			if !strings.Contains(w.Body.String(), "JC578.R383 G67 2007") {
+				t.Error("Every waiting handler should get the item's call number.")
+			}
+		}()
 	}
-	w := httptest.NewRecorder()
+	wg.Wait()
 
-	if _, err := getTokenOrError(w, r); err == nil {
-		t.Error("Should have failed with unparseable URL.")
+	if upstreamRequests != 1 {
+		t.Errorf("Expected 1 request to the Sierra API, got %v", upstreamRequests)
 	}
+}
 
-	if w.Code != http.StatusInternalServerError {
-		t.Error("Should have returned a InternalServerError")
+func TestStatusBibsHandlerNoBibIds(t *testing.T) {
+
+	req, err := http.NewRequest("GET", "/status/bibs", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	w := httptest.NewRecorder()
+	statusBibsHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Status handler didn't error %v when no bib ids provided", http.StatusBadRequest)
+	}
 }
 
-func TestGetTokenOrErrorFailTokenStoreTimeout(t *testing.T) {
+func TestStatusBibsHandlerGoodResponseFromSierra(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
 
 	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
 
-	r, err := http.NewRequest("GET", "", nil)
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("bibIds") != "1001,1002,1003" {
+			t.Errorf("Expected the BibIDs to be sent in one request, got %v", r.URL.Query().Get("bibIds"))
+		}
+		fmt.Fprintln(w, `{"entries":[
+			{"id":1,"bibIds":[1001],"location":{"name":"Floor 4 Books"},"callNumber":"|aJC578.R383|bG67 2007"},
+			{"id":2,"bibIds":["1002"],"location":{"name":"Floor 3 Books"},"callNumber":"|aPR6068.O93|bH372 1999"},
+			{"id":3,"bibIds":[1001],"location":{"name":"Reserves"},"callNumber":"|aJC578.R383|bG67 2007 c.2"}
+		]}`)
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldStatusCache := statusCache
+	statusCache = responsecache.NewCache(time.Minute, time.Minute)
+	defer func() { statusCache = oldStatusCache }()
+
+	requests := []*http.Request{}
+
+	//The same bib asked for by its record number, and with a leading zero.
+	req, err := http.NewRequest("GET", "/status/bibs?ids=1001,1002,b1001,01003", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	w := httptest.NewRecorder()
+	requests = append(requests, req)
 
-	time.Sleep(time.Second * 31)
+	req, err = http.NewRequest("POST", "/status/bibs", strings.NewReader(`{"bibIds":[1001,1002,1003]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	requests = append(requests, req)
+
+	for _, req := range requests {
+		//Start each request with an empty cache.
+		statusCache = responsecache.NewCache(time.Minute, time.Minute)
+
+		w := httptest.NewRecorder()
+		statusBibsHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Status handler didn't return %v when provided with a good response.", http.StatusOK)
+		}
+
+		var response map[string]sierraapi.ItemRecordsOut
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response) != 3 {
+			t.Errorf("Expected 3 bibs in the response, got %v", len(response))
+		}
+		if len(response["1001"].Entries) != 2 || len(response["1002"].Entries) != 1 || len(response["1003"].Entries) != 0 {
+			t.Errorf("Items not grouped by bib correctly, got %v", response)
+		}
+		if !strings.Contains(w.Body.String(), `"1003":{"Entries":[]}`) {
+			t.Errorf("A bib without items should have an empty list of entries, got %v", w.Body.String())
+		}
+	}
 
-	if _, err := getTokenOrError(w, r); err == nil {
-		t.Error("Should have failed with unparseable URL.")
+	//The bibs with items are now cached for /status/bib/, the bib without items is not.
+	if _, _, ok := statusCache.Get(ts2.URL + "/items?bibIds=1001&deleted=false&suppressed=false"); !ok {
+		t.Error("Expected the batch results to be cached per bib.")
+	}
+	if _, _, ok := statusCache.Get(ts2.URL + "/items?bibIds=1003&deleted=false&suppressed=false"); ok {
+		t.Error("A bib without items should not be cached.")
 	}
+}
 
-	if w.Code != http.StatusInternalServerError {
-		t.Error("Should have returned a InternalServerError")
+func TestNormalizeBibID(t *testing.T) {
+	tests := map[string]string{
+		"2401597":    "2401597",
+		" 02401597 ": "2401597",
+		"b2401597":   "2401597",
+		"B24015975":  "2401597",
+		".b24015975": "2401597",
+		"b":          "",
+		"abc":        "",
+		"0":          "",
+		"":           "",
+	}
+	for raw, expected := range tests {
+		bibID, ok := normalizeBibID(raw)
+		if bibID != expected || ok != (expected != "") {
+			t.Errorf("normalizeBibID(%q) returned %q, %v, expected %q", raw, bibID, ok, expected)
+		}
 	}
 
+	for path, handler := range map[string]http.HandlerFunc{
+		"/status/bibs?ids=1001,abc": statusBibsHandler,
+		"/status/bib/abc":           statusBibHandler,
+	} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v returned %v, expected %v", path, w.Code, http.StatusBadRequest)
+		}
+	}
 }
 
-//The default case. Don't set the header at all.
-func TestSetACAOHeaderNoConfig(t *testing.T) {
-	r, err := http.NewRequest("GET", "/", nil)
+func TestStatsHandler(t *testing.T) {
+
+	req, err := http.NewRequest("GET", "/stats", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	w := httptest.NewRecorder()
-	setACAOHeader(w, r, "")
-	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
-		t.Error("Access-Control-Allow-Origin shouldn't be set.")
+	statsHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Stats handler didn't return %v", http.StatusOK)
+	}
+	for _, cache := range []string{"StatusCache", "BibCache", "LookupCache", "QueryCache", "CoursesCache", "FilteredNewCache"} {
+		if !strings.Contains(w.Body.String(), `"`+cache+`"`) {
+			t.Errorf("Stats handler didn't return the %v counters.", cache)
+		}
 	}
 }
 
-//Set the header to *.
-func TestSetACAOHeaderAllOrigins(t *testing.T) {
-	r, err := http.NewRequest("GET", "/", nil)
+func TestNewBibsHandlerSnapshotNotReady(t *testing.T) {
+
+	oldNewBibs := newBibs
+	newBibs = newbibs.NewSnapshot()
+	defer func() { newBibs = oldNewBibs }()
+
+	req, err := http.NewRequest("GET", "/new", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	w := httptest.NewRecorder()
-	setACAOHeader(w, r, "*")
-	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "*" {
-		t.Error("Access-Control-Allow-Origin not set properly.")
+	newBibsHandler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("New handler didn't return %v before the snapshot was ready.", http.StatusServiceUnavailable)
 	}
 }
 
-//Set the ACAO config to a single origin which doesn't match.
-func TestSetACAOHeaderNotMatchOnSingle(t *testing.T) {
-	r, err := http.NewRequest("GET", "/", nil)
+func TestNewBibsHandlerFromSnapshot(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("limit") == "1" {
+			fmt.Fprintln(w, `{"total":20}`)
+			return
+		}
+		//Only the newest -newlimit bibs of the day are asked for.
+		if r.URL.Query().Get("offset") != "18" || r.URL.Query().Get("limit") != "2" {
+			t.Errorf("Expected an offset of 18 and a limit of 2, got %v", r.URL.RawQuery)
+		}
+		fmt.Fprintln(w, `{"entries":[
+			{"id":1001,"createdDate":"2015-01-22T08:00:00Z","marc":{"fields":[{"tag":"245","data":{"subfields":[{"code":"a","data":"Older /"},{"code":"c","data":"An Author."}]}}]}},
+			{"id":1002,"createdDate":"2015-01-22T09:00:00Z","marc":{"fields":[{"tag":"245","data":{"subfields":[{"code":"a","data":"Newer /"},{"code":"c","data":"An Author."}]}}]}}
+		]}`)
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldNewLimit := *newLimit
+	*newLimit = 2
+	defer func() { *newLimit = oldNewLimit }()
+
+	oldNewBibs := newBibs
+	newBibs = newbibs.NewSnapshot()
+	defer func() { newBibs = oldNewBibs }()
+
+	fetched := make(chan struct{}, 1)
+	newBibs.Poller(time.Hour, func() (sierraapi.BibRecordsOut, error) {
+		defer func() { fetched <- struct{}{} }()
+		return fetchNewBibs()
+	})
+	defer close(newBibs.Refresh)
+
+	select {
+	case <-fetched:
+	case <-time.After(time.Second * 5):
+		t.Fatal("The snapshot was never refreshed.")
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	req, err := http.NewRequest("GET", "/new", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	w := httptest.NewRecorder()
-	setACAOHeader(w, r, "http://test.com")
-	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
-		t.Error("Access-Control-Allow-Origin shouldn't be set.")
+	newBibsHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("New handler didn't return %v from the snapshot.", http.StatusOK)
+	}
+	if w.HeaderMap.Get("Last-Modified") == "" {
+		t.Error("New handler should report when the snapshot was refreshed.")
 	}
-}
 
-//Set the ACAO config to a single origin which does match.
-func TestSetACAOHeaderMatchOnSingle(t *testing.T) {
-	r, err := http.NewRequest("GET", "/", nil)
-	if err != nil {
+	var response sierraapi.BibRecordsOut
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
 		t.Fatal(err)
 	}
-	r.Header.Set("Origin", "http://test.com")
-	w := httptest.NewRecorder()
-	setACAOHeader(w, r, "http://test.com")
-	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "http://test.com" {
-		t.Error("Access-Control-Allow-Origin not set properly.")
+	if len(response) != 2 || response[0].BibID != 1002 || response[1].BibID != 1001 {
+		t.Errorf("New handler should return the newest bibs first, got %v", response)
 	}
 }
 
-//Set the ACAO config to a one of a list of origins, none of which match.
-func TestSetACAOHeaderNoMatchOnList(t *testing.T) {
-	r, err := http.NewRequest("GET", "/", nil)
+func TestFetchNewBibsGivesUp(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	//A catalogue with no recent bibs.
+	var days int
+	var lock sync.Mutex
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		days++
+		lock.Unlock()
+		fmt.Fprintln(w, `{"total":0}`)
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldNewMaxDays := *newMaxDays
+	*newMaxDays = 3
+	defer func() { *newMaxDays = oldNewMaxDays }()
+
+	bibs, err := fetchNewBibs()
 	if err != nil {
 		t.Fatal(err)
 	}
-	r.Header.Set("Origin", "http://test3.com")
-	w := httptest.NewRecorder()
-	setACAOHeader(w, r, "http://test.com;http://test2.com;")
-	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
-		t.Error("Access-Control-Allow-Origin shouldn't be set.")
+	if len(bibs) != 0 || days != 3 {
+		t.Errorf("fetchNewBibs() should give up after -newmaxdays days, found %v after %v requests", bibs, days)
 	}
 }
 
-//Set the ACAO config to a one of a list of origins, one of which does match.
-func TestSetACAOHeaderMatchOnList(t *testing.T) {
-	r, err := http.NewRequest("GET", "/", nil)
-	if err != nil {
-		t.Fatal(err)
+func TestNewBibsHandlerFeeds(t *testing.T) {
+
+	oldNewLimit := *newLimit
+	*newLimit = 2
+	defer func() { *newLimit = oldNewLimit }()
+
+	oldNewBibs := newBibs
+	newBibs = newbibs.NewSnapshot()
+	defer func() { newBibs = oldNewBibs }()
+
+	fetched := make(chan struct{}, 1)
+	newBibs.Poller(time.Hour, func() (sierraapi.BibRecordsOut, error) {
+		defer func() { fetched <- struct{}{} }()
+		return sierraapi.BibRecordsOut{sierraapi.BibRecordOut{BibID: 7777777, TitleAndAuthor: "A Title /An Author."}}, nil
+	})
+	defer close(newBibs.Refresh)
+	<-fetched
+	time.Sleep(time.Millisecond * 10)
+
+	oldOPACLink := *opacLink
+	*opacLink = "https://catalogue.library.ca/record=b{bibID}"
+	defer func() { *opacLink = oldOPACLink }()
+
+	tests := []struct {
+		url, accept, contentType string
+	}{
+		{"/new.rss", "", "application/rss+xml;charset=UTF-8"},
+		{"/new.atom", "", "application/atom+xml;charset=UTF-8"},
+		{"/new", "application/atom+xml", "application/atom+xml;charset=UTF-8"},
+		{"/new", "application/rss+xml, */*", "application/rss+xml;charset=UTF-8"},
+		{"/new", "", "application/json;charset=UTF-8"},
 	}
-	r.Header.Set("Origin", "http://test2.com")
-	w := httptest.NewRecorder()
-	setACAOHeader(w, r, "http://test.com;http://test2.com;")
-	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "http://test2.com" {
-		t.Error("Access-Control-Allow-Origin not set properly.")
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		w := httptest.NewRecorder()
+		newBibsHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("New handler didn't return %v for %v", http.StatusOK, test.url)
+		}
+		if w.HeaderMap.Get("Content-Type") != test.contentType {
+			t.Errorf("Expected %v for %v with Accept %v, got %v", test.contentType, test.url, test.accept, w.HeaderMap.Get("Content-Type"))
+		}
+		if !strings.Contains(w.Body.String(), "7777777") {
+			t.Errorf("Expected the bib in the response for %v", test.url)
+		}
+	}
+}
+
+func TestNewBibsHandlerFiltered(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	days := 0
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		days++
+		if r.URL.Query().Get("locations") != "mu" {
+			t.Errorf("Expected the location filter to be sent to Sierra, got %v", r.URL.Query().Get("locations"))
+		}
+		fmt.Fprintln(w, `{"entries":[
+			{"id":1001,"createdDate":"2015-01-22T08:00:00Z","materialType":{"code":"g"},"lang":{"code":"eng"},"locations":[{"code":"mu"}]},
+			{"id":1002,"createdDate":"2015-01-22T09:00:00Z","materialType":{"code":"a"},"lang":{"code":"eng"},"locations":[{"code":"mu"}]}
+		]}`)
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldNewMaxDays := *newMaxDays
+	*newMaxDays = 3
+	defer func() { *newMaxDays = oldNewMaxDays }()
+
+	oldFilteredNewCache := filteredNewCache
+	filteredNewCache = responsecache.NewCache(time.Minute, time.Minute)
+	defer func() { filteredNewCache = oldFilteredNewCache }()
+
+	req, err := http.NewRequest("GET", "/new?location=mu&mattype=g&limit=5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	newBibsHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("New handler didn't return %v for a filtered list.", http.StatusOK)
+	}
+
+	var response sierraapi.BibRecordsOut
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 1 || response[0].BibID != 1001 {
+		t.Errorf("New handler didn't filter on material type, got %v", response)
+	}
+	if days != 3 {
+		t.Errorf("Expected to look back 3 days for matching bibs, looked back %v", days)
+	}
+}
+
+func TestNewBibsHandlerBadLimit(t *testing.T) {
+
+	req, err := http.NewRequest("GET", "/new?limit=none", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	newBibsHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("New handler didn't return %v for a bad limit.", http.StatusBadRequest)
+	}
+}
+
+//A mock Sierra API for the patron endpoints.
+func newPatronTestServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/patrons/validate":
+			var credentials struct {
+				Barcode string `json:"barcode"`
+				PIN     string `json:"pin"`
+			}
+			json.NewDecoder(r.Body).Decode(&credentials)
+			if credentials.Barcode == "12345" && credentials.PIN == "1234" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `{"code":108,"specificCode":0,"httpStatus":400,"name":"Invalid parameter","description":"Invalid barcode or PIN"}`)
+		case "/patrons/find":
+			if r.URL.Query().Get("barcode") != "12345" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprintln(w, `{"id":1234567}`)
+		case "/patrons/1234567/checkouts":
+			fmt.Fprintln(w, `{"total":2,"entries":[{"id":"https://example.com/v2/patrons/checkouts/111","patron":"https://example.com/v2/patrons/1234567","item":"https://example.com/v2/items/2536252","barcode":"39007001","callNumber":"|aJC578.R383|bG67 2007","dueDate":"2014-11-13T09:00:00Z","numberOfRenewals":2},{"id":"https://example.com/v2/patrons/checkouts/112","patron":"https://example.com/v2/patrons/1234567","item":"https://example.com/v2/items/2536253","dueDate":"2014-11-13T09:00:00Z","numberOfRenewals":3}]}`)
+		case "/patrons/1234567/holds":
+			fmt.Fprintln(w, `{"total":1,"entries":[{"id":"https://example.com/v2/patrons/holds/222","record":"https://example.com/v2/bibs/2536252","recordType":"b","placed":"2014-11-01","priority":3,"pickupLocation":{"code":"mu","name":"Music Library"},"status":{"code":"0","name":"on hold."}}]}`)
+		case "/patrons/1234567/holds/requests":
+			var hold sierraapi.HoldRequest
+			json.NewDecoder(r.Body).Decode(&hold)
+			if r.Method != "POST" || hold.RecordType != "b" {
+				t.Errorf("Unexpected hold request %v %+v", r.Method, hold)
+			}
+			if hold.PickupLocation != "mu" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, `{"code":108,"specificCode":0,"httpStatus":400,"name":"Invalid parameter","description":"Invalid pickupLocation zz for record id 2536252"}`)
+				return
+			}
+			if hold.RecordNumber == 2536252 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, `{"code":132,"specificCode":2,"httpStatus":500,"name":"XCirc error","description":"XCirc error : Request denied - already on hold for or checked out to you."}`)
+		case "/patrons/holds/222":
+			if r.Method == "DELETE" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			fmt.Fprintln(w, `{"id":"https://example.com/v2/patrons/holds/222","patron":"https://example.com/v2/patrons/1234567"}`)
+		case "/patrons/holds/333":
+			if r.Method == "DELETE" {
+				t.Error("Another patron's hold should never be cancelled.")
+			}
+			fmt.Fprintln(w, `{"id":"https://example.com/v2/patrons/holds/333","patron":"https://example.com/v2/patrons/7654321"}`)
+		case "/patrons/checkouts/111/renewal":
+			fmt.Fprintln(w, `{"id":"https://example.com/v2/patrons/checkouts/111","item":"https://example.com/v2/items/2536252","dueDate":"2014-12-13T09:00:00Z","numberOfRenewals":3}`)
+		case "/patrons/checkouts/112/renewal":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, `{"code":132,"specificCode":2,"httpStatus":500,"name":"XCirc error","description":"XCirc error : Too many renewals"}`)
+		case "/patrons/1234567/fines":
+			w.WriteHeader(http.StatusNotFound)
+		case "/items":
+			fmt.Fprintln(w, `{"total":1,"entries":[{"id":"2536252","bibIds":["2536252"]}]}`)
+		case "/bibs":
+			fmt.Fprintln(w, `{"total":1,"entries":[{"id":2536252,"title":"Test Title"}]}`)
+		default:
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestPatronValidateHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	ts2 := newPatronTestServer(t)
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldSessionSigner := sessionSigner
+	sessionSigner = session.NewSigner("secret", time.Hour)
+	defer func() { sessionSigner = oldSessionSigner }()
+
+	req, err := http.NewRequest("POST", "/patron/validate", strings.NewReader(`{"barcode":"12345","pin":"1234"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	patronValidateHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Patron validate handler didn't return %v for a good barcode and PIN, got %v", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		Token string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if patronID, err := sessionSigner.Verify(response.Token); err != nil || patronID != 1234567 {
+		t.Error("Patron validate handler didn't return a session token for the patron.")
+	}
+
+	//A session token is accepted by getPatronOrError.
+	req, err = http.NewRequest("GET", "/patron/checkouts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+response.Token)
+	w = httptest.NewRecorder()
+	if patronID, err := getPatronOrError(w, req); err != nil || patronID != 1234567 {
+		t.Error("getPatronOrError should accept the session token.")
+	}
+
+	//A bad PIN, sent as a form.
+	req, err = http.NewRequest("POST", "/patron/validate", strings.NewReader("barcode=12345&pin=0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w = httptest.NewRecorder()
+	patronValidateHandler(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Patron validate handler didn't return %v for a bad PIN, got %v", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestPatronValidateHandlerBadRequests(t *testing.T) {
+
+	req, err := http.NewRequest("GET", "/patron/validate?barcode=12345&pin=1234", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	patronValidateHandler(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Patron validate handler didn't return %v for a GET", http.StatusMethodNotAllowed)
+	}
+
+	req, err = http.NewRequest("POST", "/patron/validate", strings.NewReader("barcode=12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w = httptest.NewRecorder()
+	patronValidateHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Patron validate handler didn't return %v without a PIN", http.StatusBadRequest)
+	}
+}
+
+func TestGetPatronOrErrorNoSession(t *testing.T) {
+
+	oldSessionSigner := sessionSigner
+	sessionSigner = session.NewSigner("secret", time.Hour)
+	defer func() { sessionSigner = oldSessionSigner }()
+
+	for _, authorization := range []string{"", "Basic abc", "Bearer nonsense"} {
+		req, err := http.NewRequest("GET", "/patron/checkouts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authorization)
+
+		w := httptest.NewRecorder()
+		if _, err := getPatronOrError(w, req); err == nil {
+			t.Errorf("getPatronOrError should fail with Authorization %q", authorization)
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("getPatronOrError should return %v", http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRawHandlerTestRewrite(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	req, err := http.NewRequest("GET", "/raw/?bibIds=1234", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldAPIURL := *apiURL
+	*apiURL = "http://apiurl.com/test/"
+	defer func() { *apiURL = oldAPIURL }()
+
+	rawRewriter(req)
+
+	if req.URL.String() != "http://apiurl.com/test?bibIds=1234" {
+		t.Error("The raw handler is not correctly rewriting the url")
+	}
+
+}
+
+func TestOverrideUnsetFlagsFromEnvVars(t *testing.T) {
+
+	oldAddress := os.Getenv(EnvPrefix + "ADDRESS")
+	defer os.Setenv(EnvPrefix+"ADDRESS", oldAddress)
+	newAddress := ":7654"
+	os.Setenv(EnvPrefix+"ADDRESS", newAddress)
+
+	overrideUnsetFlagsFromEnvironmentVariables()
+
+	if *address != ":7654" {
+		t.Error("Didn't override unset flags.")
+	}
+
+}
+
+func TestParseURLandJoinToPath(t *testing.T) {
+
+	goodURL := "http://test.com"
+	endpoint := "test"
+	badURL := ":"
+
+	parsedURL, err := parseURLandJoinToPath(goodURL, endpoint)
+	if err != nil {
+		t.Error("The parse should not have failed.")
+	}
+	if parsedURL.String() != "http://test.com/test" {
+		t.Error("Bad join")
+	}
+
+	_, err = parseURLandJoinToPath(badURL, endpoint)
+	if err == nil {
+		t.Error("Parse should have failed")
+	}
+
+}
+
+func TestGetTokenOrErrorFailTokenStoreInitialized(t *testing.T) {
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(":", "", "")
+	defer close(tokenStore.Refresh)
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	<-tokenStore.Initialized
+
+	if _, err := getTokenOrError(w, r); err == nil {
+		t.Error("Should have failed with unparseable URL.")
+	}
+
+	if w.Code != http.StatusInternalServerError {
+		t.Error("Should have returned a InternalServerError")
+	}
+
+}
+
+func TestGetTokenOrErrorFailTokenStoreUninitialized(t *testing.T) {
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(":", "", "")
+	defer close(tokenStore.Refresh)
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	if _, err := getTokenOrError(w, r); err == nil {
+		t.Error("Should have failed with unparseable URL.")
+	}
+
+	if w.Code != http.StatusInternalServerError {
+		t.Error("Should have returned a InternalServerError")
+	}
+
+}
+
+func TestGetTokenOrErrorFailTokenStoreTimeout(t *testing.T) {
+
+	tokenStore = tokenstore.NewTokenStore()
+
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+
+	time.Sleep(time.Second * 31)
+
+	if _, err := getTokenOrError(w, r); err == nil {
+		t.Error("Should have failed with unparseable URL.")
+	}
+
+	if w.Code != http.StatusInternalServerError {
+		t.Error("Should have returned a InternalServerError")
+	}
+
+}
+
+//The default case. Don't set the header at all.
+func TestSetACAOHeaderNoConfig(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	setACAOHeader(w, r, "")
+	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Access-Control-Allow-Origin shouldn't be set.")
+	}
+}
+
+//Set the header to *.
+func TestSetACAOHeaderAllOrigins(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	setACAOHeader(w, r, "*")
+	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("Access-Control-Allow-Origin not set properly.")
+	}
+}
+
+//Set the ACAO config to a single origin which doesn't match.
+func TestSetACAOHeaderNotMatchOnSingle(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	setACAOHeader(w, r, "http://test.com")
+	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Access-Control-Allow-Origin shouldn't be set.")
+	}
+}
+
+//Set the ACAO config to a single origin which does match.
+func TestSetACAOHeaderMatchOnSingle(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Origin", "http://test.com")
+	w := httptest.NewRecorder()
+	setACAOHeader(w, r, "http://test.com")
+	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "http://test.com" {
+		t.Error("Access-Control-Allow-Origin not set properly.")
+	}
+}
+
+//Set the ACAO config to a one of a list of origins, none of which match.
+func TestSetACAOHeaderNoMatchOnList(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Origin", "http://test3.com")
+	w := httptest.NewRecorder()
+	setACAOHeader(w, r, "http://test.com;http://test2.com;")
+	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Access-Control-Allow-Origin shouldn't be set.")
+	}
+}
+
+//Set the ACAO config to a one of a list of origins, one of which does match.
+func TestSetACAOHeaderMatchOnList(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Origin", "http://test2.com")
+	w := httptest.NewRecorder()
+	setACAOHeader(w, r, "http://test.com;http://test2.com;")
+	if w.HeaderMap.Get("Access-Control-Allow-Origin") != "http://test2.com" {
+		t.Error("Access-Control-Allow-Origin not set properly.")
+	}
+}
+
+func TestPatronRecordHandlers(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+	<-tokenStore.Initialized
+
+	ts2 := newPatronTestServer(t)
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldSessionSigner := sessionSigner
+	sessionSigner = session.NewSigner("secret", time.Hour)
+	defer func() { sessionSigner = oldSessionSigner }()
+
+	oldMaxRenewals := *maxRenewals
+	*maxRenewals = 2
+	defer func() { *maxRenewals = oldMaxRenewals }()
+
+	sessionToken, _ := sessionSigner.Sign(1234567)
+
+	get := func(handler http.HandlerFunc, path string, v interface{}) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v handler returned %v, expected %v", path, w.Code, http.StatusOK)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var checkouts sierraapi.CheckoutsOut
+	get(patronCheckoutsHandler, "/patron/checkouts", &checkouts)
+	if len(checkouts.Entries) != 2 {
+		t.Fatalf("Expected two checkouts, got %v", len(checkouts.Entries))
+	}
+	checkout := checkouts.Entries[0]
+	if checkout.CheckoutID != 111 || checkout.ItemID != 2536252 || checkout.Title != "Test Title" ||
+		checkout.CallNumber != "JC578.R383 G67 2007" || checkout.Due != "Due November 13, 2014" || checkout.Renewable == nil || *checkout.Renewable {
+		t.Errorf("Unexpected checkout %+v", checkout)
+	}
+
+	//With the default -maxrenewals, Renewable isn't known, so it's left out.
+	*maxRenewals = 0
+	var unlimited struct {
+		Entries []map[string]interface{}
+	}
+	get(patronCheckoutsHandler, "/patron/checkouts", &unlimited)
+	for _, entry := range unlimited.Entries {
+		if _, ok := entry["Renewable"]; ok {
+			t.Errorf("Renewable should be left out with no renewal limit, %v", entry)
+		}
+	}
+	*maxRenewals = 2
+
+	var holds sierraapi.HoldsOut
+	get(patronHoldsHandler, "/patron/holds", &holds)
+	if len(holds.Entries) != 1 {
+		t.Fatalf("Expected one hold, got %v", len(holds.Entries))
+	}
+	hold := holds.Entries[0]
+	if hold.HoldID != 222 || hold.RecordID != 2536252 || hold.Title != "Test Title" ||
+		hold.PickupLocation != "Music Library" || hold.QueuePosition != 3 {
+		t.Errorf("Unexpected hold %+v", hold)
+	}
+
+	var fines sierraapi.FinesOut
+	get(patronFinesHandler, "/patron/fines", &fines)
+	if len(fines.Entries) != 0 || fines.TotalOwed != 0 {
+		t.Errorf("Expected no fines, got %+v", fines)
+	}
+
+	//Without a session, no records are returned.
+	req, err := http.NewRequest("GET", "/patron/checkouts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	patronCheckoutsHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Patron checkouts handler returned %v without a session, expected %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPatronHoldRequests(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+	<-tokenStore.Initialized
+
+	ts2 := newPatronTestServer(t)
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldSessionSigner := sessionSigner
+	sessionSigner = session.NewSigner("secret", time.Hour)
+	defer func() { sessionSigner = oldSessionSigner }()
+
+	sessionToken, _ := sessionSigner.Sign(1234567)
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		path    string
+		body    string
+		code    int
+	}{
+		{patronHoldsHandler, "POST", "/patron/holds", `{"recordType":"b","recordNumber":2536252,"pickupLocation":"mu"}`, http.StatusCreated},
+		{patronHoldsHandler, "POST", "/patron/holds", `{"recordType":"b","recordNumber":2536253,"pickupLocation":"mu"}`, http.StatusConflict},
+		{patronHoldsHandler, "POST", "/patron/holds", `{"recordType":"x","recordNumber":2536252,"pickupLocation":"mu"}`, http.StatusBadRequest},
+		{patronHoldsHandler, "POST", "/patron/holds", `{"recordType":"b","recordNumber":2536252}`, http.StatusBadRequest},
+		{patronHoldsHandler, "POST", "/patron/holds", `{"recordType":`, http.StatusBadRequest},
+		{patronHoldHandler, "DELETE", "/patron/holds/222", "", http.StatusNoContent},
+		{patronHoldHandler, "DELETE", "/patron/holds/333", "", http.StatusNotFound},
+		{patronHoldHandler, "DELETE", "/patron/holds/", "", http.StatusBadRequest},
+		{patronHoldHandler, "GET", "/patron/holds/222", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+
+		w := httptest.NewRecorder()
+		test.handler(w, req)
+
+		if w.Code != test.code {
+			t.Errorf("%v %v %v returned %v, expected %v", test.method, test.path, test.body, w.Code, test.code)
+		}
+	}
+
+	//Only circulation refusals are passed on to patrons, other errors get a general message.
+	req, err := http.NewRequest("POST", "/patron/holds", strings.NewReader(`{"recordType":"b","recordNumber":2536252,"pickupLocation":"zz"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+sessionToken)
+	w := httptest.NewRecorder()
+	patronHoldsHandler(w, req)
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "Invalid pickupLocation") {
+		t.Errorf("Unexpected response to a rejected hold %v %v", w.Code, w.Body.String())
+	}
+
+	//A form works too.
+	req, err = http.NewRequest("POST", "/patron/holds", strings.NewReader("recordType=b&recordNumber=2536252&pickupLocation=mu"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+sessionToken)
+	w = httptest.NewRecorder()
+	patronHoldsHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("Placing a hold with a form returned %v, expected %v", w.Code, http.StatusCreated)
+	}
+}
+
+func TestPatronRenewHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+	<-tokenStore.Initialized
+
+	ts2 := newPatronTestServer(t)
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldSessionSigner := sessionSigner
+	sessionSigner = session.NewSigner("secret", time.Hour)
+	defer func() { sessionSigner = oldSessionSigner }()
+
+	sessionToken, _ := sessionSigner.Sign(1234567)
+
+	renew := func(contentType, body string) (int, sierraapi.RenewalsOut) {
+		req, err := http.NewRequest("POST", "/patron/checkouts/renew", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+		w := httptest.NewRecorder()
+		patronRenewHandler(w, req)
+		var out sierraapi.RenewalsOut
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, out
+	}
+
+	code, out := renew("application/json", `{"checkoutIds":[111,112,999]}`)
+	if code != http.StatusOK || len(out.Entries) != 3 {
+		t.Fatalf("Expected three renewal results, got %v %+v", code, out)
+	}
+	if !out.Entries[0].Renewed || out.Entries[0].Due != "Due December 13, 2014" || out.Entries[0].Title != "Test Title" {
+		t.Errorf("Checkout 111 should have been renewed, got %+v", out.Entries[0])
+	}
+	if out.Entries[1].Renewed || out.Entries[1].Message != "XCirc error : Too many renewals" || out.Entries[1].Due != "Due November 13, 2014" {
+		t.Errorf("Checkout 112 should have been refused, got %+v", out.Entries[1])
+	}
+	if out.Entries[2].Renewed || out.Entries[2].ItemID != 0 {
+		t.Errorf("Checkout 999 isn't the patron's, got %+v", out.Entries[2])
+	}
+
+	code, out = renew("application/x-www-form-urlencoded", "all=true")
+	if code != http.StatusOK || len(out.Entries) != 2 {
+		t.Errorf("Expected two renewal results, got %v %+v", code, out)
+	}
+
+	code, out = renew("application/x-www-form-urlencoded", "checkoutIds=111")
+	if code != http.StatusOK || len(out.Entries) != 1 || !out.Entries[0].Renewed {
+		t.Errorf("Expected checkout 111 to be renewed, got %v %+v", code, out)
+	}
+
+	if code, _ = renew("application/json", `{}`); code != http.StatusBadRequest {
+		t.Errorf("Expected %v without any checkouts, got %v", http.StatusBadRequest, code)
+	}
+	if code, _ = renew("application/x-www-form-urlencoded", "checkoutIds=abc"); code != http.StatusBadRequest {
+		t.Errorf("Expected %v with a bad checkoutId, got %v", http.StatusBadRequest, code)
+	}
+
+	//If the token expires partway through, the renewals already done are still reported.
+	ts3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/patrons/checkouts/112/renewal" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ts2.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts3.Close()
+	*apiURL = ts3.URL
+
+	code, out = renew("application/json", `{"checkoutIds":[111,112]}`)
+	if code != http.StatusOK || len(out.Entries) != 2 {
+		t.Fatalf("Expected two renewal results after the token expired, got %v %+v", code, out)
+	}
+	if !out.Entries[0].Renewed || out.Entries[1].Renewed || out.Entries[1].Message != "Unable to renew, please try again later." {
+		t.Errorf("Unexpected renewal results after the token expired %+v", out)
+	}
+}
+
+func TestBrowseHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+	<-tokenStore.Initialized
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/items" && r.URL.Query().Get("bibIds") == "3":
+			fmt.Fprintln(w, `{"entries":[{"id":"31","callNumber":"|aJC578.R383|bG67 2007 c.2"},{"id":"30","callNumber":"|aJC578.R383|bG67 2007"}]}`)
+		case r.URL.Path == "/items" && r.URL.Query().Get("bibIds") == "9":
+			fmt.Fprintln(w, `{"entries":[{"id":"90","callNumber":""}]}`)
+		case r.URL.Path == "/items" && r.URL.Query().Get("deleted") == "true":
+			if r.URL.Query().Get("deletedDate") != "[2014-10-16,]" {
+				t.Errorf("Unexpected deleted items request %v", r.URL.RawQuery)
+			}
+			fmt.Fprintln(w, `{"entries":[{"id":"10","deleted":true}]}`)
+		case r.URL.Path == "/items" && r.URL.Query().Get("updatedDate") != "":
+			if r.URL.Query().Get("suppressed") != "" {
+				t.Errorf("Changed items should include suppressed ones, %v", r.URL.RawQuery)
+			}
+			fmt.Fprintln(w, `{"entries":[
+				{"id":"40","bibIds":["4"],"callNumber":"|aPR6068.O93|bH372 1999","suppressed":true},
+				{"id":"20","bibIds":["2"],"callNumber":""}]}`)
+		case r.URL.Path == "/items" && r.URL.Query().Get("offset") == "0":
+			if r.URL.Query().Get("fields") != "id,bibIds,callNumber,suppressed" || r.URL.Query().Get("suppressed") != "false" {
+				t.Errorf("Unexpected harvest request %v", r.URL.RawQuery)
+			}
+			fmt.Fprintln(w, `{"entries":[
+				{"id":"10","bibIds":["1"],"callNumber":"|aJC100.A1"},
+				{"id":"20","bibIds":["2"],"callNumber":"|aJC578.A1"},
+				{"id":"30","bibIds":["3"],"callNumber":"|aJC578.R383|bG67 2007"},
+				{"id":"31","bibIds":["3"],"callNumber":"|aJC578.R383|bG67 2007 c.2"},
+				{"id":"40","bibIds":["4"],"callNumber":"|aPR6068.O93|bH372 1999"},
+				{"id":"50","bibIds":["5"],"callNumber":""}]}`)
+		case r.URL.Path == "/bibs":
+			fmt.Fprintln(w, `{"entries":[
+				{"id":2,"title":"Second Title","author":"Second Author","marc":{"fields":[{"tag":"020","data":{"subfields":[{"code":"a","data":"9780000000002 (pbk.)"}]}}]}},
+				{"id":4,"title":"Fourth Title","author":"Fourth Author"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldShelfIndex := shelfIndex
+	shelfIndex = shelf.NewIndex()
+	defer func() { shelfIndex = oldShelfIndex }()
+
+	browse := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		browseHandler(w, req)
+		return w
+	}
+
+	if w := browse("/browse/3"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Browse handler returned %v before the first harvest, expected %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	entries, removed, err := harvestShelf(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 || len(removed) != 1 {
+		t.Errorf("Expected 5 items with call numbers from the harvest, got %v, and 1 without, got %v", len(entries), removed)
+	}
+	shelfIndex.Replace(entries)
+
+	w := browse("/browse/3?n=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Browse handler returned %v, expected %v", w.Code, http.StatusOK)
+	}
+	var response struct {
+		BibID      int
+		CallNumber string
+		Before     []shelf.Entry
+		After      []shelf.Entry
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.CallNumber != "JC578.R383 G67 2007" || len(response.Before) != 1 || len(response.After) != 1 {
+		t.Fatalf("Unexpected browse response %+v", response)
+	}
+	before := response.Before[0]
+	if before.BibID != 2 || before.Title != "Second Title" || before.Author != "Second Author" || before.ISBN != "9780000000002" || before.CallNumber != "JC578.A1" {
+		t.Errorf("Unexpected record before %+v", before)
+	}
+	if response.After[0].BibID != 4 {
+		t.Errorf("Unexpected record after %+v", response.After[0])
+	}
+
+	//Items suppressed, deleted or without a call number since the last harvest leave the shelf.
+	entries, removed, err = harvestShelf(time.Date(2014, 10, 16, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 || !reflect.DeepEqual(removed, []int{40, 20, 10}) {
+		t.Errorf("Unexpected changes %+v %v", entries, removed)
+	}
+	shelfIndex.Update(entries, removed)
+	if shelfIndex.Len() != 1 {
+		t.Errorf("Only bib 3 should be left on the shelf, found %v bibs", shelfIndex.Len())
+	}
+
+	tests := map[string]int{
+		"/browse/":        http.StatusBadRequest,
+		"/browse/abc":     http.StatusBadRequest,
+		"/browse/3?n=0":   http.StatusBadRequest,
+		"/browse/3?n=100": http.StatusBadRequest,
+		"/browse/9":       http.StatusNotFound,
+		"/browse/404":     http.StatusNotFound,
+	}
+	for path, code := range tests {
+		if w := browse(path); w.Code != code {
+			t.Errorf("Browse handler returned %v for %v, expected %v", w.Code, path, code)
+		}
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	var queries []string
+	var lock sync.Mutex
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bibs/query", "/items/query":
+			if r.Method != "POST" {
+				t.Errorf("Expected a POST to %v, got %v", r.URL.Path, r.Method)
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			lock.Lock()
+			queries = append(queries, string(body))
+			lock.Unlock()
+			switch {
+			case strings.Contains(string(body), `"9780521875646"`):
+				//Sierra's "has" matches 2401598 too, which has the ISBN in a note.
+				fmt.Fprintln(w, `{"total":2,"entries":[{"link":"https://sierra/v1/bibs/2401597"},{"link":"https://sierra/v1/bibs/2401598"}]}`)
+			case strings.Contains(string(body), `{"tag":"i"}},"expr":{"op":"has","operands":["9780306406157"]}`):
+				//Only the standard number index finds a hyphenated 020.
+				fmt.Fprintln(w, `{"total":1,"entries":[{"link":"https://sierra/v1/bibs/2401600"}]}`)
+			case strings.Contains(string(body), `"777"`):
+				//A full page of bibs which only contain the number, then the bib which has it.
+				var links []string
+				start, end := 3000000, 3000000+MaxLookupResults
+				if r.URL.Query().Get("offset") != "0" {
+					start, end = end, end+1
+				}
+				for id := start; id < end; id++ {
+					links = append(links, fmt.Sprintf(`{"link":"https://sierra/v1/bibs/%v"}`, id))
+				}
+				fmt.Fprintf(w, `{"total":%v,"entries":[%v]}`, len(links), strings.Join(links, ","))
+			case strings.Contains(string(body), `"39000000123456"`):
+				fmt.Fprintln(w, `{"total":1,"entries":[{"link":"https://sierra/v1/items/111"}]}`)
+			default:
+				fmt.Fprintln(w, `{"total":0,"entries":[]}`)
+			}
+		case "/bibs":
+			if strings.HasPrefix(r.URL.Query().Get("id"), "3000") {
+				var entries []string
+				for _, id := range strings.Split(r.URL.Query().Get("id"), ",") {
+					oclc := "ocm7770"
+					if id == fmt.Sprint(3000000+MaxLookupResults) {
+						oclc = "ocm777"
+					}
+					entries = append(entries, fmt.Sprintf(`{"id":%v,"marc":{"fields":[{"tag":"001","data":"%v"}]}}`, id, oclc))
+				}
+				fmt.Fprintf(w, `{"entries":[%v]}`, strings.Join(entries, ","))
+				return
+			}
+			if r.URL.Query().Get("id") == "2401600" {
+				fmt.Fprintln(w, `{"entries":[{"id":2401600,"marc":{"fields":[
+					{"tag":"020","data":{"subfields":[{"code":"a","data":"978-0-306-40615-7 (pbk.)"}]}}]}}]}`)
+				return
+			}
+			fmt.Fprintln(w, `{"entries":[
+				{"id":2401597,"marc":{"fields":[
+					{"tag":"020","data":{"subfields":[{"code":"a","data":"0521875641 (hbk.)"}]}},
+					{"tag":"245","data":{"subfields":[{"code":"a","data":"A Title"}]}}]}},
+				{"id":2401598,"marc":{"fields":[
+					{"tag":"020","data":{"subfields":[{"code":"z","data":"9780521875646"}]}}]}}]}`)
+		case "/items":
+			if r.URL.Query().Get("id") == "111" {
+				fmt.Fprintln(w, `{"entries":[{"id":111,"bibIds":[2401597]}]}`)
+				return
+			}
+			fmt.Fprintln(w, `{"entries":[{"id":111,"bibIds":[2401597],"status":{"code":"-"},"location":{"code":"flr4","name":"Floor 4 Books"}}]}`)
+		default:
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	oldLookupCache := lookupCache
+	lookupCache = responsecache.NewCache(time.Minute, time.Minute)
+	defer func() { lookupCache = oldLookupCache }()
+
+	get := func(path string) (*httptest.ResponseRecorder, LookupOut) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		lookupHandler(w, req)
+		var response LookupOut
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, response
+	}
+
+	//The ISBN-10 is looked up in both forms, and the bib with it only in a $z is left out.
+	w, response := get("/lookup/isbn/0-521-87564-1?include=bib,status")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Lookup handler returned %v", w.Code)
+	}
+	if response.Type != "isbn" || response.Value != "9780521875646" || len(response.BibIDs) != 1 || response.BibIDs[0] != 2401597 {
+		t.Errorf("Unexpected lookup %+v", response)
+	}
+	if len(response.Bibs) != 1 || response.Bibs[0].Title != "A Title" {
+		t.Errorf("Unexpected bibs %+v", response.Bibs)
+	}
+	if items, ok := response.Status["2401597"]; !ok || len(items.Entries) != 1 || items.Entries[0].Location != "Floor 4 Books" {
+		t.Errorf("Unexpected status %+v", response.Status)
+	}
+	if len(queries) != 1 || !strings.Contains(queries[0], `"queries":[`) || !strings.Contains(queries[0], `"0521875641"`) || !strings.Contains(queries[0], `"marcTag":"020"`) {
+		t.Errorf("Unexpected query %v", queries)
+	}
+
+	//A hyphenated 020 is found through the standard number index.
+	w, response = get("/lookup/isbn/0306406152")
+	if w.Code != http.StatusOK || len(response.BibIDs) != 1 || response.BibIDs[0] != 2401600 {
+		t.Errorf("Unexpected lookup of a hyphenated ISBN %v %+v", w.Code, response)
+	}
+
+	//The match is found past the first page of candidates.
+	w, response = get("/lookup/oclc/777")
+	if w.Code != http.StatusOK || len(response.BibIDs) != 1 || response.BibIDs[0] != 3000000+MaxLookupResults {
+		t.Errorf("Unexpected lookup past the first page of candidates %v %+v", w.Code, response)
+	}
+
+	w, response = get("/lookup/barcode/39000000123456")
+	if w.Code != http.StatusOK || len(response.BibIDs) != 1 || response.BibIDs[0] != 2401597 || response.Bibs != nil || response.Status != nil {
+		t.Errorf("Unexpected barcode lookup %v %+v", w.Code, response)
+	}
+
+	for path, code := range map[string]int{
+		"/lookup/isbn/0521875642": http.StatusBadRequest,
+		"/lookup/issn/12345":      http.StatusBadRequest,
+		"/lookup/issn/1234-5678":  http.StatusBadRequest,
+		"/lookup/oclc/12345678":   http.StatusNotFound,
+		"/lookup/lccn/12345678":   http.StatusNotFound,
+		"/lookup/isbn":            http.StatusBadRequest,
+		"/lookup/":                http.StatusBadRequest,
+	} {
+		if w, _ := get(path); w.Code != code {
+			t.Errorf("Lookup handler returned %v for %v, expected %v", w.Code, path, code)
+		}
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bibs/search" {
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if q.Get("offset") == "100" {
+			http.NotFound(w, r)
+			return
+		}
+		if q.Get("text") != "dangerous nation" || q.Get("index") != "title" || q.Get("offset") != "10" || q.Get("limit") != "10" {
+			t.Errorf("Unexpected search %v", r.URL.RawQuery)
+		}
+		fmt.Fprintln(w, `{"count":1,"total":25,"start":10,"entries":[{"relevance":1,"bib":{"id":2401597}}]}`)
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	get := func(path string) (*httptest.ResponseRecorder, sierraapi.SearchResultsOut) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		searchHandler(w, req)
+		var response sierraapi.SearchResultsOut
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, response
+	}
+
+	w, response := get("/search?q=dangerous+nation&field=title&offset=10&limit=10")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Search handler returned %v", w.Code)
+	}
+	if response.Total != 25 || response.Next == nil || *response.Next != 20 || response.Previous == nil || *response.Previous != 0 || len(response.Entries) != 1 {
+		t.Errorf("Unexpected results %+v", response)
+	}
+
+	//Past the end of the results, the page is empty.
+	w, response = get("/search?q=dangerous+nation&offset=100")
+	if w.Code != http.StatusOK || len(response.Entries) != 0 || response.Next != nil || response.Previous == nil {
+		t.Errorf("Unexpected results past the end %v %+v", w.Code, response)
+	}
+
+	for _, path := range []string{"/search", "/search?q=a&field=isbn", "/search?q=a&offset=-1", "/search?q=a&limit=0"} {
+		if w, _ := get(path); w.Code != http.StatusBadRequest {
+			t.Errorf("Search handler returned %v for %v, expected %v", w.Code, path, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestQueryHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items/query":
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method != "POST" || string(body) != `{"target":{"record":{"type":"item"},"id":88},"expr":{"op":"equals","operands":["m"]}}` {
+				t.Errorf("Unexpected query %v %v", r.Method, string(body))
+			}
+			//One more than the limit is asked for, to find if there's a next page.
+			if r.URL.Query().Get("limit") != "3" {
+				t.Errorf("Unexpected paging %v", r.URL.RawQuery)
+			}
+			switch r.URL.Query().Get("offset") {
+			case "0":
+				fmt.Fprintln(w, `{"total":3,"entries":[{"link":"https://sierra/v1/items/111"},{"link":"https://sierra/v1/items/222"},{"link":"https://sierra/v1/items/333"}]}`)
+			case "2":
+				fmt.Fprintln(w, `{"total":2,"entries":[{"link":"https://sierra/v1/items/111"},{"link":"https://sierra/v1/items/222"}]}`)
+			default:
+				t.Errorf("Unexpected paging %v", r.URL.RawQuery)
+			}
+		case "/items":
+			if r.URL.Query().Get("id") != "111,222" {
+				t.Errorf("Unexpected items request %v", r.URL.RawQuery)
+			}
+			fmt.Fprintln(w, `{"entries":[{"id":"111","bibIds":["5"],"callNumber":"QA76","status":{"code":"m","display":"MISSING"},"location":{"code":"flr4","name":"Fourth Floor"}},{"id":"222","bibIds":["6"],"status":{"code":"m"}}]}`)
+		case "/bibs/query":
+			http.NotFound(w, r)
+		default:
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	parsed, err := sierraapi.ParseQuery("item.status = m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedQueries = map[string]sierraapi.SavedQuery{
+		"missing": {Description: "Missing items", Query: "item.status = m", Parsed: parsed},
+	}
+	defer func() { savedQueries = map[string]sierraapi.SavedQuery{} }()
+
+	queryCache = responsecache.NewCache(0, 0)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, req)
+		return w
+	}
+
+	w := get("/query")
+	var list []SavedQueryOut
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []SavedQueryOut{{Name: "missing", Description: "Missing items", Query: "item.status = m", Record: "item"}}) {
+		t.Errorf("Unexpected list of saved queries %+v", list)
+	}
+
+	type queryResponse struct {
+		sierraapi.QueryResultsOut
+		Entries []sierraapi.QueryItemOut
+	}
+
+	//A full page with more records past it links to the next page.
+	w = get("/query/missing?offset=0&limit=2")
+	var first queryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &first); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || first.Next == nil || *first.Next != 2 || first.Previous != nil || len(first.Entries) != 2 || strings.Contains(w.Body.String(), "Total") {
+		t.Errorf("Unexpected first page %v %v", w.Code, w.Body.String())
+	}
+
+	//A full last page doesn't link to an empty one.
+	w = get("/query/missing?offset=2&limit=2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Query handler returned %v", w.Code)
+	}
+	var response queryResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Name != "missing" || response.Record != "item" || response.Next != nil || response.Previous == nil || *response.Previous != 0 || len(response.Entries) != 2 {
+		t.Errorf("Unexpected results %v", w.Body.String())
+	}
+	if item := response.Entries[0]; item.ItemID != 111 || !reflect.DeepEqual(item.BibIDs, []int{5}) || item.LocationCode != "flr4" {
+		t.Errorf("Unexpected item %+v", item)
+	}
+
+	if w := get("/query/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("Query handler returned %v for an unknown saved query", w.Code)
+	}
+	if w := get("/query?q=bib.lang+%3D+eng"); w.Code != http.StatusForbidden {
+		t.Errorf("Query handler returned %v for an ad hoc query, expected %v", w.Code, http.StatusForbidden)
+	}
+
+	*adhocQueries = true
+	defer func() { *adhocQueries = false }()
+
+	w = get("/query?q=bib.lang+%3D+eng")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Record":"bib"`) || !strings.Contains(w.Body.String(), `"Entries":[]`) {
+		t.Errorf("Unexpected ad hoc query results %v %v", w.Code, w.Body.String())
+	}
+	for _, path := range []string{"/query?q=bib.lang", "/query/missing?limit=0", "/query/missing?offset=x"} {
+		if w := get(path); w.Code != http.StatusBadRequest {
+			t.Errorf("Query handler returned %v for %v, expected %v", w.Code, path, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestReportsHandler(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "tyroreports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items/query":
+			if r.URL.Query().Get("offset") != "0" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintln(w, `{"total":1,"entries":[{"link":"https://sierra/v1/items/111"}]}`)
+		case "/items":
+			fmt.Fprintln(w, `{"entries":[{"id":"111","bibIds":["5"],"callNumber":"QA76","status":{"code":"-","duedate":"2014-09-01T04:00:00Z"},"location":{"code":"flr4","name":"Fourth Floor"}}]}`)
+		case "/bibs":
+			fmt.Fprintln(w, `{"entries":[{"id":5,"title":"Dangerous nation"}]}`)
+		default:
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	parsed, err := sierraapi.ParseQuery("item.status = -")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := reports.Report{Every: "24h", Interval: 24 * time.Hour}
+	report.Description = "Long overdues"
+	report.Query = "item.status = -"
+	report.Parsed = parsed
+
+	savedReports = map[string]reports.Report{"overdue": report}
+	defer func() { savedReports = map[string]reports.Report{} }()
+	reportStore = reports.NewStore(dir, 2)
+
+	oldReportToken, oldHeaderACAO := *reportToken, *headerACAO
+	*reportToken, *headerACAO = "staffonly", "*"
+	defer func() { *reportToken, *headerACAO = oldReportToken, oldHeaderACAO }()
+
+	getWithToken := func(path, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		reportsHandler(w, req)
+		return w
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		return getWithToken(path, "staffonly")
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := getWithToken("/reports", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("Reports handler returned %v with token %q, expected %v", w.Code, token, http.StatusUnauthorized)
+		}
+	}
+	if w := getWithToken("/reports?token=staffonly", ""); w.Code != http.StatusOK {
+		t.Errorf("Reports handler returned %v with the token in the query string, expected %v", w.Code, http.StatusOK)
+	}
+
+	if w := get("/reports/overdue"); w.Code != http.StatusNotFound {
+		t.Errorf("Reports handler returned %v before the first run, expected %v", w.Code, http.StatusNotFound)
+	}
+
+	table, err := runReport(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Truncated {
+		t.Error("A report which found one record shouldn't be truncated.")
+	}
+	started := time.Date(2014, 10, 16, 12, 0, 0, 0, time.UTC)
+	if _, err := reportStore.Save("overdue", report, started, table); err != nil {
+		t.Fatal(err)
+	}
+
+	w := get("/reports/overdue.csv")
+	expected := "ItemID,BibID,Title,CallNumber,Location,LocationCode,Status,DueDate\n111,5,Dangerous nation,QA76,Fourth Floor,flr4,"
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != reports.CSVContentType || !strings.HasPrefix(w.Body.String(), expected) || !strings.HasSuffix(w.Body.String(), ",2014-09-01\n") {
+		t.Errorf("Unexpected CSV %v %v", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("X-Report-Truncated") != "" {
+		t.Errorf("Unexpected headers on the CSV %v", w.Header())
+	}
+
+	for _, path := range []string{"/reports/overdue", "/reports/overdue/20141016T120000Z.json"} {
+		w := get(path)
+		var run reports.Run
+		if err := json.Unmarshal(w.Body.Bytes(), &run); err != nil {
+			t.Fatal(err)
+		}
+		if run.Name != "overdue" || run.Count != 1 || run.Entries[0]["ItemID"] != "111" {
+			t.Errorf("Unexpected run at %v, %+v", path, run)
+		}
+	}
+
+	//A truncated run is marked in both formats.
+	table.Truncated = true
+	if _, err := reportStore.Save("overdue", report, started.Add(time.Hour), table); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/reports/overdue.csv", "/reports/overdue"} {
+		if w := get(path); w.Code != http.StatusOK || w.Header().Get("X-Report-Truncated") != "true" {
+			t.Errorf("Reports handler returned %v %v for the truncated run at %v", w.Code, w.Header(), path)
+		}
+	}
+
+	w = get("/reports")
+	var list []ReportOut
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "overdue" || list[0].Record != "item" || !reflect.DeepEqual(list[0].Runs, []string{"20141016T130000Z", "20141016T120000Z"}) {
+		t.Errorf("Unexpected list of reports %+v", list)
+	}
+
+	for _, path := range []string{"/reports/unknown", "/reports/overdue.xml", "/reports/overdue/20141016T140000Z", "/reports/overdue/a/b"} {
+		if w := get(path); w.Code != http.StatusNotFound {
+			t.Errorf("Reports handler returned %v for %v, expected %v", w.Code, path, http.StatusNotFound)
+		}
+	}
+}
+
+func TestCoursesHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"access_token":"test","token_type":"bearer","expires_in":3600}`)
+	}))
+	defer ts.Close()
+
+	tokenStore = tokenstore.NewTokenStore()
+	tokenStore.Refresher(ts.URL, "", "")
+	defer close(tokenStore.Refresh)
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			if r.URL.Query().Get("id") != "111,222" {
+				t.Errorf("Unexpected items request %v", r.URL.RawQuery)
+			}
+			fmt.Fprintln(w, `{"entries":[{"id":"111","bibIds":["5"],"callNumber":"QA76","status":{"code":"-"},"location":{"code":"res","name":"Reserves"}}]}`)
+		case "/bibs":
+			fmt.Fprintln(w, `{"entries":[{"id":5,"title":"Dangerous nation"}]}`)
+		default:
+			t.Errorf("Unexpected request to %v", r.URL.Path)
+		}
+	}))
+	defer ts2.Close()
+
+	oldAPIURL := *apiURL
+	*apiURL = ts2.URL
+	defer func() { *apiURL = oldAPIURL }()
+
+	sierraapi.SetCourses(map[string]sierraapi.Course{
+		"hist2100": {Name: "HIST 2100 Canada", Instructors: []string{"Smith, Jane"}, ItemIDs: []int{111, 222}},
+	})
+	defer sierraapi.SetCourses(map[string]sierraapi.Course{})
+
+	coursesCache = responsecache.NewCache(0, 0)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		coursesHandler(w, req)
+		return w
+	}
+
+	w := get("/courses?instructor=jane")
+	var list []sierraapi.CourseOut
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].CourseID != "hist2100" || list[0].Items != nil {
+		t.Errorf("Unexpected list of courses %v", w.Body.String())
+	}
+	if w := get("/courses?instructor=nobody"); w.Body.String() != "[]" {
+		t.Errorf("Unexpected list of courses %v", w.Body.String())
+	}
+
+	w = get("/courses/hist2100")
+	var course sierraapi.CourseOut
+	if err := json.Unmarshal(w.Body.Bytes(), &course); err != nil {
+		t.Fatal(err)
+	}
+	if len(course.Items) != 1 {
+		t.Fatalf("Unexpected course %v", w.Body.String())
+	}
+	if item := course.Items[0]; item.ItemID != 111 || item.Title != "Dangerous nation" || item.Location != "Reserves" || item.Availability != sierraapi.Available {
+		t.Errorf("Unexpected item on reserve %+v", item)
+	}
+
+	if w := get("/courses/math1000"); w.Code != http.StatusNotFound {
+		t.Errorf("Courses handler returned %v for an unknown course, expected %v", w.Code, http.StatusNotFound)
 	}
 }
@@ -0,0 +1,324 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package marc writes the MARC records decoded from Sierra as MARCXML,
+//ISO 2709 binary MARC and MARC-in-JSON, and reads them back again.
+package marc
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"sort"
+	"strconv"
+)
+
+//The content types of each format.
+const (
+	XMLContentType     string = "application/marcxml+xml"
+	ISO2709ContentType string = "application/marc"
+	JSONContentType    string = "application/marc+json"
+)
+
+//The MARCXML namespace.
+const XMLNamespace string = "http://www.loc.gov/MARC21/slim"
+
+//The ISO 2709 delimiters.
+const (
+	subfieldDelimiter byte = 0x1F
+	fieldTerminator   byte = 0x1E
+	recordTerminator  byte = 0x1D
+)
+
+//Leader positions 20-23, the length of each part of a directory entry.
+const entryMap string = "4500"
+
+//The leader used for records with a missing or short leader.
+const defaultLeader string = "00000nam a2200000   4500"
+
+var ErrBadRecord = errors.New("Malformed ISO 2709 record.")
+
+type xmlRecord struct {
+	XMLName       xml.Name          `xml:"http://www.loc.gov/MARC21/slim record"`
+	Leader        string            `xml:"leader"`
+	ControlFields []xmlControlField `xml:"controlfield"`
+	DataFields    []xmlDataField    `xml:"datafield"`
+}
+
+type xmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlDataField struct {
+	Tag       string        `xml:"tag,attr"`
+	Ind1      string        `xml:"ind1,attr"`
+	Ind2      string        `xml:"ind2,attr"`
+	Subfields []xmlSubfield `xml:"subfield"`
+}
+
+type xmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+//XML writes the record as a MARCXML record element.
+//Control fields come before data fields, as the schema requires.
+func XML(m *sierraapi.Marc) ([]byte, error) {
+
+	record := xmlRecord{Leader: m.Leader}
+	for _, field := range m.Fields {
+		if field.IsControl() {
+			record.ControlFields = append(record.ControlFields, xmlControlField{field.Tag, field.Value})
+			continue
+		}
+		data := xmlDataField{Tag: field.Tag, Ind1: indicator(field.Ind1), Ind2: indicator(field.Ind2)}
+		for _, subfield := range field.Subfields {
+			data.Subfields = append(data.Subfields, xmlSubfield{subfield.Code, subfield.Data})
+		}
+		record.DataFields = append(record.DataFields, data)
+	}
+
+	out, err := xml.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+//ParseXML reads a MARCXML record element.
+func ParseXML(b []byte) (*sierraapi.Marc, error) {
+
+	var record xmlRecord
+	if err := xml.Unmarshal(b, &record); err != nil {
+		return nil, err
+	}
+
+	m := &sierraapi.Marc{Leader: record.Leader}
+	for _, control := range record.ControlFields {
+		m.Fields = append(m.Fields, sierraapi.MarcField{Tag: control.Tag, Value: control.Value})
+	}
+	for _, data := range record.DataFields {
+		field := sierraapi.MarcField{Tag: data.Tag, Ind1: data.Ind1, Ind2: data.Ind2}
+		for _, subfield := range data.Subfields {
+			field.Subfields = append(field.Subfields, sierraapi.MarcSubfield{Code: subfield.Code, Data: subfield.Value})
+		}
+		m.Fields = append(m.Fields, field)
+	}
+	return m, nil
+}
+
+//ISO2709 writes the record as binary MARC, encoded as UTF-8.
+//The record length, base address and other structural positions
+//of the leader are filled in, the rest of the leader is kept.
+func ISO2709(m *sierraapi.Marc) ([]byte, error) {
+
+	var directory, data bytes.Buffer
+
+	for _, field := range m.Fields {
+		if len(field.Tag) != 3 {
+			return nil, fmt.Errorf("Field tag %q is not three characters.", field.Tag)
+		}
+
+		start := data.Len()
+		if field.IsControl() {
+			data.WriteString(field.Value)
+		} else {
+			data.WriteString(indicator(field.Ind1))
+			data.WriteString(indicator(field.Ind2))
+			for _, subfield := range field.Subfields {
+				data.WriteByte(subfieldDelimiter)
+				data.WriteString(subfield.Code)
+				data.WriteString(subfield.Data)
+			}
+		}
+		data.WriteByte(fieldTerminator)
+
+		length := data.Len() - start
+		if length > 9999 || start > 99999 {
+			return nil, fmt.Errorf("Field %v is too long for ISO 2709.", field.Tag)
+		}
+		fmt.Fprintf(&directory, "%v%04d%05d", field.Tag, length, start)
+	}
+	directory.WriteByte(fieldTerminator)
+
+	baseAddress := 24 + directory.Len()
+	recordLength := baseAddress + data.Len() + 1
+	if recordLength > 99999 {
+		return nil, errors.New("The record is too long for ISO 2709.")
+	}
+
+	leader := []byte(m.Leader)
+	if len(leader) != 24 {
+		leader = []byte(defaultLeader)
+	}
+	copy(leader[0:5], fmt.Sprintf("%05d", recordLength))
+	//Character coding scheme, Unicode.
+	leader[9] = 'a'
+	//Indicator count and subfield code length.
+	leader[10], leader[11] = '2', '2'
+	copy(leader[12:17], fmt.Sprintf("%05d", baseAddress))
+	copy(leader[20:24], entryMap)
+
+	var out bytes.Buffer
+	out.Write(leader)
+	out.Write(directory.Bytes())
+	out.Write(data.Bytes())
+	out.WriteByte(recordTerminator)
+	return out.Bytes(), nil
+}
+
+//ParseISO2709 reads one binary MARC record.
+func ParseISO2709(b []byte) (*sierraapi.Marc, error) {
+
+	if len(b) < 25 {
+		return nil, ErrBadRecord
+	}
+	recordLength, err := strconv.Atoi(string(b[0:5]))
+	if err != nil || recordLength > len(b) {
+		return nil, ErrBadRecord
+	}
+	baseAddress, err := strconv.Atoi(string(b[12:17]))
+	if err != nil || baseAddress > recordLength || baseAddress < 25 {
+		return nil, ErrBadRecord
+	}
+
+	m := &sierraapi.Marc{Leader: string(b[0:24])}
+	directory := b[24 : baseAddress-1]
+	data := b[baseAddress:recordLength]
+
+	if len(directory)%12 != 0 {
+		return nil, ErrBadRecord
+	}
+
+	for i := 0; i < len(directory); i += 12 {
+		entry := directory[i : i+12]
+		length, err := strconv.Atoi(string(entry[3:7]))
+		if err != nil {
+			return nil, ErrBadRecord
+		}
+		start, err := strconv.Atoi(string(entry[7:12]))
+		if err != nil || length < 1 || start+length > len(data) {
+			return nil, ErrBadRecord
+		}
+
+		field := sierraapi.MarcField{Tag: string(entry[0:3])}
+		//Leave off the field terminator.
+		content := data[start : start+length-1]
+
+		if field.IsControl() {
+			field.Value = string(content)
+			m.Fields = append(m.Fields, field)
+			continue
+		}
+
+		if len(content) < 2 {
+			return nil, ErrBadRecord
+		}
+		field.Ind1, field.Ind2 = string(content[0]), string(content[1])
+		for _, subfield := range bytes.Split(content[2:], []byte{subfieldDelimiter}) {
+			if len(subfield) == 0 {
+				continue
+			}
+			field.Subfields = append(field.Subfields, sierraapi.MarcSubfield{Code: string(subfield[0]), Data: string(subfield[1:])})
+		}
+		m.Fields = append(m.Fields, field)
+	}
+
+	return m, nil
+}
+
+//JSON writes the record as MARC-in-JSON, where each field is an object
+//with the tag as its only key, like {"001": "ocm12345678"} or
+//{"245": {"ind1": "1", "ind2": "0", "subfields": [{"a": "A Title"}]}}
+func JSON(m *sierraapi.Marc) ([]byte, error) {
+
+	type jsonDataField struct {
+		Ind1      string              `json:"ind1"`
+		Ind2      string              `json:"ind2"`
+		Subfields []map[string]string `json:"subfields"`
+	}
+
+	record := struct {
+		Leader string                   `json:"leader"`
+		Fields []map[string]interface{} `json:"fields"`
+	}{Leader: m.Leader, Fields: []map[string]interface{}{}}
+
+	for _, field := range m.Fields {
+		if field.IsControl() {
+			record.Fields = append(record.Fields, map[string]interface{}{field.Tag: field.Value})
+			continue
+		}
+		data := jsonDataField{Ind1: indicator(field.Ind1), Ind2: indicator(field.Ind2), Subfields: []map[string]string{}}
+		for _, subfield := range field.Subfields {
+			data.Subfields = append(data.Subfields, map[string]string{subfield.Code: subfield.Data})
+		}
+		record.Fields = append(record.Fields, map[string]interface{}{field.Tag: data})
+	}
+
+	return json.Marshal(record)
+}
+
+//ParseJSON reads a MARC-in-JSON record.
+func ParseJSON(b []byte) (*sierraapi.Marc, error) {
+
+	var record struct {
+		Leader string                       `json:"leader"`
+		Fields []map[string]json.RawMessage `json:"fields"`
+	}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, err
+	}
+
+	m := &sierraapi.Marc{Leader: record.Leader}
+	for _, f := range record.Fields {
+		if len(f) != 1 {
+			return nil, errors.New("Each MARC-in-JSON field must have exactly one tag.")
+		}
+		for tag, raw := range f {
+			field := sierraapi.MarcField{Tag: tag}
+			if field.IsControl() {
+				if err := json.Unmarshal(raw, &field.Value); err != nil {
+					return nil, err
+				}
+				m.Fields = append(m.Fields, field)
+				continue
+			}
+
+			var data struct {
+				Ind1      string              `json:"ind1"`
+				Ind2      string              `json:"ind2"`
+				Subfields []map[string]string `json:"subfields"`
+			}
+			if err := json.Unmarshal(raw, &data); err != nil {
+				return nil, err
+			}
+			field.Ind1, field.Ind2 = data.Ind1, data.Ind2
+			for _, s := range data.Subfields {
+				//Subfields should have one code each, but keep any extras in a stable order.
+				codes := make([]string, 0, len(s))
+				for code := range s {
+					codes = append(codes, code)
+				}
+				sort.Strings(codes)
+				for _, code := range codes {
+					field.Subfields = append(field.Subfields, sierraapi.MarcSubfield{Code: code, Data: s[code]})
+				}
+			}
+			m.Fields = append(m.Fields, field)
+		}
+	}
+	return m, nil
+}
+
+//indicator returns a blank for a missing indicator.
+func indicator(ind string) string {
+	if len(ind) != 1 {
+		return " "
+	}
+	return ind
+}
@@ -0,0 +1,161 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package marc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//A record as Sierra returns it, with fields=marc.
+const sierraJSON = `{
+	"leader": "00000cam  2200000 a 4500",
+	"fields": [
+		{"tag": "001", "data": "ocm12345678"},
+		{"tag": "008", "data": "070321s2007    nyu      b    001 0 eng  "},
+		{"tag": "020", "data": {"ind1": " ", "ind2": " ", "subfields": [{"code": "a", "data": "9780521875646"}]}},
+		{"tag": "245", "data": {"ind1": "1", "ind2": "0", "subfields": [
+			{"code": "a", "data": "Ça & là :"},
+			{"code": "b", "data": "<une> histoire /"},
+			{"code": "c", "data": "Émile Zola."}]}},
+		{"tag": "650", "data": {"ind1": " ", "ind2": "0", "subfields": [{"code": "a", "data": "Imperialism."}]}}
+	]
+}`
+
+func sampleRecord(t *testing.T) *sierraapi.Marc {
+	m := new(sierraapi.Marc)
+	if err := json.Unmarshal([]byte(sierraJSON), m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+
+	m := sampleRecord(t)
+
+	out, err := XML(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<record xmlns="http://www.loc.gov/MARC21/slim">`,
+		`<controlfield tag="001">ocm12345678</controlfield>`,
+		`<datafield tag="245" ind1="1" ind2="0">`,
+		`<subfield code="b">&lt;une&gt; histoire /</subfield>`,
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("Expected %v in the MARCXML, got %v", expected, string(out))
+		}
+	}
+
+	parsed, err := ParseXML(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, parsed) {
+		t.Errorf("Round trip through MARCXML changed the record, %+v", parsed)
+	}
+}
+
+func TestISO2709RoundTrip(t *testing.T) {
+
+	m := sampleRecord(t)
+
+	out, err := ISO2709(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out[len(out)-1] != recordTerminator {
+		t.Error("The record should end with a record terminator.")
+	}
+	//The length is in bytes, not characters.
+	if string(out[0:5]) != fmt.Sprintf("%05d", len(out)) {
+		t.Errorf("The leader has the wrong record length, %v for %v bytes", string(out[0:5]), len(out))
+	}
+	if string(out[5:12]) != "cam a22" || string(out[20:24]) != "4500" {
+		t.Errorf("Unexpected leader %q", string(out[0:24]))
+	}
+	//The directory has five entries, and starts with the 001.
+	if string(out[12:17]) != "00085" || string(out[24:36]) != "001001200000" {
+		t.Errorf("Unexpected base address or directory %q", string(out[12:36]))
+	}
+
+	parsed, err := ParseISO2709(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Fields, parsed.Fields) {
+		t.Errorf("Round trip through ISO 2709 changed the fields, %+v", parsed.Fields)
+	}
+
+	again, err := ISO2709(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, again) {
+		t.Error("Writing a parsed record should give the same bytes.")
+	}
+}
+
+func TestISO2709Errors(t *testing.T) {
+
+	if _, err := ISO2709(&sierraapi.Marc{Fields: []sierraapi.MarcField{{Tag: "24"}}}); err == nil {
+		t.Error("A two character tag should be an error.")
+	}
+
+	huge := &sierraapi.Marc{Fields: []sierraapi.MarcField{{Tag: "500", Subfields: []sierraapi.MarcSubfield{{Code: "a", Data: strings.Repeat("x", 10000)}}}}}
+	if _, err := ISO2709(huge); err == nil {
+		t.Error("A field over 9999 bytes should be an error.")
+	}
+
+	//A missing leader is replaced with a default.
+	out, err := ISO2709(&sierraapi.Marc{Fields: []sierraapi.MarcField{{Tag: "001", Value: "1"}}})
+	if err != nil || string(out[5:12]) != "nam a22" {
+		t.Errorf("Unexpected record without a leader %q, %v", out, err)
+	}
+
+	for _, bad := range []string{"", "short", "99999cam  2200025 a 4500\x1e\x1d", "00030cam  2200099 a 4500\x1e\x1d"} {
+		if _, err := ParseISO2709([]byte(bad)); err != ErrBadRecord {
+			t.Errorf("ParseISO2709(%q) should return ErrBadRecord, got %v", bad, err)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+
+	m := sampleRecord(t)
+
+	out, err := JSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`{"001":"ocm12345678"}`,
+		`{"245":{"ind1":"1","ind2":"0","subfields":[{"a":"Ça \u0026 là :"},`,
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("Expected %v in the MARC-in-JSON, got %v", expected, string(out))
+		}
+	}
+
+	parsed, err := ParseJSON(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, parsed) {
+		t.Errorf("Round trip through MARC-in-JSON changed the record, %+v", parsed)
+	}
+
+	if _, err := ParseJSON([]byte(`{"leader":"","fields":[{"001":"1","002":"2"}]}`)); err == nil {
+		t.Error("A field with two tags should be an error.")
+	}
+}
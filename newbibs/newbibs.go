@@ -0,0 +1,86 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package newbibs keeps a snapshot of the newest bib records,
+//refreshed on a schedule by a background poller.
+//Access is controlled by a sync.RWMutex
+package newbibs
+
+import (
+	"errors"
+	"fmt"
+	l "github.com/cudevmaxwell/tyro/loglevel"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"sync"
+	"time"
+)
+
+//The number of seconds before a failed refresh is tried again.
+const DefaultRetryTime int = 30
+
+type Snapshot struct {
+	lock      sync.RWMutex
+	bibs      sierraapi.BibRecordsOut
+	refreshed time.Time
+	Refresh   chan struct{}
+}
+
+func NewSnapshot() *Snapshot {
+	s := new(Snapshot)
+	s.Refresh = make(chan struct{})
+
+	return s
+}
+
+//Get returns the newest bibs, and when they were fetched.
+//It returns an error if the first refresh hasn't finished.
+func (s *Snapshot) Get() (sierraapi.BibRecordsOut, time.Time, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.refreshed.IsZero() {
+		return nil, s.refreshed, errors.New("The snapshot of new bibs has not been generated yet.")
+	}
+	return s.bibs, s.refreshed, nil
+}
+
+func (s *Snapshot) set(bibs sierraapi.BibRecordsOut) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bibs = bibs
+	s.refreshed = time.Now()
+}
+
+//This function runs forever, calling fetch to replace the snapshot
+//every interval, or when there is a message on the Refresh channel.
+//It will exit if the Refresh channel is closed.
+func (s *Snapshot) Poller(interval time.Duration, fetch func() (sierraapi.BibRecordsOut, error)) {
+
+	runRefreshSetUpNext := func() <-chan time.Time {
+		bibs, err := fetch()
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to refresh the new bibs snapshot, %v", err), l.ErrorMessage)
+			return time.After(time.Duration(DefaultRetryTime) * time.Second)
+		}
+		s.set(bibs)
+		l.Log(fmt.Sprintf("Refreshed the new bibs snapshot, %v seconds until the next refresh.", interval.Seconds()), l.TraceMessage)
+		return time.After(interval)
+	}
+
+	go func() {
+		next := runRefreshSetUpNext()
+		for {
+			select {
+			case <-next:
+				next = runRefreshSetUpNext()
+			case _, ok := <-s.Refresh:
+				if !ok {
+					return
+				}
+				l.Log("A new bibs snapshot has been requested", l.TraceMessage)
+				next = runRefreshSetUpNext()
+			}
+		}
+	}()
+
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package newbibs
+
+import (
+	"errors"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestSnapshotGetBeforeRefresh(t *testing.T) {
+
+	s := NewSnapshot()
+
+	if _, _, err := s.Get(); err == nil {
+		t.Error("Get() should return an error before the first refresh.")
+	}
+}
+
+func TestSnapshotPoller(t *testing.T) {
+
+	s := NewSnapshot()
+
+	fetched := make(chan struct{}, 10)
+	s.Poller(time.Hour, func() (sierraapi.BibRecordsOut, error) {
+		defer func() { fetched <- struct{}{} }()
+		return sierraapi.BibRecordsOut{sierraapi.BibRecordOut{BibID: 1}}, nil
+	})
+	defer close(s.Refresh)
+
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Fatal("Poller() should fetch right away.")
+	}
+
+	//The set happens after fetch returns.
+	time.Sleep(time.Millisecond * 10)
+
+	bibs, refreshed, err := s.Get()
+	if err != nil {
+		t.Error("Get() should not return an error after a refresh.")
+	}
+	if len(bibs) != 1 || bibs[0].BibID != 1 {
+		t.Error("Get() returned the wrong bibs.")
+	}
+	if time.Since(refreshed) > time.Second {
+		t.Error("The refreshed time is wrong.")
+	}
+
+	s.Refresh <- struct{}{}
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Error("Poller() should fetch when a refresh is requested.")
+	}
+}
+
+func TestSnapshotPollerError(t *testing.T) {
+
+	s := NewSnapshot()
+
+	fetched := make(chan struct{}, 10)
+	s.Poller(time.Hour, func() (sierraapi.BibRecordsOut, error) {
+		defer func() { fetched <- struct{}{} }()
+		return nil, errors.New("Sierra is down")
+	})
+	defer close(s.Refresh)
+
+	<-fetched
+	time.Sleep(time.Millisecond * 10)
+
+	if _, _, err := s.Get(); err == nil {
+		t.Error("A failed fetch should not fill the snapshot.")
+	}
+}
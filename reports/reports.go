@@ -0,0 +1,304 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package reports runs saved queries on a schedule, and keeps
+//the results of the last few runs on disk as CSV and JSON.
+package reports
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	l "github.com/cudevmaxwell/tyro/loglevel"
+	"github.com/cudevmaxwell/tyro/sierraapi"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//The number of seconds before a failed run is tried again.
+	DefaultRetryTime int = 300
+
+	//The layout of run IDs, which sort in the order the runs happened.
+	RunIDLayout string = "20060102T150405Z"
+
+	CSVContentType  string = "text/csv;charset=UTF-8"
+	JSONContentType string = "application/json;charset=UTF-8"
+)
+
+var ErrNoRuns = errors.New("The report has not been run yet.")
+
+//Report is a saved query, run every Every, like "24h".
+type Report struct {
+	sierraapi.SavedQuery
+	Every    string        `json:"every"`
+	Interval time.Duration `json:"-"`
+}
+
+//Table is the result of a run, a row of values for each record found.
+//Truncated is set when the query found more records than were kept.
+type Table struct {
+	Columns   []string
+	Rows      [][]string
+	Truncated bool
+}
+
+//Run is one run of a report, as it's kept on disk in JSON.
+type Run struct {
+	ID          string
+	Name        string
+	Description string
+	Query       string
+	Started     time.Time
+	Finished    time.Time
+	Count       int
+	Truncated   bool
+	Entries     []map[string]string
+}
+
+//Load reads a JSON file of reports, like
+//{"missing": {"description": "Missing items", "query": "item.status = m", "every": "24h"}}
+//Every query and schedule is checked, so mistakes are found at startup.
+func Load(filename string) (map[string]Report, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var loaded map[string]Report
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return nil, fmt.Errorf("Unable to parse reports in %v, %v", filename, err)
+	}
+
+	for name, report := range loaded {
+		if name == "" || strings.ContainsAny(name, `/\.`) {
+			return nil, fmt.Errorf("The report name %q in %v can't be empty or contain a /, \\ or .", name, filename)
+		}
+		report.Parsed, err = sierraapi.ParseQuery(report.Query)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the query of report %q in %v, %v", name, filename, err)
+		}
+		report.Interval, err = time.ParseDuration(report.Every)
+		if err != nil || report.Interval < time.Minute {
+			return nil, fmt.Errorf("The report %q in %v needs to run every minute or longer, like \"24h\", not %q", name, filename, report.Every)
+		}
+		loaded[name] = report
+	}
+
+	return loaded, nil
+}
+
+//Store keeps the runs of each report in a directory named
+//for the report, with a .json and .csv file for each run.
+//Only the newest Keep runs are kept.
+type Store struct {
+	lock sync.RWMutex
+	dir  string
+	keep int
+	Stop chan struct{}
+}
+
+func NewStore(dir string, keep int) *Store {
+	s := new(Store)
+	s.dir = dir
+	s.keep = keep
+	s.Stop = make(chan struct{})
+
+	return s
+}
+
+//Save writes a run to disk as JSON and CSV, and removes the oldest runs.
+func (s *Store) Save(name string, report Report, started time.Time, table *Table) (*Run, error) {
+
+	run := &Run{
+		ID:          started.UTC().Format(RunIDLayout),
+		Name:        name,
+		Description: report.Description,
+		Query:       report.Query,
+		Started:     started,
+		Finished:    time.Now(),
+		Count:       len(table.Rows),
+		Truncated:   table.Truncated,
+		Entries:     []map[string]string{},
+	}
+	for _, row := range table.Rows {
+		entry := make(map[string]string)
+		for i, column := range table.Columns {
+			if i < len(row) {
+				entry[column] = row[i]
+			}
+		}
+		run.Entries = append(run.Entries, entry)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dir := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	err := writeFile(dir, run.ID+".json", func(f *os.File) error {
+		return json.NewEncoder(f).Encode(run)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFile(dir, run.ID+".csv", func(f *os.File) error {
+		w := csv.NewWriter(f)
+		w.Write(table.Columns)
+		w.WriteAll(table.Rows)
+		return w.Error()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.runIDs(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := s.keep; i < len(ids); i++ {
+		for _, ext := range []string{".json", ".csv"} {
+			if err := os.Remove(filepath.Join(dir, ids[i]+ext)); err != nil && !os.IsNotExist(err) {
+				l.Log(fmt.Sprintf("Unable to remove an old run of report %v, %v", name, err), l.WarnMessage)
+			}
+		}
+	}
+
+	return run, nil
+}
+
+//writeFile writes a file through a temporary file, so
+//readers never see a partly written run.
+func writeFile(dir, filename string, write func(f *os.File) error) error {
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, filename))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+//Runs returns the IDs of the runs of a report on disk, newest first.
+func (s *Store) Runs(name string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.runIDs(name)
+}
+
+//runIDs lists the runs, newest first. The caller must hold the lock.
+func (s *Store) runIDs(name string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, name, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, match := range matches {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(match), ".json"))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+//Read returns the contents of a run's file, with the extension
+//.json or .csv. An empty ID reads the newest run.
+func (s *Store) Read(name, id, ext string) ([]byte, error) {
+
+	if ext != ".json" && ext != ".csv" {
+		return nil, fmt.Errorf("Unknown report format %v", ext)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if id == "" {
+		ids, err := s.runIDs(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, ErrNoRuns
+		}
+		id = ids[0]
+	}
+	if _, err := time.Parse(RunIDLayout, id); err != nil {
+		return nil, ErrNoRuns
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, name, id+ext))
+	if os.IsNotExist(err) {
+		return nil, ErrNoRuns
+	}
+	return b, err
+}
+
+//Last returns when the newest run on disk started, or the zero time.
+func (s *Store) Last(name string) time.Time {
+	ids, err := s.Runs(name)
+	if err != nil || len(ids) == 0 {
+		return time.Time{}
+	}
+	last, _ := time.Parse(RunIDLayout, ids[0])
+	return last
+}
+
+//This function runs forever, calling run for the report every
+//report.Interval. If the newest run on disk is recent, the first
+//run waits until it is due, so restarting Tyro doesn't rerun reports.
+//It will exit if the Stop channel is closed.
+func (s *Store) Scheduler(name string, report Report, run func(report Report) (*Table, error)) {
+
+	runSaveSetUpNext := func() <-chan time.Time {
+		started := time.Now()
+		table, err := run(report)
+		if err == nil {
+			_, err = s.Save(name, report, started, table)
+		}
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to run report %v, %v", name, err), l.ErrorMessage)
+			return time.After(time.Duration(DefaultRetryTime) * time.Second)
+		}
+		l.Log(fmt.Sprintf("Ran report %v, found %v records, %v until the next run.", name, len(table.Rows), report.Interval), l.InfoMessage)
+		return time.After(report.Interval)
+	}
+
+	go func() {
+		var next <-chan time.Time
+		if wait := s.Last(name).Add(report.Interval).Sub(time.Now()); wait > 0 {
+			l.Log(fmt.Sprintf("Report %v is next due in %v", name, wait), l.TraceMessage)
+			next = time.After(wait)
+		} else {
+			next = runSaveSetUpNext()
+		}
+		for {
+			select {
+			case <-next:
+				next = runSaveSetUpNext()
+			case <-s.Stop:
+				return
+			}
+		}
+	}()
+
+}
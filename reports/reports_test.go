@@ -0,0 +1,158 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package reports
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tyroreports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	load := func(content string) (map[string]Report, error) {
+		filename := filepath.Join(dir, "reports.json")
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return Load(filename)
+	}
+
+	loaded, err := load(`{"missing": {"description": "Missing items", "query": "item.status = m", "every": "24h"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, ok := loaded["missing"]
+	if !ok || missing.Description != "Missing items" || missing.Interval != 24*time.Hour || missing.Parsed == nil || missing.Parsed.Record != "item" {
+		t.Errorf("Unexpected reports %+v", loaded)
+	}
+
+	for _, content := range []string{
+		`{"missing": {"query": "item.status", "every": "24h"}}`,
+		`{"missing": {"query": "item.status = m"}}`,
+		`{"missing": {"query": "item.status = m", "every": "1s"}}`,
+		`{"../missing": {"query": "item.status = m", "every": "24h"}}`,
+	} {
+		if _, err := load(content); err == nil {
+			t.Errorf("Expected an error loading %v", content)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := NewStore(dir, 2)
+	report := Report{Every: "1h"}
+	report.Description = "Missing items"
+	report.Query = "item.status = m"
+	table := &Table{Columns: []string{"ItemID", "Title"}, Rows: [][]string{{"1", "Dangerous nation, a history"}}, Truncated: true}
+
+	if _, err := s.Read("missing", "", ".json"); err != ErrNoRuns {
+		t.Errorf("Read() should return ErrNoRuns before the first run, not %v", err)
+	}
+
+	start := time.Date(2014, 10, 16, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if _, err := s.Save("missing", report, start.Add(time.Duration(i)*time.Hour), table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := s.Runs("missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(runs, []string{"20141016T140000Z", "20141016T130000Z"}) {
+		t.Errorf("Only the newest runs should be kept, newest first, not %v", runs)
+	}
+	if !s.Last("missing").Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("Unexpected last run %v", s.Last("missing"))
+	}
+
+	b, err := s.Read("missing", "20141016T130000Z", ".csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ItemID,Title\n1,\"Dangerous nation, a history\"\n" {
+		t.Errorf("Unexpected CSV %q", string(b))
+	}
+
+	b, err = s.Read("missing", "", ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run Run
+	if err := json.Unmarshal(b, &run); err != nil {
+		t.Fatal(err)
+	}
+	if run.ID != "20141016T140000Z" || run.Count != 1 || !run.Truncated || run.Entries[0]["Title"] != "Dangerous nation, a history" {
+		t.Errorf("Unexpected run %+v", run)
+	}
+
+	for _, id := range []string{"20141016T120000Z", "../missing", "x"} {
+		if _, err := s.Read("missing", id, ".csv"); err != ErrNoRuns {
+			t.Errorf("Read() should return ErrNoRuns for run %v, not %v", id, err)
+		}
+	}
+}
+
+func TestScheduler(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := NewStore(dir, 5)
+	defer close(s.Stop)
+
+	ran := make(chan struct{}, 10)
+	run := func(report Report) (*Table, error) {
+		defer func() { ran <- struct{}{} }()
+		return &Table{Columns: []string{"ItemID"}}, nil
+	}
+
+	s.Scheduler("missing", Report{Interval: time.Hour}, run)
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("Scheduler() should run a report with no runs right away.")
+	}
+
+	//The save happens after run returns.
+	time.Sleep(time.Millisecond * 10)
+	if runs, _ := s.Runs("missing"); len(runs) != 1 {
+		t.Errorf("Expected one run, found %v", runs)
+	}
+
+	//A report which ran recently isn't run again on startup.
+	s.Scheduler("missing", Report{Interval: time.Hour}, run)
+	select {
+	case <-ran:
+		t.Error("Scheduler() shouldn't run a report before it is due.")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
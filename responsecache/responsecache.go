@@ -0,0 +1,150 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package responsecache keeps converted Sierra API responses
+//in memory, keyed on the upstream URL. Entries are fresh
+//for a TTL, then may be served stale while a single
+//background refresh runs. Access is controlled
+//by a sync.RWMutex
+package responsecache
+
+import (
+	"fmt"
+	l "github.com/cudevmaxwell/tyro/loglevel"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+type Cache struct {
+	lock       sync.RWMutex
+	entries    map[string]*entry
+	refreshing map[string]bool
+	ttl        time.Duration
+	stale      time.Duration
+	lastPurge  time.Time
+	stats      Stats
+}
+
+//Counters describing how the cache has been used.
+type Stats struct {
+	Hits      uint64
+	StaleHits uint64
+	Misses    uint64
+	Entries   int
+}
+
+//NewCache returns a cache which keeps entries fresh for ttl,
+//and will serve them for a further stale while they are refreshed.
+//A ttl of zero disables the cache.
+func NewCache(ttl, stale time.Duration) *Cache {
+	c := new(Cache)
+	c.entries = make(map[string]*entry)
+	c.refreshing = make(map[string]bool)
+	c.ttl = ttl
+	c.stale = stale
+	c.lastPurge = time.Now()
+
+	return c
+}
+
+//Get looks up the value for key. If ok is false, there was no
+//usable entry. If fresh is false, the entry is past its TTL
+//and the caller should Revalidate it.
+func (c *Cache) Get(key string) (value interface{}, fresh bool, ok bool) {
+	if c.ttl <= 0 {
+		return nil, false, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return nil, false, false
+	}
+
+	now := time.Now()
+	if now.Before(e.expires) {
+		c.stats.Hits++
+		l.Log(fmt.Sprintf("Cache hit for %v", key), l.TraceMessage)
+		return e.value, true, true
+	}
+	if now.Before(e.expires.Add(c.stale)) {
+		c.stats.StaleHits++
+		l.Log(fmt.Sprintf("Stale cache hit for %v", key), l.TraceMessage)
+		return e.value, false, true
+	}
+
+	delete(c.entries, key)
+	c.stats.Misses++
+	return nil, false, false
+}
+
+//Set stores value under key, fresh for the cache's TTL.
+func (c *Cache) Set(key string, value interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	c.entries[key] = &entry{value: value, expires: now.Add(c.ttl)}
+
+	//Dead entries are only removed when they are looked up,
+	//so sweep the whole map now and again.
+	if now.Sub(c.lastPurge) > c.ttl+c.stale {
+		for k, e := range c.entries {
+			if now.After(e.expires.Add(c.stale)) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPurge = now
+	}
+}
+
+//Revalidate runs fetch in the background and stores the result
+//under key. Only one refresh per key will run at a time. If fetch
+//returns an error, the stale entry is left alone.
+func (c *Cache) Revalidate(key string, fetch func() (interface{}, error)) {
+	c.lock.Lock()
+	if c.refreshing[key] {
+		c.lock.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.lock.Unlock()
+
+	go func() {
+		defer func() {
+			c.lock.Lock()
+			delete(c.refreshing, key)
+			c.lock.Unlock()
+		}()
+
+		value, err := fetch()
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to refresh cache entry %v, %v", key, err), l.WarnMessage)
+			return
+		}
+		c.Set(key, value)
+	}()
+}
+
+//Stats returns a copy of the cache's counters.
+func (c *Cache) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
@@ -0,0 +1,147 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package responsecache
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func TestCacheSetAndGet(t *testing.T) {
+
+	c := NewCache(time.Minute, time.Minute)
+
+	if _, _, ok := c.Get("key"); ok {
+		t.Error("Get() should not find a key which was never Set().")
+	}
+
+	c.Set("key", "value")
+
+	value, fresh, ok := c.Get("key")
+	if !ok || !fresh {
+		t.Error("Get() should have found a fresh entry.")
+	}
+	if value.(string) != "value" {
+		t.Error("Get() returned the wrong value.")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.StaleHits != 0 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+
+	c := NewCache(0, time.Minute)
+	c.Set("key", "value")
+
+	if _, _, ok := c.Get("key"); ok {
+		t.Error("A cache with a zero TTL should never return entries.")
+	}
+}
+
+func TestCacheStaleAndExpired(t *testing.T) {
+
+	c := NewCache(time.Millisecond*10, time.Millisecond*50)
+	c.Set("key", "value")
+
+	time.Sleep(time.Millisecond * 20)
+
+	value, fresh, ok := c.Get("key")
+	if !ok || fresh {
+		t.Error("Get() should have returned a stale entry.")
+	}
+	if value.(string) != "value" {
+		t.Error("Get() returned the wrong stale value.")
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if _, _, ok := c.Get("key"); ok {
+		t.Error("Get() should not return an entry past the stale window.")
+	}
+
+	stats := c.Stats()
+	if stats.StaleHits != 1 || stats.Misses != 1 || stats.Entries != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+
+	c := NewCache(time.Minute, time.Minute)
+	c.Set("key", "old")
+
+	done := make(chan struct{})
+	c.Revalidate("key", func() (interface{}, error) {
+		defer close(done)
+		return "new", nil
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Revalidate() should have run the fetch function.")
+	}
+
+	//The Set happens after fetch returns.
+	time.Sleep(time.Millisecond * 10)
+
+	value, _, _ := c.Get("key")
+	if value.(string) != "new" {
+		t.Error("Revalidate() didn't store the new value.")
+	}
+}
+
+func TestCacheRevalidateErrorKeepsOldValue(t *testing.T) {
+
+	c := NewCache(time.Minute, time.Minute)
+	c.Set("key", "old")
+
+	done := make(chan struct{})
+	c.Revalidate("key", func() (interface{}, error) {
+		defer close(done)
+		return nil, errors.New("upstream failed")
+	})
+	<-done
+	time.Sleep(time.Millisecond * 10)
+
+	value, _, ok := c.Get("key")
+	if !ok || value.(string) != "old" {
+		t.Error("A failed Revalidate() should leave the old value in place.")
+	}
+}
+
+func TestCacheRevalidateOnlyOnce(t *testing.T) {
+
+	c := NewCache(time.Minute, time.Minute)
+
+	release := make(chan struct{})
+	calls := make(chan struct{}, 2)
+	fetch := func() (interface{}, error) {
+		calls <- struct{}{}
+		<-release
+		return "value", nil
+	}
+
+	c.Revalidate("key", fetch)
+	<-calls
+	c.Revalidate("key", fetch)
+	close(release)
+
+	select {
+	case <-calls:
+		t.Error("Only one refresh per key should run at a time.")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package session issues and checks signed patron session tokens.
+//A token holds the patron's Sierra record ID and an expiry time,
+//signed with HMAC-SHA256, so Tyro doesn't need to keep any state.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("Session token is malformed.")
+	ErrSignature = errors.New("Session token has a bad signature.")
+	ErrExpired   = errors.New("Session token has expired.")
+)
+
+type Signer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+//NewSigner returns a Signer which signs tokens with secret.
+//Tokens are valid for ttl after they are issued.
+func NewSigner(secret string, ttl time.Duration) *Signer {
+	s := new(Signer)
+	s.secret = []byte(secret)
+	s.ttl = ttl
+
+	return s
+}
+
+//Sign issues a token for the patron, and returns it with its expiry time.
+func (s *Signer) Sign(patronID int) (string, time.Time) {
+	expires := time.Now().Add(s.ttl)
+	payload := fmt.Sprintf("%v|%v", patronID, expires.Unix())
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + s.signature(encoded), expires
+}
+
+//Verify checks the token's signature and expiry,
+//and returns the patron ID it was issued for.
+func (s *Signer) Verify(token string) (int, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, ErrMalformed
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(s.signature(parts[0]))) {
+		return 0, ErrSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, ErrMalformed
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 2 {
+		return 0, ErrMalformed
+	}
+	patronID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, ErrMalformed
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, ErrMalformed
+	}
+
+	if time.Now().Unix() >= expires {
+		return 0, ErrExpired
+	}
+
+	return patronID, nil
+}
+
+func (s *Signer) signature(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+
+	s := NewSigner("secret", time.Hour)
+
+	token, expires := s.Sign(1234567)
+	if expires.Sub(time.Now()) < time.Minute*59 {
+		t.Error("Sign() returned the wrong expiry time.")
+	}
+
+	patronID, err := s.Verify(token)
+	if err != nil {
+		t.Errorf("Verify() should accept a token it signed, %v", err)
+	}
+	if patronID != 1234567 {
+		t.Error("Verify() returned the wrong patron ID.")
+	}
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+
+	s := NewSigner("secret", time.Hour)
+	token, _ := s.Sign(1234567)
+
+	other := NewSigner("other secret", time.Hour)
+	if _, err := other.Verify(token); err != ErrSignature {
+		t.Error("Verify() should reject a token signed with a different secret.")
+	}
+
+	//Swap in a different patron ID, keeping the old signature.
+	forged, _ := s.Sign(7654321)
+	forged = strings.Split(forged, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, err := s.Verify(forged); err != ErrSignature {
+		t.Error("Verify() should reject a token with a forged payload.")
+	}
+
+	for _, bad := range []string{"", "nodot", "a.b.c"} {
+		if _, err := s.Verify(bad); err != ErrMalformed {
+			t.Errorf("Verify() should reject malformed token %q", bad)
+		}
+	}
+}
+
+func TestVerifyRejectsExpiredTokens(t *testing.T) {
+
+	s := NewSigner("secret", -time.Minute)
+	token, _ := s.Sign(1234567)
+
+	if _, err := s.Verify(token); err != ErrExpired {
+		t.Error("Verify() should reject an expired token.")
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//Package shelf keeps an index of bibs in shelf order, harvested
+//from Sierra by a background harvester, for browsing the records
+//nearby on the shelf. Access is controlled by a sync.RWMutex
+package shelf
+
+import (
+	"errors"
+	"fmt"
+	l "github.com/cudevmaxwell/tyro/loglevel"
+	"sort"
+	"sync"
+	"time"
+)
+
+//The number of seconds before a failed harvest is tried again.
+const DefaultRetryTime int = 30
+
+//Entry is a bib on the shelf, placed by the call number of one of its items.
+//The index only keeps what places the bib, the title, author and ISBN
+//are filled in by the caller for the entries it serves.
+type Entry struct {
+	BibID      int
+	ItemID     int `json:"-"`
+	CallNumber string
+	SortKey    string `json:"-"`
+	Title      string
+	Author     string
+	ISBN       string
+}
+
+type Index struct {
+	lock      sync.RWMutex
+	entries   []Entry
+	byItem    map[int]Entry
+	harvested time.Time
+	Refresh   chan struct{}
+}
+
+func NewIndex() *Index {
+	x := new(Index)
+	x.byItem = make(map[int]Entry)
+	x.Refresh = make(chan struct{})
+
+	return x
+}
+
+//Replace swaps the whole index for entries, one for each item.
+func (x *Index) Replace(entries []Entry) {
+	byItem := make(map[int]Entry)
+	for _, entry := range entries {
+		byItem[entry.ItemID] = entry
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.byItem = byItem
+	x.rebuild()
+}
+
+//Update adds or replaces the entries of changed items, and
+//removes the items which are gone from the shelf, keeping the rest.
+func (x *Index) Update(entries []Entry, removed []int) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	for _, itemID := range removed {
+		delete(x.byItem, itemID)
+	}
+	for _, entry := range entries {
+		x.byItem[entry.ItemID] = entry
+	}
+	x.rebuild()
+}
+
+//rebuild places each bib by its first item in shelf order, and
+//sorts the bibs. The caller must hold the write lock.
+func (x *Index) rebuild() {
+	byBib := make(map[int]Entry)
+	for _, entry := range x.byItem {
+		old, found := byBib[entry.BibID]
+		if !found || entry.SortKey < old.SortKey || (entry.SortKey == old.SortKey && entry.ItemID < old.ItemID) {
+			byBib[entry.BibID] = entry
+		}
+	}
+	x.entries = make([]Entry, 0, len(byBib))
+	for _, entry := range byBib {
+		x.entries = append(x.entries, entry)
+	}
+	sort.Sort(byShelfOrder(x.entries))
+	x.harvested = time.Now()
+}
+
+//Len returns the number of bibs in the index.
+func (x *Index) Len() int {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return len(x.entries)
+}
+
+//Near returns up to n bibs on either side of sortKey. The bib with bibID
+//is left out. Before is in shelf order, so the nearest bib is last.
+//It returns an error if the first harvest hasn't finished.
+func (x *Index) Near(sortKey string, bibID, n int) (before, after []Entry, err error) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	if x.harvested.IsZero() {
+		return nil, nil, errors.New("The shelf index has not been harvested yet.")
+	}
+
+	target := Entry{BibID: bibID, SortKey: sortKey}
+	i := sort.Search(len(x.entries), func(i int) bool {
+		return !less(x.entries[i], target)
+	})
+
+	start := i - n
+	if start < 0 {
+		start = 0
+	}
+	before = append(before, x.entries[start:i]...)
+
+	if i < len(x.entries) && x.entries[i].BibID == bibID {
+		i++
+	}
+	end := i + n
+	if end > len(x.entries) {
+		end = len(x.entries)
+	}
+	after = append(after, x.entries[i:end]...)
+
+	return before, after, nil
+}
+
+//This function runs forever, calling harvest every interval, or when
+//there is a message on the Refresh channel. The first harvest has a
+//zero since and replaces the index, later ones are asked for what has
+//changed since the last good harvest began, and update it. harvest
+//returns the entries of changed items, and the IDs of the items which
+//were deleted, suppressed or lost their call number.
+//It will exit if the Refresh channel is closed.
+func (x *Index) Harvester(interval time.Duration, harvest func(since time.Time) ([]Entry, []int, error)) {
+
+	var since time.Time
+
+	runHarvestSetUpNext := func() <-chan time.Time {
+		started := time.Now()
+		entries, removed, err := harvest(since)
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to harvest the shelf index, %v", err), l.ErrorMessage)
+			return time.After(time.Duration(DefaultRetryTime) * time.Second)
+		}
+		if since.IsZero() {
+			x.Replace(entries)
+		} else {
+			x.Update(entries, removed)
+		}
+		since = started
+		l.Log(fmt.Sprintf("Harvested %v items into the shelf index and removed %v, %v seconds until the next harvest.", len(entries), len(removed), interval.Seconds()), l.TraceMessage)
+		return time.After(interval)
+	}
+
+	go func() {
+		next := runHarvestSetUpNext()
+		for {
+			select {
+			case <-next:
+				next = runHarvestSetUpNext()
+			case _, ok := <-x.Refresh:
+				if !ok {
+					return
+				}
+				l.Log("A shelf index harvest has been requested", l.TraceMessage)
+				next = runHarvestSetUpNext()
+			}
+		}
+	}()
+
+}
+
+func less(a, b Entry) bool {
+	if a.SortKey != b.SortKey {
+		return a.SortKey < b.SortKey
+	}
+	return a.BibID < b.BibID
+}
+
+type byShelfOrder []Entry
+
+func (b byShelfOrder) Len() int           { return len(b) }
+func (b byShelfOrder) Less(i, j int) bool { return less(b[i], b[j]) }
+func (b byShelfOrder) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,159 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package shelf
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func bibIDs(entries []Entry) []int {
+	var ids []int
+	for _, entry := range entries {
+		ids = append(ids, entry.BibID)
+	}
+	return ids
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIndexNear(t *testing.T) {
+
+	x := NewIndex()
+
+	if _, _, err := x.Near("b", 2, 2); err == nil {
+		t.Error("Near() should return an error before the first harvest.")
+	}
+
+	x.Replace([]Entry{
+		Entry{BibID: 5, ItemID: 50, SortKey: "e"},
+		Entry{BibID: 1, ItemID: 10, SortKey: "a"},
+		Entry{BibID: 3, ItemID: 30, SortKey: "c"},
+		Entry{BibID: 2, ItemID: 20, SortKey: "b"},
+		Entry{BibID: 4, ItemID: 40, SortKey: "d"},
+		Entry{BibID: 3, ItemID: 31, SortKey: "z"},
+	})
+
+	if x.Len() != 5 {
+		t.Errorf("Expected 5 bibs in the index, got %v", x.Len())
+	}
+
+	tests := []struct {
+		key    string
+		bibID  int
+		n      int
+		before []int
+		after  []int
+	}{
+		{"c", 3, 2, []int{1, 2}, []int{4, 5}},
+		{"c", 3, 1, []int{2}, []int{4}},
+		{"a", 1, 2, nil, []int{2, 3}},
+		{"e", 5, 2, []int{3, 4}, nil},
+		//A bib which isn't in the index yet.
+		{"cc", 9, 1, []int{3}, []int{4}},
+	}
+
+	for _, test := range tests {
+		before, after, err := x.Near(test.key, test.bibID, test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(bibIDs(before), test.before) || !equal(bibIDs(after), test.after) {
+			t.Errorf("Near(%q, %v, %v) returned %v %v, expected %v %v", test.key, test.bibID, test.n,
+				bibIDs(before), bibIDs(after), test.before, test.after)
+		}
+	}
+}
+
+func TestIndexUpdate(t *testing.T) {
+
+	x := NewIndex()
+	x.Replace([]Entry{
+		Entry{BibID: 1, ItemID: 10, SortKey: "a"},
+		Entry{BibID: 2, ItemID: 20, SortKey: "b"},
+		Entry{BibID: 4, ItemID: 40, SortKey: "d"},
+		Entry{BibID: 5, ItemID: 50, SortKey: "e"},
+		Entry{BibID: 5, ItemID: 51, SortKey: "f"},
+	})
+
+	x.Update([]Entry{
+		//Item 10 was moved.
+		Entry{BibID: 1, ItemID: 10, SortKey: "c"},
+		//Another copy of bib 2, further along the shelf.
+		Entry{BibID: 2, ItemID: 21, SortKey: "x"},
+		Entry{BibID: 3, ItemID: 30, SortKey: "aa"},
+		//Item 50 moved past bib 5's other copy, which now places it.
+		Entry{BibID: 5, ItemID: 50, SortKey: "z"},
+	}, []int{40})
+
+	_, after, _ := x.Near("", 0, 5)
+	if !equal(bibIDs(after), []int{3, 2, 1, 5}) {
+		t.Errorf("Unexpected order after Update(), %v", bibIDs(after))
+	}
+	if after[3].ItemID != 51 {
+		t.Errorf("Bib 5 should be placed by item 51, not %v", after[3].ItemID)
+	}
+
+	//Removing a bib's last item takes it off the shelf.
+	x.Update(nil, []int{10, 99})
+	if x.Len() != 3 {
+		t.Errorf("Expected 3 bibs after removing item 10, got %v", x.Len())
+	}
+}
+
+func TestIndexHarvester(t *testing.T) {
+
+	x := NewIndex()
+
+	calls := make(chan time.Time)
+	harvests := 0
+	x.Harvester(time.Hour, func(since time.Time) ([]Entry, []int, error) {
+		harvests++
+		calls <- since
+		if harvests == 1 {
+			return nil, nil, errors.New("Sierra is down")
+		}
+		return []Entry{Entry{BibID: harvests, ItemID: harvests, SortKey: "a"}}, nil, nil
+	})
+	defer close(x.Refresh)
+
+	if since := <-calls; !since.IsZero() {
+		t.Error("The first harvest should be a full harvest.")
+	}
+
+	x.Refresh <- struct{}{}
+	if since := <-calls; !since.IsZero() {
+		t.Error("A harvest after a failed first harvest should be a full harvest.")
+	}
+
+	x.Refresh <- struct{}{}
+	if since := <-calls; since.IsZero() {
+		t.Error("Later harvests should only ask for changes.")
+	}
+
+	//Wait for the last harvest to be stored.
+	x.Refresh <- struct{}{}
+	<-calls
+	if x.Len() == 0 {
+		t.Error("The harvested entries should be in the index.")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"regexp"
+	"strings"
+)
+
+//BibDetailOut is a simplified bibliographic record, built from
+//the MARC record, for showing a full record to patrons.
+type BibDetailOut struct {
+	BibID               int
+	Title               string
+	Subtitle            string
+	Responsibility      string
+	Authors             []string
+	Edition             string
+	PublicationPlace    string
+	Publisher           string
+	PublicationDate     string
+	PhysicalDescription string
+	Subjects            []string
+	Series              []string
+	ISBNs               []string
+	ISBNDetails         []ISBNOut
+	ISSNs               []string
+	OCLCNumber          string
+	Language            string
+	MaterialType        string
+	URLs                []URLOut
+}
+
+//URLOut is an electronic location from an 856, with the
+//text which should be shown for the link.
+type URLOut struct {
+	URL  string
+	Text string
+}
+
+//OCLC numbers are in the 035 like (OCoLC)12345678, or in the
+//001 with a prefix like ocm, ocn or on.
+var (
+	oclc035RE = regexp.MustCompile(`^\(OCoLC\)\s*(?:ocm|ocn|on)?0*(\d+)$`)
+	oclc001RE = regexp.MustCompile(`^(?:ocm|ocn|on)0*(\d+)$`)
+)
+
+//Detail converts the bib and its MARC record into a BibDetailOut.
+//The language and material type come from Sierra's fixed fields,
+//if they were asked for.
+func (in *BibRecordIn) Detail() *BibDetailOut {
+
+	out := new(BibDetailOut)
+	m := &in.Marc
+
+	out.BibID = in.ID
+	out.Title = m.TitleProper()
+	out.Subtitle = m.Subtitle()
+	out.Responsibility = m.Responsibility()
+	out.Authors = m.Authors()
+	out.Edition = m.Edition()
+	out.Publisher = m.Publisher()
+	out.PublicationDate = m.PublicationDate()
+	if field, ok := m.publication(); ok {
+		out.PublicationPlace = CleanPunctuation(field.Subfield("a"))
+	}
+	if field, ok := m.Field("300"); ok {
+		out.PhysicalDescription = CleanPunctuation(field.Text("a", "b", "c", "e"))
+	}
+	out.Subjects = m.Subjects()
+	out.Series = m.Series()
+	out.ISBNs = m.ISBNs()
+	out.ISBNDetails = m.ISBNDetails()
+	out.ISSNs = m.ISSNs()
+	out.OCLCNumber = m.OCLCNumber()
+	out.URLs = m.URLs()
+
+	out.Language = in.Lang.Name
+	if out.Language == "" {
+		out.Language = m.LanguageCode()
+	}
+	out.MaterialType = in.MaterialType.Value
+
+	//Fall back to Sierra's title, for records without a 245.
+	if out.Title == "" {
+		out.Title = CleanPunctuation(in.Title)
+	}
+	if len(out.Authors) == 0 && in.Author != "" {
+		out.Authors = []string{CleanPunctuation(in.Author)}
+	}
+
+	return out
+}
+
+//Authors are the main entry, 100, 110 or 111, then the
+//added entries in 700, 710 and 711, without duplicates.
+func (m *Marc) Authors() []string {
+	var authors []string
+	for _, tags := range [][]string{{"100", "110", "111"}, {"700", "710", "711"}} {
+		for _, field := range m.FieldsByTag(tags...) {
+			//Added entries with a title are related works, not authors.
+			if field.Subfield("t") != "" {
+				continue
+			}
+			name := CleanPunctuation(field.Text("a", "b", "c", "d", "q"))
+			if name != "" && !contains(authors, name) {
+				authors = append(authors, name)
+			}
+		}
+	}
+	return authors
+}
+
+//ISSNs are the 022 $a.
+func (m *Marc) ISSNs() []string {
+	var issns []string
+	for _, value := range m.SubfieldValues("022", "a") {
+		if fields := strings.Fields(value); len(fields) > 0 {
+			issns = append(issns, fields[0])
+		}
+	}
+	return issns
+}
+
+//OCLCNumber is the number from an (OCoLC) 035 $a, or from the
+//001 if the 003 is OCoLC or it has an OCLC prefix.
+func (m *Marc) OCLCNumber() string {
+	for _, value := range m.SubfieldValues("035", "a") {
+		if match := oclc035RE.FindStringSubmatch(strings.TrimSpace(value)); match != nil {
+			return match[1]
+		}
+	}
+	control := strings.TrimSpace(m.ControlField("001"))
+	if match := oclc001RE.FindStringSubmatch(control); match != nil {
+		return match[1]
+	}
+	if strings.TrimSpace(m.ControlField("003")) == "OCoLC" {
+		return strings.TrimLeft(control, "0")
+	}
+	return ""
+}
+
+//LanguageCode is the MARC language code in the 008.
+func (m *Marc) LanguageCode() string {
+	if fixed := m.ControlField("008"); len(fixed) >= 38 {
+		return strings.TrimSpace(fixed[35:38])
+	}
+	return ""
+}
+
+//URLs are the 856 $u. The link text is the materials
+//specified, $3, the link text, $y, or the public note, $z.
+func (m *Marc) URLs() []URLOut {
+	var urls []URLOut
+	for _, field := range m.FieldsByTag("856") {
+		text := CleanPunctuation(field.Text("3", "y"))
+		if text == "" {
+			text = CleanPunctuation(field.Text("z"))
+		}
+		for _, u := range field.SubfieldValues("u") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, URLOut{URL: u, Text: text})
+			}
+		}
+	}
+	return urls
+}
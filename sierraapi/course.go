@@ -0,0 +1,174 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"encoding/json"
+	"fmt"
+	l "github.com/cudevmaxwell/tyro/loglevel"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Course is a course with items on reserve. Sierra's API doesn't
+//have course records, so courses are loaded from a JSON file kept
+//by hand. It isn't a Sierra export, and is only as current as its
+//last edit.
+type Course struct {
+	Name        string   `json:"name"`
+	Instructors []string `json:"instructors"`
+	ItemIDs     []int    `json:"items"`
+}
+
+//CourseOut is a course, and at /courses/[courseID], its items.
+type CourseOut struct {
+	CourseID    string
+	Name        string
+	Instructors []string
+	ItemIDs     []int
+	Items       []CourseItemOut `json:",omitempty"`
+}
+
+//CourseItemOut is an item on reserve, with its live status.
+type CourseItemOut struct {
+	QueryItemOut
+	Title string
+}
+
+type byCourseID []CourseOut
+
+func (b byCourseID) Len() int           { return len(b) }
+func (b byCourseID) Less(i, j int) bool { return b[i].CourseID < b[j].CourseID }
+func (b byCourseID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+//The courses in use. Access is controlled by a sync.RWMutex
+var courses = struct {
+	sync.RWMutex
+	m map[string]Course
+}{m: make(map[string]Course)}
+
+//LookupCourse returns a course by its ID.
+func LookupCourse(courseID string) (*CourseOut, bool) {
+	courses.RLock()
+	defer courses.RUnlock()
+	course, ok := courses.m[strings.TrimSpace(courseID)]
+	if !ok {
+		return nil, false
+	}
+	return course.out(strings.TrimSpace(courseID)), true
+}
+
+//Courses lists the courses, in order by ID. If instructor isn't
+//empty, only courses with an instructor whose name contains it are listed.
+func Courses(instructor string) []CourseOut {
+	courses.RLock()
+	defer courses.RUnlock()
+
+	instructor = strings.ToLower(strings.TrimSpace(instructor))
+	list := []CourseOut{}
+	for courseID, course := range courses.m {
+		if instructor == "" || course.taughtBy(instructor) {
+			list = append(list, *course.out(courseID))
+		}
+	}
+	sort.Sort(byCourseID(list))
+	return list
+}
+
+func (c Course) taughtBy(instructor string) bool {
+	for _, name := range c.Instructors {
+		if strings.Contains(strings.ToLower(name), instructor) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Course) out(courseID string) *CourseOut {
+	out := &CourseOut{CourseID: courseID, Name: c.Name, Instructors: c.Instructors, ItemIDs: c.ItemIDs}
+	if out.Instructors == nil {
+		out.Instructors = []string{}
+	}
+	if out.ItemIDs == nil {
+		out.ItemIDs = []int{}
+	}
+	return out
+}
+
+//SetCourses replaces the courses.
+func SetCourses(table map[string]Course) {
+	courses.Lock()
+	defer courses.Unlock()
+	courses.m = table
+}
+
+//LoadCourses reads a JSON file of courses keyed on course ID, like
+//{"hist2100": {"name": "HIST 2100 Canada", "instructors": ["Smith, Jane"], "items": [4000001]}}
+func LoadCourses(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var loaded map[string]Course
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return fmt.Errorf("Unable to parse courses in %v, %v", filename, err)
+	}
+
+	table := make(map[string]Course)
+	for courseID, course := range loaded {
+		courseID = strings.TrimSpace(courseID)
+		if courseID == "" || strings.Contains(courseID, "/") {
+			return fmt.Errorf("The course ID %q in %v can't be empty or contain a /", courseID, filename)
+		}
+		table[courseID] = course
+	}
+
+	SetCourses(table)
+	return nil
+}
+
+//This function runs forever, checking the courses file every interval,
+//and loading it again when it has changed, so edits are served
+//without restarting Tyro. If the new file can't be loaded, the old
+//courses are kept. It will exit if the stop channel is closed.
+func WatchCourses(filename string, interval time.Duration, stop <-chan struct{}) {
+
+	modified := func() time.Time {
+		info, err := os.Stat(filename)
+		if err != nil {
+			l.Log(fmt.Sprintf("Unable to check the courses in %v, %v", filename, err), l.WarnMessage)
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	go func() {
+		last := modified()
+		for {
+			select {
+			case <-time.After(interval):
+				changed := modified()
+				if changed.IsZero() || changed.Equal(last) {
+					continue
+				}
+				if err := LoadCourses(filename); err != nil {
+					l.Log(fmt.Sprintf("Unable to reload the courses, keeping the old ones, %v", err), l.ErrorMessage)
+					continue
+				}
+				last = changed
+				l.Log("Reloaded the courses from: "+filename, l.InfoMessage)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+}
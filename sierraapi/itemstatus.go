@@ -0,0 +1,100 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+//Availability classes for item statuses.
+const (
+	Available   string = "available"
+	Unavailable string = "unavailable"
+	Limited     string = "limited"
+)
+
+//ItemStatus is the public label and availability class for
+//a Sierra item status code.
+type ItemStatus struct {
+	Label        string `json:"label"`
+	Availability string `json:"availability"`
+}
+
+//DefaultItemStatuses are the labels used for Sierra's standard
+//item status codes, unless they are replaced by LoadItemStatuses.
+var DefaultItemStatuses = map[string]ItemStatus{
+	"-": ItemStatus{"In Library", Available},
+	"!": ItemStatus{"On Holdshelf", Unavailable},
+	"t": ItemStatus{"In Transit", Unavailable},
+	"m": ItemStatus{"Missing", Unavailable},
+	"z": ItemStatus{"Claimed Returned", Unavailable},
+	"$": ItemStatus{"Lost", Unavailable},
+	"n": ItemStatus{"Lost", Unavailable},
+	"w": ItemStatus{"Withdrawn", Unavailable},
+	"b": ItemStatus{"At Bindery", Unavailable},
+	"p": ItemStatus{"In Process", Unavailable},
+	"q": ItemStatus{"On Order", Unavailable},
+	"o": ItemStatus{"Library Use Only", Limited},
+}
+
+//The table in use. Access is controlled by a sync.RWMutex
+var itemStatuses = struct {
+	sync.RWMutex
+	m map[string]ItemStatus
+}{m: DefaultItemStatuses}
+
+//LookupItemStatus returns the label and availability class for a status code.
+func LookupItemStatus(code string) (ItemStatus, bool) {
+	itemStatuses.RLock()
+	defer itemStatuses.RUnlock()
+	status, ok := itemStatuses.m[code]
+	return status, ok
+}
+
+//SetItemStatuses replaces the table of item statuses.
+func SetItemStatuses(statuses map[string]ItemStatus) {
+	itemStatuses.Lock()
+	defer itemStatuses.Unlock()
+	itemStatuses.m = statuses
+}
+
+//LoadItemStatuses reads a JSON file of item statuses, like
+//{"m": {"label": "Missing", "availability": "unavailable"}}
+//The entries are added to the defaults, replacing any with the same code.
+func LoadItemStatuses(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var loaded map[string]ItemStatus
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return fmt.Errorf("Unable to parse item statuses in %v, %v", filename, err)
+	}
+
+	statuses := make(map[string]ItemStatus)
+	for code, status := range DefaultItemStatuses {
+		statuses[code] = status
+	}
+	for code, status := range loaded {
+		switch status.Availability {
+		case Available, Unavailable, Limited:
+		default:
+			return fmt.Errorf("Item status %q in %v has an unknown availability %q", code, filename, status.Availability)
+		}
+		if status.Label == "" {
+			return fmt.Errorf("Item status %q in %v has no label", code, filename)
+		}
+		statuses[code] = status
+	}
+
+	SetItemStatuses(statuses)
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+//Location is the public description of a Sierra location code.
+type Location struct {
+	Name           string `json:"name"`
+	Branch         string `json:"branch"`
+	Floor          string `json:"floor"`
+	MapURL         string `json:"mapURL"`
+	NonCirculating bool   `json:"nonCirculating"`
+}
+
+//The table in use. Access is controlled by a sync.RWMutex
+var locations = struct {
+	sync.RWMutex
+	m map[string]Location
+}{m: make(map[string]Location)}
+
+//LookupLocation returns the public description of a location code.
+func LookupLocation(code string) (Location, bool) {
+	locations.RLock()
+	defer locations.RUnlock()
+	location, ok := locations.m[strings.TrimSpace(code)]
+	return location, ok
+}
+
+//SetLocations replaces the table of locations.
+func SetLocations(table map[string]Location) {
+	locations.Lock()
+	defer locations.Unlock()
+	locations.m = table
+}
+
+//LoadLocations reads a JSON file of locations keyed on Sierra location code, like
+//{"flr4": {"name": "4th Floor Books", "branch": "Main Library", "floor": "4"}}
+func LoadLocations(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var loaded map[string]Location
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return fmt.Errorf("Unable to parse locations in %v, %v", filename, err)
+	}
+
+	table := make(map[string]Location)
+	for code, location := range loaded {
+		table[strings.TrimSpace(code)] = location
+	}
+
+	SetLocations(table)
+	return nil
+}
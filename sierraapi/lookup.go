@@ -0,0 +1,123 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"github.com/cudevmaxwell/tyro/isbn"
+	"regexp"
+	"strings"
+)
+
+//Lookup finds bibs by a standard number. The queries find
+//candidates, which are then checked against their MARC records,
+//since Sierra's "has" operator matches any part of a field.
+type Lookup struct {
+	//Normalize cleans up a number, and reports whether it's valid.
+	Normalize func(value string) (string, bool)
+	//Queries are the queries for a normalized number, joined with "or".
+	Queries func(value string) []Query
+	//Matches reports whether the bib has the normalized number.
+	Matches func(bib *BibRecordIn, value string) bool
+}
+
+//Lookups are the standard numbers bibs can be looked up by.
+var Lookups = map[string]Lookup{
+	"isbn": Lookup{
+		Normalize: func(value string) (string, bool) {
+			isbn13, err := isbn.To13(value)
+			return isbn13, err == nil
+		},
+		//The 020 $a is often hyphenated, which "has" won't match, so the
+		//standard number index, the i field, which has no hyphens, is queried too.
+		Queries: func(value string) []Query {
+			forms := []string{value}
+			if isbn10, err := isbn.To10(value); err == nil {
+				forms = append(forms, isbn10)
+			}
+			var queries []Query
+			for _, form := range forms {
+				queries = append(queries, marcQuery("020", "a", form), VarFieldQuery("bib", "i", "has", form))
+			}
+			return queries
+		},
+		Matches: func(bib *BibRecordIn, value string) bool {
+			for _, number := range bib.Marc.ISBNs() {
+				if isbn.Equal(number, value) {
+					return true
+				}
+			}
+			return false
+		},
+	},
+	"issn": Lookup{
+		Normalize: NormalizeISSN,
+		Queries: func(value string) []Query {
+			return []Query{marcQuery("022", "a", value)}
+		},
+		Matches: func(bib *BibRecordIn, value string) bool {
+			for _, issn := range bib.Marc.ISSNs() {
+				if normalized, ok := NormalizeISSN(issn); ok && normalized == value {
+					return true
+				}
+			}
+			return false
+		},
+	},
+	"oclc": Lookup{
+		Normalize: NormalizeOCLCNumber,
+		Queries: func(value string) []Query {
+			return []Query{marcQuery("035", "a", value), marcQuery("001", "", value)}
+		},
+		Matches: func(bib *BibRecordIn, value string) bool {
+			return bib.Marc.OCLCNumber() == value
+		},
+	},
+}
+
+var (
+	issnRE = regexp.MustCompile(`^(\d{4})-?(\d{3}[\dX])$`)
+	oclcRE = regexp.MustCompile(`^(?:\(OCoLC\))?(?:ocm|ocn|on)?0*(\d+)$`)
+)
+
+//NormalizeISSN returns an ISSN in the form 1234-567X.
+//ISSNs with the wrong check digit aren't valid.
+func NormalizeISSN(value string) (string, bool) {
+	match := issnRE.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return "", false
+	}
+	digits := match[1] + match[2]
+	sum := 0
+	for i := 0; i < 7; i++ {
+		sum += int(digits[i]-'0') * (8 - i)
+	}
+	check := byte('0' + (11-sum%11)%11)
+	if check == '0'+10 {
+		check = 'X'
+	}
+	if digits[7] != check {
+		return "", false
+	}
+	return match[1] + "-" + match[2], true
+}
+
+//NormalizeOCLCNumber returns an OCLC number without a
+//prefix, like (OCoLC) or ocm, or leading zeros.
+func NormalizeOCLCNumber(value string) (string, bool) {
+	match := oclcRE.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+func marcQuery(tag, subfields, value string) Query {
+	return MarcFieldQuery("bib", tag, subfields, "has", value)
+}
+
+//BarcodeQuery finds items by barcode, the item's b field.
+func BarcodeQuery(barcode string) Query {
+	return VarFieldQuery("item", "b", "equals", strings.TrimSpace(barcode))
+}
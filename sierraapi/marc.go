@@ -0,0 +1,366 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"encoding/json"
+	"github.com/cudevmaxwell/tyro/isbn"
+	"strings"
+)
+
+//Marc is a MARC record, as returned by the Sierra API when
+//marc is included in the fields of a bib request.
+type Marc struct {
+	Leader string      `json:"leader"`
+	Fields []MarcField `json:"fields"`
+}
+
+//MarcField is a control field, with just a Value,
+//or a data field, with indicators and subfields.
+type MarcField struct {
+	Tag       string
+	Value     string
+	Ind1      string
+	Ind2      string
+	Subfields []MarcSubfield
+}
+
+//ISBNOut is an ISBN from the 020, in both forms, with its qualifier.
+//Invalid ISBNs have no ISBN10 or ISBN13, and Cancelled ISBNs are from $z.
+type ISBNOut struct {
+	Number    string
+	ISBN10    string
+	ISBN13    string
+	Qualifier string
+	Valid     bool
+	Cancelled bool
+}
+
+//MarcSubfield is one coded subfield of a data field.
+type MarcSubfield struct {
+	Code string `json:"code"`
+	Data string `json:"data"`
+}
+
+type marcFieldJSON struct {
+	Tag  string          `json:"tag"`
+	Data json.RawMessage `json:"data"`
+}
+
+type marcDataJSON struct {
+	Ind1      string         `json:"ind1"`
+	Ind2      string         `json:"ind2"`
+	Subfields []MarcSubfield `json:"subfields"`
+}
+
+//UnmarshalJSON reads a field. The data of a control field is a string,
+//the data of a data field is an object with indicators and subfields.
+func (f *MarcField) UnmarshalJSON(b []byte) error {
+
+	var in marcFieldJSON
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	*f = MarcField{Tag: in.Tag}
+
+	data := strings.TrimSpace(string(in.Data))
+	if data == "" || data == "null" {
+		return nil
+	}
+	if strings.HasPrefix(data, `"`) {
+		return json.Unmarshal(in.Data, &f.Value)
+	}
+
+	var d marcDataJSON
+	if err := json.Unmarshal(in.Data, &d); err != nil {
+		return err
+	}
+	f.Ind1 = d.Ind1
+	f.Ind2 = d.Ind2
+	f.Subfields = d.Subfields
+	return nil
+}
+
+//MarshalJSON writes a field in the same form Sierra uses.
+func (f MarcField) MarshalJSON() ([]byte, error) {
+	if f.IsControl() {
+		return json.Marshal(struct {
+			Tag  string `json:"tag"`
+			Data string `json:"data"`
+		}{f.Tag, f.Value})
+	}
+	return json.Marshal(struct {
+		Tag  string       `json:"tag"`
+		Data marcDataJSON `json:"data"`
+	}{f.Tag, marcDataJSON{f.Ind1, f.Ind2, f.Subfields}})
+}
+
+//IsControl reports whether the field is a control field, 001 to 009.
+func (f *MarcField) IsControl() bool {
+	return strings.HasPrefix(f.Tag, "00")
+}
+
+//Subfield returns the first subfield with code, or "".
+func (f *MarcField) Subfield(code string) string {
+	for _, subfield := range f.Subfields {
+		if subfield.Code == code {
+			return subfield.Data
+		}
+	}
+	return ""
+}
+
+//SubfieldValues returns every subfield with one of the codes, in order.
+func (f *MarcField) SubfieldValues(codes ...string) []string {
+	var values []string
+	for _, subfield := range f.Subfields {
+		for _, code := range codes {
+			if subfield.Code == code {
+				values = append(values, subfield.Data)
+				break
+			}
+		}
+	}
+	return values
+}
+
+//Text joins the subfields with one of the codes with spaces.
+//If no codes are given, every subfield is used.
+func (f *MarcField) Text(codes ...string) string {
+	var parts []string
+	for _, subfield := range f.Subfields {
+		if len(codes) > 0 && !contains(codes, subfield.Code) {
+			continue
+		}
+		if data := strings.TrimSpace(subfield.Data); data != "" {
+			parts = append(parts, data)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+//FieldsByTag returns every field with one of the tags, in order.
+func (m *Marc) FieldsByTag(tags ...string) []MarcField {
+	var fields []MarcField
+	for _, field := range m.Fields {
+		if contains(tags, field.Tag) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+//Field returns the first field with tag.
+func (m *Marc) Field(tag string) (*MarcField, bool) {
+	for i := range m.Fields {
+		if m.Fields[i].Tag == tag {
+			return &m.Fields[i], true
+		}
+	}
+	return nil, false
+}
+
+//ControlField returns the value of the first control field with tag, or "".
+func (m *Marc) ControlField(tag string) string {
+	if field, ok := m.Field(tag); ok {
+		return field.Value
+	}
+	return ""
+}
+
+//SubfieldValues returns the subfields with code, from every field with tag.
+func (m *Marc) SubfieldValues(tag, code string) []string {
+	var values []string
+	for _, field := range m.FieldsByTag(tag) {
+		values = append(values, field.SubfieldValues(code)...)
+	}
+	return values
+}
+
+//TitleProper is the 245 $a, with the number and name of part, $n and $p.
+func (m *Marc) TitleProper() string {
+	if field, ok := m.Field("245"); ok {
+		return CleanPunctuation(field.Text("a", "n", "p"))
+	}
+	return ""
+}
+
+//Subtitle is the 245 $b.
+func (m *Marc) Subtitle() string {
+	if field, ok := m.Field("245"); ok {
+		return CleanPunctuation(field.Text("b"))
+	}
+	return ""
+}
+
+//Responsibility is the statement of responsibility, the 245 $c.
+func (m *Marc) Responsibility() string {
+	if field, ok := m.Field("245"); ok {
+		return CleanPunctuation(field.Text("c"))
+	}
+	return ""
+}
+
+//Edition is the 250 $a.
+func (m *Marc) Edition() string {
+	if field, ok := m.Field("250"); ok {
+		return CleanPunctuation(field.Text("a", "b"))
+	}
+	return ""
+}
+
+//publication returns the 264 publication field, or the older 260.
+func (m *Marc) publication() (*MarcField, bool) {
+	for _, field := range m.FieldsByTag("264") {
+		if field.Ind2 == "1" {
+			return &field, true
+		}
+	}
+	return m.Field("260")
+}
+
+//Publisher is the 264 or 260 $b.
+func (m *Marc) Publisher() string {
+	if field, ok := m.publication(); ok {
+		return CleanPunctuation(field.Subfield("b"))
+	}
+	return ""
+}
+
+//PublicationDate is the 264 or 260 $c, or Date 1 from the 008.
+func (m *Marc) PublicationDate() string {
+	if field, ok := m.publication(); ok {
+		if date := CleanPunctuation(field.Subfield("c")); date != "" {
+			return date
+		}
+	}
+	if fixed := m.ControlField("008"); len(fixed) >= 11 {
+		return strings.TrimSpace(fixed[7:11])
+	}
+	return ""
+}
+
+//Subjects are the 6XX fields, with their subdivisions joined by " -- ".
+func (m *Marc) Subjects() []string {
+	var subjects []string
+	for _, field := range m.Fields {
+		if !strings.HasPrefix(field.Tag, "6") {
+			continue
+		}
+		var parts []string
+		for _, value := range field.SubfieldValues("a", "b", "c", "d", "t", "v", "x", "y", "z") {
+			if value = CleanPunctuation(value); value != "" {
+				parts = append(parts, value)
+			}
+		}
+		if len(parts) > 0 {
+			subjects = append(subjects, strings.Join(parts, " -- "))
+		}
+	}
+	return subjects
+}
+
+//Series are the series statements in 490, or the
+//controlled series titles in 8XX if there are none.
+func (m *Marc) Series() []string {
+	var series []string
+	for _, field := range m.FieldsByTag("490") {
+		if text := CleanPunctuation(field.Text("a", "v")); text != "" {
+			series = append(series, text)
+		}
+	}
+	if len(series) > 0 {
+		return series
+	}
+	for _, field := range m.FieldsByTag("800", "810", "811", "830") {
+		if text := CleanPunctuation(field.Text("a", "t", "n", "p", "v")); text != "" {
+			series = append(series, text)
+		}
+	}
+	return series
+}
+
+//ISBNs are the valid ISBNs in the 020 $a, without hyphens
+//or qualifiers like (pbk.)
+func (m *Marc) ISBNs() []string {
+	var isbns []string
+	for _, i := range m.ISBNDetails() {
+		if i.Valid && !i.Cancelled {
+			isbns = append(isbns, i.Number)
+		}
+	}
+	return isbns
+}
+
+//ISBNDetails are the ISBNs in the 020 $a, and the cancelled or
+//invalid ISBNs in the 020 $z, with both forms and their qualifiers.
+func (m *Marc) ISBNDetails() []ISBNOut {
+	var isbns []ISBNOut
+	for _, field := range m.FieldsByTag("020") {
+		//Newer records have the qualifier in $q, instead of in parentheses.
+		qualifier := cleanQualifier(strings.Join(field.SubfieldValues("q"), " "))
+		for _, subfield := range field.Subfields {
+			if subfield.Code != "a" && subfield.Code != "z" {
+				continue
+			}
+			parsed := isbn.Parse(subfield.Data)
+			if parsed.Number == "" {
+				continue
+			}
+			out := ISBNOut{
+				Number:    parsed.Number,
+				ISBN10:    parsed.ISBN10,
+				ISBN13:    parsed.ISBN13,
+				Qualifier: cleanQualifier(parsed.Qualifier),
+				Valid:     parsed.Valid,
+				Cancelled: subfield.Code == "z",
+			}
+			if out.Qualifier == "" {
+				out.Qualifier = qualifier
+			}
+			isbns = append(isbns, out)
+		}
+	}
+	return isbns
+}
+
+//cleanQualifier removes the ISBD punctuation after a qualifier, like
+//"pbk. ;". Qualifiers are mostly abbreviations, like pbk. and alk.,
+//so a final period is kept.
+func cleanQualifier(s string) string {
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(s), " /:;,="))
+}
+
+//Abbreviations which keep their final period.
+var abbreviations = map[string]bool{
+	"ed.": true, "eds.": true, "etc.": true, "inc.": true, "co.": true, "corp.": true,
+	"ltd.": true, "jr.": true, "sr.": true, "dept.": true, "univ.": true, "assn.": true,
+}
+
+//CleanPunctuation removes the ISBD punctuation which separates
+//MARC subfields, like the " /" at the end of a title.
+func CleanPunctuation(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimRight(s, " /:;,=")
+	//A final period is punctuation, unless it ends an initial or abbreviation.
+	if strings.HasSuffix(s, ".") && !strings.HasSuffix(s, "..") {
+		words := strings.Fields(s)
+		last := words[len(words)-1]
+		if len(last) > 2 && !strings.Contains(last[:len(last)-1], ".") && !abbreviations[strings.ToLower(last)] {
+			s = strings.TrimSuffix(s, ".")
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
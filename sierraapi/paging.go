@@ -0,0 +1,54 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"net/url"
+	"strconv"
+)
+
+//Page is one page of a list of records, with the
+//offsets of the pages before and after it.
+//Next and Previous are nil on the last and first pages.
+type Page struct {
+	Offset   int
+	Limit    int
+	Total    int
+	Next     *int
+	Previous *int
+}
+
+//NewPage works out the next and previous offsets.
+func NewPage(offset, limit, total int) Page {
+	p := Page{Offset: offset, Limit: limit, Total: total}
+	if next := offset + limit; limit > 0 && next < total {
+		p.Next = &next
+	}
+	if offset > 0 {
+		previous := offset - limit
+		if previous < 0 {
+			previous = 0
+		}
+		p.Previous = &previous
+	}
+	return p
+}
+
+//SetPaging sets the offset and limit of a Sierra API request.
+func SetPaging(u *url.URL, offset, limit int) {
+	q := u.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+}
+
+//TotalURL returns a copy of u which asks for a single record.
+//Decode the response into a TotalIn, to find the size of a
+//list without fetching it.
+func TotalURL(u *url.URL) *url.URL {
+	total := *u
+	SetPaging(&total, 0, 1)
+	return &total
+}
@@ -0,0 +1,246 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"github.com/cudevmaxwell/tyro/callnumber"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//API Endpoint for patron records, followed by the patron's ID
+	PatronRequestEndpoint string = "patrons"
+
+	//The number of checkouts, holds or fines asked for at once.
+	PatronRecordsLimit int = 200
+)
+
+//IDFromLink returns the record ID at the end of a Sierra API link,
+//like https://sandbox.iii.com/iii/sierra-api/v1/items/1234567
+//It returns 0 if there is no ID.
+func IDFromLink(link string) int {
+	id, err := strconv.Atoi(path.Base(strings.TrimRight(link, "/")))
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+//FormatDueDate formats a due date the way it's shown to patrons.
+func FormatDueDate(due time.Time) string {
+	return "Due " + due.Format("January 2, 2006")
+}
+
+type CheckoutIn struct {
+	ID               string    `json:"id"`
+	Item             string    `json:"item"`
+	Barcode          string    `json:"barcode"`
+	CallNumber       string    `json:"callNumber"`
+	DueDate          time.Time `json:"dueDate"`
+	NumberOfRenewals int       `json:"numberOfRenewals"`
+}
+
+type CheckoutOut struct {
+	CheckoutID int
+	ItemID     int
+	Title      string
+	CallNumber string
+	Due        string
+	DueDate    time.Time
+	Renewals   int
+	//Renewable is left out when there is no renewal limit, since
+	//Sierra doesn't say whether a checkout can be renewed.
+	Renewable *bool `json:",omitempty"`
+}
+
+type CheckoutsIn struct {
+	Entries []CheckoutIn `json:"entries"`
+}
+
+type CheckoutsOut struct {
+	Entries []CheckoutOut
+}
+
+//Convert simplifies the checkout. A checkout is renewable if it
+//has been renewed fewer than maxRenewals times. If maxRenewals is 0,
+//Renewable is nil, since it isn't known.
+func (in *CheckoutIn) Convert(maxRenewals int) *CheckoutOut {
+
+	out := new(CheckoutOut)
+	out.CheckoutID = IDFromLink(in.ID)
+	out.ItemID = IDFromLink(in.Item)
+	out.CallNumber = callnumber.Normalize(in.CallNumber)
+	out.Due = FormatDueDate(in.DueDate)
+	out.DueDate = in.DueDate
+	out.Renewals = in.NumberOfRenewals
+	if maxRenewals > 0 {
+		renewable := in.NumberOfRenewals < maxRenewals
+		out.Renewable = &renewable
+	}
+
+	return out
+}
+
+func (in *CheckoutsIn) Convert(maxRenewals int) *CheckoutsOut {
+	out := new(CheckoutsOut)
+	for _, checkout := range in.Entries {
+		out.Entries = append(out.Entries, *checkout.Convert(maxRenewals))
+	}
+	return out
+}
+
+//RenewalOut reports the result of renewing a checkout. If Renewed is
+//false, Message holds the reason.
+type RenewalOut struct {
+	CheckoutID int
+	ItemID     int
+	Title      string
+	Renewed    bool
+	Due        string
+	DueDate    time.Time
+	Message    string
+}
+
+type RenewalsOut struct {
+	Entries []RenewalOut
+}
+
+type HoldIn struct {
+	ID             string     `json:"id"`
+	Patron         string     `json:"patron"`
+	Record         string     `json:"record"`
+	RecordType     string     `json:"recordType"`
+	Placed         string     `json:"placed"`
+	Frozen         bool       `json:"frozen"`
+	Priority       int        `json:"priority"`
+	PickupLocation CodedValue `json:"pickupLocation"`
+	Status         CodedValue `json:"status"`
+}
+
+//HoldRequest is sent to Sierra to place a hold. RecordType is b or i.
+type HoldRequest struct {
+	RecordType     string `json:"recordType"`
+	RecordNumber   int    `json:"recordNumber"`
+	PickupLocation string `json:"pickupLocation"`
+}
+
+type HoldOut struct {
+	HoldID         int
+	RecordID       int
+	RecordType     string
+	Title          string
+	Placed         string
+	PickupLocation string
+	QueuePosition  int
+	Status         string
+	Frozen         bool
+}
+
+type HoldsIn struct {
+	Entries []HoldIn `json:"entries"`
+}
+
+type HoldsOut struct {
+	Entries []HoldOut
+}
+
+func (in *HoldIn) Convert() *HoldOut {
+
+	out := new(HoldOut)
+	out.HoldID = IDFromLink(in.ID)
+	out.RecordID = IDFromLink(in.Record)
+	out.RecordType = in.RecordType
+	out.Placed = in.Placed
+	out.PickupLocation = strings.TrimSpace(in.PickupLocation.Name)
+	out.QueuePosition = in.Priority
+	out.Status = in.Status.Name
+	out.Frozen = in.Frozen
+
+	return out
+}
+
+func (in *HoldsIn) Convert() *HoldsOut {
+	out := new(HoldsOut)
+	for _, hold := range in.Entries {
+		out.Entries = append(out.Entries, *hold.Convert())
+	}
+	return out
+}
+
+type FineIn struct {
+	ID            string  `json:"id"`
+	Item          string  `json:"item"`
+	AssessedDate  string  `json:"assessedDate"`
+	Description   string  `json:"description"`
+	ItemCharge    float64 `json:"itemCharge"`
+	ProcessingFee float64 `json:"processingFee"`
+	BillingFee    float64 `json:"billingFee"`
+	PaidAmount    float64 `json:"paidAmount"`
+	ChargeType    struct {
+		Code    string `json:"code"`
+		Display string `json:"display"`
+	} `json:"chargeType"`
+}
+
+type FineOut struct {
+	FineID      int
+	ItemID      int
+	Title       string
+	Description string
+	ChargeType  string
+	Assessed    string
+	AmountOwed  float64
+}
+
+type FinesIn struct {
+	Entries []FineIn `json:"entries"`
+}
+
+type FinesOut struct {
+	Entries   []FineOut
+	TotalOwed float64
+}
+
+func (in *FineIn) Convert() *FineOut {
+
+	out := new(FineOut)
+	out.FineID = IDFromLink(in.ID)
+	out.ItemID = IDFromLink(in.Item)
+	out.Description = in.Description
+	out.ChargeType = in.ChargeType.Display
+	out.Assessed = in.AssessedDate
+	out.AmountOwed = dollars(in.owed())
+
+	return out
+}
+
+//owed is the amount owed on a fine, in cents. Amounts are added up
+//in cents, so they don't pick up floating point errors like 0.30000000000000004
+func (in *FineIn) owed() int64 {
+	return cents(in.ItemCharge) + cents(in.ProcessingFee) + cents(in.BillingFee) - cents(in.PaidAmount)
+}
+
+func (in *FinesIn) Convert() *FinesOut {
+	out := new(FinesOut)
+	var total int64
+	for _, fine := range in.Entries {
+		out.Entries = append(out.Entries, *fine.Convert())
+		total += fine.owed()
+	}
+	out.TotalOwed = dollars(total)
+	return out
+}
+
+func cents(amount float64) int64 {
+	return int64(math.Floor(amount*100 + 0.5))
+}
+
+func dollars(cents int64) float64 {
+	return float64(cents) / 100
+}
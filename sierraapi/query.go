@@ -0,0 +1,124 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+const (
+	//API Endpoints for Sierra's JSON query language
+	BibQueryEndpoint  string = "bibs/query"
+	ItemQueryEndpoint string = "items/query"
+)
+
+//Query is a search of one field of one type of record, in
+//Sierra's JSON query language.
+type Query struct {
+	Target QueryTarget `json:"target"`
+	Expr   QueryExpr   `json:"expr"`
+}
+
+//QueryTarget is a fixed field, by its number in ID, or a variable field.
+type QueryTarget struct {
+	Record QueryRecord `json:"record"`
+	ID     int         `json:"id,omitempty"`
+	Field  *QueryField `json:"field,omitempty"`
+}
+
+type QueryRecord struct {
+	Type string `json:"type"`
+}
+
+//QueryField is a MARC tag, with optional subfields,
+//or a Sierra field tag, like b for an item barcode.
+type QueryField struct {
+	MarcTag   string `json:"marcTag,omitempty"`
+	Subfields string `json:"subfields,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+}
+
+type QueryExpr struct {
+	Op       string   `json:"op"`
+	Operands []string `json:"operands"`
+}
+
+//CompoundQuery joins queries with "and" or "or".
+type CompoundQuery struct {
+	Queries []interface{} `json:"queries"`
+}
+
+//FixedFieldQuery searches a fixed field, like 88, the status of an item.
+func FixedFieldQuery(record string, id int, op string, operands ...string) Query {
+	return Query{
+		Target: QueryTarget{Record: QueryRecord{record}, ID: id},
+		Expr:   QueryExpr{Op: op, Operands: operands},
+	}
+}
+
+//VarFieldQuery searches a variable field by its Sierra field tag, like b, the barcode of an item.
+func VarFieldQuery(record, tag, op string, operands ...string) Query {
+	return Query{
+		Target: QueryTarget{Record: QueryRecord{record}, Field: &QueryField{Tag: tag}},
+		Expr:   QueryExpr{Op: op, Operands: operands},
+	}
+}
+
+//MarcFieldQuery searches a MARC field, and optionally only some of its subfields.
+func MarcFieldQuery(record, tag, subfields, op string, operands ...string) Query {
+	return Query{
+		Target: QueryTarget{Record: QueryRecord{record}, Field: &QueryField{MarcTag: tag, Subfields: subfields}},
+		Expr:   QueryExpr{Op: op, Operands: operands},
+	}
+}
+
+//And joins queries, or other compound queries, with "and".
+func And(queries ...interface{}) interface{} {
+	return join("and", queries)
+}
+
+//Or joins queries, or other compound queries, with "or".
+func Or(queries ...interface{}) interface{} {
+	return join("or", queries)
+}
+
+//AnyOf joins the queries with "or".
+func AnyOf(queries ...Query) interface{} {
+	var joined []interface{}
+	for _, query := range queries {
+		joined = append(joined, query)
+	}
+	return Or(joined...)
+}
+
+//join puts op between the queries. A single query is returned as is.
+func join(op string, queries []interface{}) interface{} {
+	if len(queries) == 1 {
+		return queries[0]
+	}
+	compound := CompoundQuery{}
+	for i, query := range queries {
+		if i > 0 {
+			compound.Queries = append(compound.Queries, op)
+		}
+		compound.Queries = append(compound.Queries, query)
+	}
+	return compound
+}
+
+//QueryResultsIn is the response to a query, links to the matching records.
+type QueryResultsIn struct {
+	Total   int `json:"total"`
+	Entries []struct {
+		Link string `json:"link"`
+	} `json:"entries"`
+}
+
+//IDs returns the record IDs from the links.
+func (in *QueryResultsIn) IDs() []int {
+	var ids []int
+	for _, entry := range in.Entries {
+		if id := IDFromLink(entry.Link); id != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
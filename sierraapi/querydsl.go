@@ -0,0 +1,382 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//A small language for writing Sierra JSON queries, like
+//
+//	item.location = flr4 and (item.status = m or item.status = z)
+//
+//Each condition is a record type and field, an operator and a value.
+//Values with spaces or operators in them go in double quotes.
+//Fields are the names in QueryFields, or fixed:N for fixed field N,
+//var:X for variable field tag X, or marc:NNN for MARC tag NNN,
+//followed by the subfields, like marc:245ab.
+//The operators are in QueryOperators, and between takes two values,
+//like bib.created between 2014-01-01 2014-02-01.
+//and binds more tightly than or, and parentheses group conditions.
+//Every condition in a query must be for the same type of record.
+
+//QueryOperators are the operators of the query language,
+//and the Sierra operators they stand for.
+var QueryOperators = map[string]string{
+	"=":       "equals",
+	"~":       "has",
+	"^":       "starts_with",
+	"<":       "less",
+	">":       "greater",
+	"<=":      "less_or_equal",
+	">=":      "greater_or_equal",
+	"between": "between",
+}
+
+//QueryFields are the named fields of each type of record.
+//Fields with an ID are fixed fields, the others are variable fields.
+var QueryFields = map[string]map[string]QueryTarget{
+	"item": {
+		"location":   {ID: 79},
+		"status":     {ID: 88},
+		"itype":      {ID: 61},
+		"barcode":    {Field: &QueryField{Tag: "b"}},
+		"callnumber": {Field: &QueryField{Tag: "c"}},
+	},
+	"bib": {
+		"location":  {ID: 26},
+		"lang":      {ID: 24},
+		"cataloged": {ID: 28},
+		"biblevel":  {ID: 29},
+		"mattype":   {ID: 30},
+		"title":     {Field: &QueryField{Tag: "t"}},
+		"author":    {Field: &QueryField{Tag: "a"}},
+	},
+}
+
+//ParsedQuery is a query in the query language, and the Sierra JSON query it stands for.
+type ParsedQuery struct {
+	//The type of record the query finds, item or bib.
+	Record string
+	//The Sierra JSON query, a Query or a CompoundQuery.
+	JSON interface{}
+}
+
+//ParseQuery turns the query language into a Sierra JSON query.
+func ParseQuery(s string) (*ParsedQuery, error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Unexpected %q in query.", p.tokens[p.pos].text)
+	}
+	return &ParsedQuery{Record: p.record, JSON: q}, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+//tokenizeQuery splits a query into words, quoted values, operators and parentheses.
+func tokenizeQuery(s string) ([]queryToken, error) {
+
+	var tokens []queryToken
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, queryToken{text: string(c)})
+			i++
+		case c == '"':
+			var value []rune
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("Unclosed quote in query.")
+			}
+			tokens = append(tokens, queryToken{text: string(value), quoted: true})
+			i++
+		case strings.ContainsRune("=~^<>", c):
+			op := string(c)
+			if (c == '<' || c == '>') && i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			tokens = append(tokens, queryToken{text: op})
+			i += len(op)
+		default:
+			start := i
+			for ; i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"=~^<>`, runes[i]); i++ {
+			}
+			tokens = append(tokens, queryToken{text: string(runes[start:i])})
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	record string
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return queryToken{}, false
+}
+
+func (p *queryParser) next() (queryToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("Unexpected end of query.")
+	}
+	p.pos++
+	return t, nil
+}
+
+//keyword reports whether the next token is the unquoted word.
+func (p *queryParser) keyword(word string) bool {
+	t, ok := p.peek()
+	return ok && !t.quoted && strings.ToLower(t.text) == word
+}
+
+func (p *queryParser) or() (interface{}, error) {
+	return p.joined("or", p.and)
+}
+
+func (p *queryParser) and() (interface{}, error) {
+	return p.joined("and", p.factor)
+}
+
+func (p *queryParser) joined(op string, operand func() (interface{}, error)) (interface{}, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	queries := []interface{}{first}
+	for p.keyword(op) {
+		p.pos++
+		q, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return join(op, queries), nil
+}
+
+func (p *queryParser) factor() (interface{}, error) {
+	if t, ok := p.peek(); ok && !t.quoted && t.text == "(" {
+		p.pos++
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next(); err != nil || t.quoted || t.text != ")" {
+			return nil, fmt.Errorf("Missing ) in query.")
+		}
+		return q, nil
+	}
+	return p.condition()
+}
+
+//condition parses record.field op value.
+func (p *queryParser) condition() (interface{}, error) {
+
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(t.text, ".", 2)
+	if t.quoted || len(parts) != 2 {
+		return nil, fmt.Errorf("Expected a record and field like item.status, got %q.", t.text)
+	}
+	record, fieldName := strings.ToLower(parts[0]), parts[1]
+
+	fields, ok := QueryFields[record]
+	if !ok {
+		return nil, fmt.Errorf("Unknown record type %q, use item or bib.", record)
+	}
+	if p.record == "" {
+		p.record = record
+	} else if p.record != record {
+		return nil, fmt.Errorf("A query can only find one type of record, not %v and %v.", p.record, record)
+	}
+
+	target, err := queryTarget(fields, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	target.Record = QueryRecord{record}
+
+	t, err = p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := QueryOperators[strings.ToLower(t.text)]
+	if t.quoted || !ok {
+		return nil, fmt.Errorf("Unknown operator %q.", t.text)
+	}
+
+	count := 1
+	if op == "between" {
+		count = 2
+	}
+	var operands []string
+	for i := 0; i < count; i++ {
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if !value.quoted && (value.text == "(" || value.text == ")" || QueryOperators[value.text] != "") {
+			return nil, fmt.Errorf("Expected a value, got %q.", value.text)
+		}
+		operands = append(operands, value.text)
+	}
+
+	return Query{Target: target, Expr: QueryExpr{Op: op, Operands: operands}}, nil
+}
+
+//queryTarget looks up a named field, or reads fixed:N, var:X or marc:NNNabc.
+func queryTarget(fields map[string]QueryTarget, name string) (QueryTarget, error) {
+
+	if target, ok := fields[strings.ToLower(name)]; ok {
+		return target, nil
+	}
+
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		switch strings.ToLower(parts[0]) {
+		case "fixed":
+			if id, err := strconv.Atoi(parts[1]); err == nil && id > 0 {
+				return QueryTarget{ID: id}, nil
+			}
+		case "var":
+			if len(parts[1]) == 1 {
+				return QueryTarget{Field: &QueryField{Tag: parts[1]}}, nil
+			}
+		case "marc":
+			if len(parts[1]) >= 3 {
+				if _, err := strconv.Atoi(parts[1][:3]); err == nil {
+					return QueryTarget{Field: &QueryField{MarcTag: parts[1][:3], Subfields: parts[1][3:]}}, nil
+				}
+			}
+		}
+	}
+
+	return QueryTarget{}, fmt.Errorf("Unknown field %q.", name)
+}
+
+//SavedQuery is a named query, kept in the configuration.
+type SavedQuery struct {
+	Description string       `json:"description"`
+	Query       string       `json:"query"`
+	Parsed      *ParsedQuery `json:"-"`
+}
+
+//LoadSavedQueries reads a JSON file of named queries, like
+//{"missing": {"description": "Missing items", "query": "item.status = m"}}
+//Every query is parsed, so mistakes are found at startup.
+func LoadSavedQueries(filename string) (map[string]SavedQuery, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var loaded map[string]SavedQuery
+	if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+		return nil, fmt.Errorf("Unable to parse saved queries in %v, %v", filename, err)
+	}
+
+	for name, saved := range loaded {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("The saved query name %q in %v can't be empty or contain a /", name, filename)
+		}
+		saved.Parsed, err = ParseQuery(saved.Query)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse saved query %q in %v, %v", name, filename, err)
+		}
+		loaded[name] = saved
+	}
+
+	return loaded, nil
+}
+
+//QueryItemOut is an item found by a query.
+type QueryItemOut struct {
+	ItemID int
+	BibIDs []int
+	ItemRecordOut
+}
+
+//QueryResultsOut is a page of records found by a query.
+//Sierra doesn't count all the matches, so there's no Total,
+//and Next is only set when there are records past the page.
+type QueryResultsOut struct {
+	Name     string `json:",omitempty"`
+	Query    string
+	Record   string
+	Offset   int
+	Limit    int
+	Next     *int
+	Previous *int
+	//The records, []QueryItemOut for items or BibRecordsOut for bibs.
+	Entries interface{}
+}
+
+//NewQueryResults starts a page of results. more is whether
+//the query found records past the end of the page.
+func NewQueryResults(name, query, record string, offset, limit int, more bool) *QueryResultsOut {
+	page := NewPage(offset, limit, 0)
+	out := &QueryResultsOut{Name: name, Query: query, Record: record, Offset: offset, Limit: limit, Previous: page.Previous}
+	if more {
+		next := offset + limit
+		out.Next = &next
+	}
+	return out
+}
+
+//ConvertQueryItems simplifies the items, keeping the IDs
+//so they can be found in Sierra.
+func ConvertQueryItems(in *ItemRecordsIn) []QueryItemOut {
+	out := []QueryItemOut{}
+	for i := range in.Entries {
+		item := &in.Entries[i]
+		converted := QueryItemOut{ItemRecordOut: *item.Convert()}
+		converted.ItemID, _ = strconv.Atoi(item.ID.String())
+		for _, bibID := range item.BibIDs {
+			if id, err := strconv.Atoi(bibID.String()); err == nil {
+				converted.BibIDs = append(converted.BibIDs, id)
+			}
+		}
+		out = append(out, converted)
+	}
+	return out
+}
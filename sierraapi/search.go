@@ -0,0 +1,56 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+const (
+	//API Endpoint for keyword searches of bibs
+	BibSearchEndpoint string = "bibs/search"
+)
+
+//The indexes a search can be limited to. Keyword searches everything.
+var SearchIndexes = map[string]string{
+	"keyword": "",
+	"title":   "title",
+	"author":  "author",
+	"subject": "subject",
+}
+
+//BibSearchResultsIn is one page of results from a bib search,
+//ranked by relevance.
+type BibSearchResultsIn struct {
+	Count   int `json:"count"`
+	Total   int `json:"total"`
+	Start   int `json:"start"`
+	Entries []struct {
+		Relevance float64     `json:"relevance"`
+		Bib       BibRecordIn `json:"bib"`
+	} `json:"entries"`
+}
+
+//SearchResultsOut is a page of search results.
+type SearchResultsOut struct {
+	Query string
+	Field string
+	Page
+	Entries BibRecordsOut
+}
+
+//Convert simplifies the bibs, leaving out any suppressed or deleted.
+func (in *BibSearchResultsIn) Convert(query, field string, limit int) *SearchResultsOut {
+	out := &SearchResultsOut{
+		Query:   query,
+		Field:   field,
+		Page:    NewPage(in.Start, limit, in.Total),
+		Entries: BibRecordsOut{},
+	}
+	for i := range in.Entries {
+		bib := &in.Entries[i].Bib
+		if bib.Deleted || bib.Suppressed {
+			continue
+		}
+		out.Entries = append(out.Entries, *bib.Convert())
+	}
+	return out
+}
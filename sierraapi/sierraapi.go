@@ -5,10 +5,16 @@
 package sierraapi
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/cudevmaxwell/tyro/callnumber"
 	l "github.com/cudevmaxwell/tyro/loglevel"
+	"io"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
@@ -21,22 +27,70 @@ const (
 	TokenRequestEndpoint string = "token"
 	BibRequestEndpoint   string = "bibs"
 	ItemRequestEndpoint  string = "items"
+
+	PatronValidateEndpoint string = "patrons/validate"
+	PatronFindEndpoint     string = "patrons/find"
+
+	//The most bib IDs we will put in a single items request.
+	MaxBibIDsPerRequest int = 50
+
+	//The number of item records asked for in each page of results.
+	ItemsPerPage int = 200
+
+	//The number of bib records asked for in each page of results.
+	BibsPerPage int = 200
+
+	//The error code Sierra uses when circulation refuses a request,
+	//like a hold which can't be placed.
+	XCircErrorCode int = 132
+)
+
+var (
+	//Returned by GetJSON when the Sierra API rejects the token.
+	ErrUnauthorized = errors.New("Token is out of date, or is refreshing.")
+
+	//Returned by GetJSON when the Sierra API has no matching records.
+	ErrNotFound = errors.New("No records found.")
 )
 
 type ItemRecordIn struct {
-	CallNumber string `json:"callNumber"`
-	Status     struct {
-		DueDate time.Time `json:"duedate"`
-	} `json:"status"`
-	Location struct {
-		Name string `json:"name"`
-	} `json:"location"`
+	ID         json.Number   `json:"id"`
+	BibIDs     []json.Number `json:"bibIds"`
+	CallNumber string        `json:"callNumber"`
+	Status     ItemStatusIn  `json:"status"`
+	Location   CodedValue    `json:"location"`
+	Suppressed bool          `json:"suppressed"`
+}
+
+type ItemStatusIn struct {
+	Code    string    `json:"code"`
+	Display string    `json:"display"`
+	DueDate time.Time `json:"duedate"`
 }
 
 type ItemRecordOut struct {
-	CallNumber string
-	Status     string
-	Location   string
+	CallNumber     string
+	CallNumberSort string
+	Status         string
+	Availability   string
+	Location       string
+	LocationCode   string
+	Branch         string
+	Floor          string
+	MapURL         string
+	NonCirculating bool
+	DueDate        time.Time `json:"-"`
+}
+
+type byShelfOrder []ItemRecordOut
+
+func (b byShelfOrder) Len() int           { return len(b) }
+func (b byShelfOrder) Less(i, j int) bool { return b[i].CallNumberSort < b[j].CallNumberSort }
+func (b byShelfOrder) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+//TotalIn is the size of a list of records, without the records.
+type TotalIn struct {
+	Total int `json:"total"`
 }
 
 type ItemRecordsIn struct {
@@ -45,55 +99,146 @@ type ItemRecordsIn struct {
 
 type ItemRecordsOut struct {
 	Entries []ItemRecordOut
+	Summary *AvailabilitySummary `json:",omitempty"`
 }
 
 func (in *ItemRecordIn) Convert() *ItemRecordOut {
 
 	out := new(ItemRecordOut)
-	out.CallNumber = in.CallNumber
-	out.CallNumber = strings.Replace(out.CallNumber, "|a", " ", -1)
-	out.CallNumber = strings.Replace(out.CallNumber, "|b", " ", -1)
-	out.CallNumber = strings.TrimSpace(out.CallNumber)
-	if in.Status.DueDate.IsZero() {
+	callNumber := callnumber.Parse(in.CallNumber)
+	out.CallNumber = callNumber.Display
+	out.CallNumberSort = callNumber.SortKey()
+	status, known := LookupItemStatus(in.Status.Code)
+	switch {
+	case !in.Status.DueDate.IsZero():
+		out.Status = FormatDueDate(in.Status.DueDate)
+		out.Availability = Unavailable
+		out.DueDate = in.Status.DueDate
+	case known:
+		out.Status = status.Label
+		out.Availability = status.Availability
+	case in.Status.Display != "":
+		//A code missing from the table, use Sierra's own text.
+		out.Status = in.Status.Display
+		out.Availability = Unavailable
+	default:
 		out.Status = "In Library"
-	} else {
-		out.Status = "Due " + in.Status.DueDate.Format("January 2, 2006")
+		out.Availability = Available
 	}
+	out.LocationCode = strings.TrimSpace(in.Location.Code)
 	out.Location = in.Location.Name
+	if location, ok := LookupLocation(out.LocationCode); ok {
+		if location.Name != "" {
+			out.Location = location.Name
+		}
+		out.Branch = location.Branch
+		out.Floor = location.Floor
+		out.MapURL = location.MapURL
+		out.NonCirculating = location.NonCirculating
+	}
 
 	return out
 }
 
+//Convert simplifies the items, and puts them in shelf order.
 func (in *ItemRecordsIn) Convert() *ItemRecordsOut {
 	out := new(ItemRecordsOut)
 	for _, itemRecord := range in.Entries {
 		out.Entries = append(out.Entries, *itemRecord.Convert())
 	}
+	sort.Stable(byShelfOrder(out.Entries))
 
 	return out
 }
 
 type BibRecordIn struct {
-	ID   int `json:"id"`
-	CreatedDate time.Time `json:"createdDate"`
-	Marc struct {
-		Fields []struct {
-			Data struct {
-				Subfields []struct {
-					Code string `json:"code"`
-					Data string `json:"data"`
-				} `json:"subfields"`
-			} `json:"data"`
-			Tag string `json:"tag"`
-		} `json:"fields"`
-		Leader string `json:"leader"`
-	} `json:"marc"`
+	ID           int          `json:"id"`
+	Title        string       `json:"title"`
+	Author       string       `json:"author"`
+	CreatedDate  time.Time    `json:"createdDate"`
+	Lang         CodedValue   `json:"lang"`
+	MaterialType FixedValue   `json:"materialType"`
+	BibLevel     FixedValue   `json:"bibLevel"`
+	Locations    []CodedValue `json:"locations"`
+	Deleted      bool         `json:"deleted"`
+	Suppressed   bool         `json:"suppressed"`
+	Marc         Marc         `json:"marc"`
+}
+
+//A Sierra code, like a location, language or material type,
+//with its display name.
+type CodedValue struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+//A Sierra code from a fixed field, like a material type or
+//bib level, with its display value.
+type FixedValue struct {
+	Code  string `json:"code"`
+	Value string `json:"value"`
+}
+
+//BibFilter narrows a list of bibs to those in one of the Locations,
+//with one of the MaterialTypes, BibLevels and Languages.
+//An empty list matches everything.
+type BibFilter struct {
+	Locations     []string
+	MaterialTypes []string
+	BibLevels     []string
+	Languages     []string
+}
+
+//IsEmpty reports whether the filter would match every bib.
+func (f *BibFilter) IsEmpty() bool {
+	return len(f.Locations) == 0 && len(f.MaterialTypes) == 0 && len(f.BibLevels) == 0 && len(f.Languages) == 0
+}
+
+//Matches reports whether the bib passes the filter.
+func (f *BibFilter) Matches(in *BibRecordIn) bool {
+
+	matchesOne := func(allowed []string, code string) bool {
+		if len(allowed) == 0 {
+			return true
+		}
+		for _, a := range allowed {
+			if strings.TrimSpace(a) == strings.TrimSpace(code) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !matchesOne(f.MaterialTypes, in.MaterialType.Code) ||
+		!matchesOne(f.BibLevels, in.BibLevel.Code) ||
+		!matchesOne(f.Languages, in.Lang.Code) {
+		return false
+	}
+
+	if len(f.Locations) == 0 {
+		return true
+	}
+	for _, location := range in.Locations {
+		if matchesOne(f.Locations, location.Code) {
+			return true
+		}
+	}
+	return false
 }
 
 type BibRecordOut struct {
 	BibID           int
 	TitleAndAuthor  string
+	Title           string
+	Subtitle        string
+	Responsibility  string
+	Edition         string
+	Publisher       string
+	PublicationDate string
+	Subjects        []string
+	Series          []string
 	ISBNs           []string
+	ISBNDetails     []ISBNOut
 	CreatedDate     time.Time
 }
 
@@ -123,29 +268,23 @@ func (records BibRecordsOut) Swap(i, j int) {
 func (in *BibRecordIn) Convert() *BibRecordOut {
 
 	out := new(BibRecordOut)
-   
-    out.BibID = in.ID
-    out.CreatedDate = in.CreatedDate
-
-    for _, field := range in.Marc.Fields {
-    	if field.Tag == "245" {
-    		for _, subfield := range field.Data.Subfields {
-    			out.TitleAndAuthor += subfield.Data
-    		}
-    	}
-    	if field.Tag == "020" {
-    		for _, subfield := range field.Data.Subfields {
-    			if subfield.Code == "a"{
-    				isbnField := strings.Split(subfield.Data, " ")
-    				if len(isbnField) > 1 {
-    					out.ISBNs = append(out.ISBNs, isbnField[0])
-    				} else {
-            	        out.ISBNs = append(out.ISBNs, subfield.Data)
-    				}
-    			}
-    		}
-    	}	
-    }
+
+	out.BibID = in.ID
+	out.CreatedDate = in.CreatedDate
+
+	if field, ok := in.Marc.Field("245"); ok {
+		out.TitleAndAuthor = field.Text("a", "b", "f", "g", "k", "n", "p", "s", "c")
+	}
+	out.Title = in.Marc.TitleProper()
+	out.Subtitle = in.Marc.Subtitle()
+	out.Responsibility = in.Marc.Responsibility()
+	out.Edition = in.Marc.Edition()
+	out.Publisher = in.Marc.Publisher()
+	out.PublicationDate = in.Marc.PublicationDate()
+	out.Subjects = in.Marc.Subjects()
+	out.Series = in.Marc.Series()
+	out.ISBNs = in.Marc.ISBNs()
+	out.ISBNDetails = in.Marc.ISBNDetails()
 
 	return out
 }
@@ -160,15 +299,108 @@ func (in *BibRecordsIn) Convert() *BibRecordsOut {
 
 func SendRequestToAPI(apiURL, token string, w http.ResponseWriter, r *http.Request) (*http.Response, error) {
 
-	l.Log(fmt.Sprintf("Sending request %v to Sierra API with token %v", apiURL, token), l.TraceMessage)
+	resp, err := doRequest("GET", apiURL, token, nil, r)
+	if err != nil {
+		http.Error(w, "Error querying Sierra API.", http.StatusInternalServerError)
+		return resp, err
+	}
+	l.Log(fmt.Sprintf("Sending response %#v back to caller", resp), l.TraceMessage)
+	return resp, nil
+
+}
+
+//GetJSON sends a GET request to the Sierra API and decodes the
+//JSON response into v. Unlike SendRequestToAPI, it doesn't write
+//errors to a ResponseWriter, so it can be used outside of a handler.
+//The incoming request r is used for the X-Forwarded-For header, and may be nil.
+func GetJSON(apiURL, token string, r *http.Request, v interface{}) error {
+	return SendJSON("GET", apiURL, token, r, nil, v)
+}
+
+//SendJSON sends a request to the Sierra API with body encoded as JSON,
+//and decodes the JSON response into v. body and v may be nil.
+//If Sierra responds with an error, it is returned as an *APIError,
+//except for ErrUnauthorized and ErrNotFound.
+func SendJSON(method, apiURL, token string, r *http.Request, body, v interface{}) error {
+
+	var encoded io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		encoded = bytes.NewReader(b)
+	}
+
+	resp, err := doRequest(method, apiURL, token, encoded, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := new(APIError)
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Name == "" {
+			return fmt.Errorf("Sierra API returned %v", resp.Status)
+		}
+		apiErr.HTTPStatus = resp.StatusCode
+		return apiErr
+	}
+
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//An error response from the Sierra API.
+type APIError struct {
+	Code         int    `json:"code"`
+	SpecificCode int    `json:"specificCode"`
+	HTTPStatus   int    `json:"httpStatus"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+}
+
+func (e *APIError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("Sierra API error %v: %v", e.HTTPStatus, e.Name)
+	}
+	return fmt.Sprintf("Sierra API error %v: %v, %v", e.HTTPStatus, e.Name, e.Description)
+}
+
+//Refused is true if Sierra's circulation rules wouldn't allow the
+//request, like a renewal past the limit. The Description is then safe
+//to show to patrons. Other errors can have internal details in the
+//Description, so patrons should get a general message instead.
+func (e *APIError) Refused() bool {
+	return e.Code == XCircErrorCode
+}
+
+//Rejected is true if Sierra wouldn't accept the request, like a bad parameter.
+func (e *APIError) Rejected() bool {
+	return e.HTTPStatus >= 400 && e.HTTPStatus < 500
+}
+
+func doRequest(method, apiURL, token string, body io.Reader, r *http.Request) (*http.Response, error) {
 
-	req, err := http.NewRequest("GET", apiURL, nil)
+	l.Log(fmt.Sprintf("Sending %v request %v to Sierra API with token %v", method, apiURL, token), l.TraceMessage)
+
+	req, err := http.NewRequest(method, apiURL, body)
 	if err != nil {
-		http.Error(w, "Request failed.", http.StatusInternalServerError)
 		return new(http.Response), err
 	}
 
-        req.Close = true
+	req.Close = true
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	err = SetAuthorizationHeaders(req, r, token)
 	if err != nil {
@@ -176,22 +408,21 @@ func SendRequestToAPI(apiURL, token string, w http.ResponseWriter, r *http.Reque
 	}
 
 	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Error querying Sierra API.", http.StatusInternalServerError)
-		return resp, err
-	}
-	l.Log(fmt.Sprintf("Sending response %#v back to caller", resp), l.TraceMessage)
-	return resp, nil
-
+	return client.Do(req)
 }
 
 //Set the required Authorization headers.
 //This includes the Bearer token, User-Agent, and X-Forwarded-For
+//The original request is nil when Tyro is making a request on its
+//own behalf, in which case there is no X-Forwarded-For to set.
 func SetAuthorizationHeaders(nr, or *http.Request, token string) error {
 	nr.Header.Add("Authorization", "Bearer "+token)
 	nr.Header.Add("User-Agent", "Tyro")
 
+	if or == nil {
+		return nil
+	}
+
 	originalForwardFor := or.Header.Get("X-Forwarded-For")
 	if originalForwardFor == "" {
 		ip, _, err := net.SplitHostPort(or.RemoteAddr)
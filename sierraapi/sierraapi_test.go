@@ -6,11 +6,15 @@ package sierraapi
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/cudevmaxwell/tyro/callnumber"
 	l "github.com/cudevmaxwell/tyro/loglevel"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
@@ -68,18 +72,16 @@ func TestItemRecordConvert(t *testing.T) {
 	//An example with an empty status
 	exampleIn := ItemRecordIn{
 		CallNumber: "|aJC578.R383|bG67 2007",
-		Status: struct {
-			DueDate time.Time "json:\"duedate\""
-		}{DueDate: time.Time{}},
-		Location: struct {
-			Name string "json:\"name\""
-		}{Name: "Floor 4 Books"},
+		Status:     ItemStatusIn{DueDate: time.Time{}},
+		Location:   CodedValue{Name: "Floor 4 Books"},
 	}
 
 	exampleOut := ItemRecordOut{
-		CallNumber: "JC578.R383 G67 2007",
-		Status:     "In Library",
-		Location:   "Floor 4 Books",
+		CallNumber:     "JC578.R383 G67 2007",
+		CallNumberSort: callnumber.SortKey("JC578.R383 G67 2007"),
+		Status:         "In Library",
+		Availability:   "available",
+		Location:       "Floor 4 Books",
 	}
 
 	if *exampleIn.Convert() != exampleOut {
@@ -90,18 +92,17 @@ func TestItemRecordConvert(t *testing.T) {
 	due, _ := time.Parse(time.RFC3339, "2014-11-13T09:00:00Z")
 	exampleIn = ItemRecordIn{
 		CallNumber: "|aPR6068.O93|bH372 1999   ",
-		Status: struct {
-			DueDate time.Time "json:\"duedate\""
-		}{DueDate: due},
-		Location: struct {
-			Name string "json:\"name\""
-		}{Name: "Floor 3 Books"},
+		Status:     ItemStatusIn{DueDate: due},
+		Location:   CodedValue{Name: "Floor 3 Books"},
 	}
 
 	exampleOut = ItemRecordOut{
-		CallNumber: "PR6068.O93 H372 1999",
-		Status:     "Due November 13, 2014",
-		Location:   "Floor 3 Books",
+		CallNumber:     "PR6068.O93 H372 1999",
+		CallNumberSort: callnumber.SortKey("PR6068.O93 H372 1999"),
+		Status:         "Due November 13, 2014",
+		Availability:   "unavailable",
+		Location:       "Floor 3 Books",
+		DueDate:        due,
 	}
 
 	if *exampleIn.Convert() != exampleOut {
@@ -118,21 +119,13 @@ func TestItemRecordsConvert(t *testing.T) {
 		Entries: []ItemRecordIn{
 			ItemRecordIn{
 				CallNumber: "|aJC578.R383|bG67 2007",
-				Status: struct {
-					DueDate time.Time "json:\"duedate\""
-				}{DueDate: time.Time{}},
-				Location: struct {
-					Name string "json:\"name\""
-				}{Name: "Floor 4 Books"},
+				Status:     ItemStatusIn{DueDate: time.Time{}},
+				Location:   CodedValue{Name: "Floor 4 Books"},
 			},
 			ItemRecordIn{
 				CallNumber: "|aPR6068.O93|bH372 1999   ",
-				Status: struct {
-					DueDate time.Time "json:\"duedate\""
-				}{DueDate: due},
-				Location: struct {
-					Name string "json:\"name\""
-				}{Name: "Floor 3 Books"},
+				Status:     ItemStatusIn{DueDate: due},
+				Location:   CodedValue{Name: "Floor 3 Books"},
 			},
 		},
 	}
@@ -140,14 +133,19 @@ func TestItemRecordsConvert(t *testing.T) {
 	exampleOut := ItemRecordsOut{
 		Entries: []ItemRecordOut{
 			ItemRecordOut{
-				CallNumber: "JC578.R383 G67 2007",
-				Status:     "In Library",
-				Location:   "Floor 4 Books",
+				CallNumber:     "JC578.R383 G67 2007",
+				CallNumberSort: callnumber.SortKey("JC578.R383 G67 2007"),
+				Status:         "In Library",
+				Availability:   "available",
+				Location:       "Floor 4 Books",
 			},
 			ItemRecordOut{
-				CallNumber: "PR6068.O93 H372 1999",
-				Status:     "Due November 13, 2014",
-				Location:   "Floor 3 Books",
+				CallNumber:     "PR6068.O93 H372 1999",
+				CallNumberSort: callnumber.SortKey("PR6068.O93 H372 1999"),
+				Status:         "Due November 13, 2014",
+				Availability:   "unavailable",
+				Location:       "Floor 3 Books",
+				DueDate:        due,
 			},
 		},
 	}
@@ -228,3 +226,912 @@ func TestSendRequestToAPISuccess(t *testing.T) {
 		t.Error("Expected to get back the correct body.")
 	}
 }
+
+func TestGetJSON(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-For") != "" {
+			t.Error("GetJSON shouldn't set X-Forwarded-For without an incoming request.")
+		}
+		switch r.URL.Path {
+		case "/unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprintln(w, `{"callNumber":"|aJC578.R383|bG67 2007"}`)
+		}
+	}))
+	defer ts.Close()
+
+	var item ItemRecordIn
+	if err := GetJSON(ts.URL+"/item", "token", nil, &item); err != nil {
+		t.Errorf("Didn't expect a fail on a good request, %v", err)
+	}
+	if item.CallNumber != "|aJC578.R383|bG67 2007" {
+		t.Error("GetJSON didn't decode the response.")
+	}
+
+	if err := GetJSON(ts.URL+"/unauthorized", "token", nil, &item); err != ErrUnauthorized {
+		t.Error("Expected ErrUnauthorized.")
+	}
+	if err := GetJSON(ts.URL+"/notfound", "token", nil, &item); err != ErrNotFound {
+		t.Error("Expected ErrNotFound.")
+	}
+	if err := GetJSON(ts.URL+"/broken", "token", nil, &item); err == nil {
+		t.Error("Expected an error on an InternalServerError from Sierra.")
+	}
+	if err := GetJSON(":", "token", nil, &item); err == nil {
+		t.Error("Should have failed with bad URL")
+	}
+}
+
+func TestBibFilterMatches(t *testing.T) {
+
+	bib := BibRecordIn{
+		Lang:         CodedValue{Code: "eng"},
+		MaterialType: FixedValue{Code: "g"},
+		BibLevel:     FixedValue{Code: "m"},
+		Locations:    []CodedValue{CodedValue{Code: "flr4 "}, CodedValue{Code: "mu"}},
+	}
+
+	tests := []struct {
+		filter  BibFilter
+		matches bool
+	}{
+		{BibFilter{}, true},
+		{BibFilter{Locations: []string{"mu"}}, true},
+		{BibFilter{Locations: []string{"flr4"}}, true},
+		{BibFilter{Locations: []string{"res"}}, false},
+		{BibFilter{MaterialTypes: []string{"a", "g"}}, true},
+		{BibFilter{MaterialTypes: []string{"a"}}, false},
+		{BibFilter{BibLevels: []string{"s"}}, false},
+		{BibFilter{Languages: []string{"eng"}, Locations: []string{"mu"}, BibLevels: []string{"m"}}, true},
+		{BibFilter{Languages: []string{"fre"}, Locations: []string{"mu"}}, false},
+	}
+
+	for _, test := range tests {
+		if test.filter.Matches(&bib) != test.matches {
+			t.Errorf("Expected filter %+v to return %v", test.filter, test.matches)
+		}
+	}
+
+	if !(&BibFilter{}).IsEmpty() || (&BibFilter{Languages: []string{"eng"}}).IsEmpty() {
+		t.Error("IsEmpty() is wrong.")
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Error("SendJSON should POST a JSON body.")
+		}
+		var body struct {
+			Barcode string `json:"barcode"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body.Barcode {
+		case "good":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `{"code":108,"specificCode":0,"httpStatus":400,"name":"Invalid parameter","description":"Invalid barcode or PIN"}`)
+		}
+	}))
+	defer ts.Close()
+
+	if err := SendJSON("POST", ts.URL, "token", nil, map[string]string{"barcode": "good"}, nil); err != nil {
+		t.Errorf("Didn't expect a fail on a good request, %v", err)
+	}
+
+	err := SendJSON("POST", ts.URL, "token", nil, map[string]string{"barcode": "bad"}, nil)
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("Expected an *APIError, got %v", err)
+	}
+	if apiErr.HTTPStatus != http.StatusBadRequest || apiErr.Description != "Invalid barcode or PIN" {
+		t.Errorf("APIError not decoded properly, %+v", apiErr)
+	}
+	if apiErr.Refused() || !apiErr.Rejected() {
+		t.Error("Only XCirc errors should be refusals, a bad parameter is rejected.")
+	}
+	if xcirc := (&APIError{Code: XCircErrorCode, HTTPStatus: 500}); !xcirc.Refused() || xcirc.Rejected() {
+		t.Error("An XCirc error should be a refusal.")
+	}
+}
+
+func TestIDFromLink(t *testing.T) {
+	tests := map[string]int{
+		"https://sandbox.iii.com/iii/sierra-api/v1/items/1234567":  1234567,
+		"https://sandbox.iii.com/iii/sierra-api/v1/items/1234567/": 1234567,
+		"1234567": 1234567,
+		"":        0,
+		"https://sandbox.iii.com/iii/sierra-api/v1/items/": 0,
+	}
+	for link, id := range tests {
+		if IDFromLink(link) != id {
+			t.Errorf("IDFromLink(%q) should return %v", link, id)
+		}
+	}
+}
+
+func TestCheckoutsConvert(t *testing.T) {
+
+	due, _ := time.Parse(time.RFC3339, "2014-11-13T09:00:00Z")
+
+	exampleIn := CheckoutsIn{
+		Entries: []CheckoutIn{
+			CheckoutIn{
+				ID:               "https://example.com/v2/patrons/checkouts/111",
+				Item:             "https://example.com/v2/items/2536252",
+				CallNumber:       "|aJC578.R383|bG67 2007",
+				DueDate:          due,
+				NumberOfRenewals: 1,
+			},
+			CheckoutIn{
+				ID:               "https://example.com/v2/patrons/checkouts/112",
+				Item:             "https://example.com/v2/items/2536253",
+				DueDate:          due,
+				NumberOfRenewals: 3,
+			},
+		},
+	}
+
+	out := exampleIn.Convert(3)
+	if len(out.Entries) != 2 {
+		t.Fatal("Expected two converted checkouts.")
+	}
+	renewable := true
+	if !reflect.DeepEqual(out.Entries[0], CheckoutOut{CheckoutID: 111, ItemID: 2536252, CallNumber: "JC578.R383 G67 2007",
+		Due: "Due November 13, 2014", DueDate: due, Renewals: 1, Renewable: &renewable}) {
+		t.Errorf("Unexpected checkout %+v", out.Entries[0])
+	}
+	if out.Entries[1].Renewable == nil || *out.Entries[1].Renewable {
+		t.Error("A checkout renewed the maximum number of times shouldn't be renewable.")
+	}
+	for _, checkout := range exampleIn.Convert(0).Entries {
+		if checkout.Renewable != nil {
+			t.Error("With no maximum, whether a checkout is renewable isn't known.")
+		}
+	}
+}
+
+func TestFinesConvert(t *testing.T) {
+
+	exampleIn := FinesIn{
+		Entries: []FineIn{
+			FineIn{ID: "https://example.com/v2/patrons/fines/1", Item: "https://example.com/v2/items/2536252",
+				ItemCharge: 1.5, ProcessingFee: 0.5, PaidAmount: 1},
+			FineIn{ID: "https://example.com/v2/patrons/fines/2", BillingFee: 2.25},
+		},
+	}
+
+	out := exampleIn.Convert()
+	if len(out.Entries) != 2 || out.Entries[0].AmountOwed != 1 || out.Entries[1].ItemID != 0 {
+		t.Errorf("Unexpected fines %+v", out.Entries)
+	}
+	if out.TotalOwed != 3.25 {
+		t.Errorf("Expected a total of 3.25, got %v", out.TotalOwed)
+	}
+
+	//0.1 + 0.2 is 0.30000000000000004 in floating point.
+	inexact := FinesIn{
+		Entries: []FineIn{
+			FineIn{ItemCharge: 0.1, ProcessingFee: 0.2},
+			FineIn{ItemCharge: 0.7, BillingFee: 0.1, PaidAmount: 0.6},
+			FineIn{ItemCharge: 0.1},
+		},
+	}
+	out = inexact.Convert()
+	if out.Entries[0].AmountOwed != 0.3 || out.Entries[1].AmountOwed != 0.2 || out.TotalOwed != 0.6 {
+		t.Errorf("Expected amounts of 0.3 and 0.2, and a total of 0.6, got %+v", out)
+	}
+	if b, _ := json.Marshal(out); !strings.Contains(string(b), `"AmountOwed":0.3}`) || !strings.Contains(string(b), `"TotalOwed":0.6}`) {
+		t.Errorf("Unexpected JSON %v", string(b))
+	}
+}
+
+func TestItemRecordConvertStatusCodes(t *testing.T) {
+
+	due, _ := time.Parse(time.RFC3339, "2014-11-13T09:00:00Z")
+
+	tests := []struct {
+		status       ItemStatusIn
+		label        string
+		availability string
+	}{
+		{ItemStatusIn{Code: "-", Display: "AVAILABLE"}, "In Library", Available},
+		{ItemStatusIn{Code: "-", Display: "AVAILABLE", DueDate: due}, "Due November 13, 2014", Unavailable},
+		{ItemStatusIn{Code: "m", Display: "MISSING"}, "Missing", Unavailable},
+		{ItemStatusIn{Code: "!", Display: "ON HOLDSHELF"}, "On Holdshelf", Unavailable},
+		{ItemStatusIn{Code: "o", Display: "LIB USE ONLY"}, "Library Use Only", Limited},
+		{ItemStatusIn{Code: "%", Display: "ILL"}, "ILL", Unavailable},
+	}
+
+	for _, test := range tests {
+		in := ItemRecordIn{Status: test.status}
+		out := in.Convert()
+		if out.Status != test.label || out.Availability != test.availability {
+			t.Errorf("Status %+v converted to %v %v, expected %v %v", test.status, out.Status, out.Availability, test.label, test.availability)
+		}
+	}
+}
+
+func TestLoadItemStatuses(t *testing.T) {
+
+	defer SetItemStatuses(DefaultItemStatuses)
+
+	write := func(contents string) string {
+		f, err := ioutil.TempFile("", "itemstatuses")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		f.WriteString(contents)
+		return f.Name()
+	}
+
+	good := write(`{"m": {"label": "Ask at the desk", "availability": "limited"}, "%": {"label": "Interlibrary Loan", "availability": "unavailable"}}`)
+	defer os.Remove(good)
+
+	if err := LoadItemStatuses(good); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := LookupItemStatus("m"); status.Label != "Ask at the desk" || status.Availability != Limited {
+		t.Errorf("LoadItemStatuses didn't replace a default status, got %+v", status)
+	}
+	if status, _ := LookupItemStatus("%"); status.Label != "Interlibrary Loan" {
+		t.Errorf("LoadItemStatuses didn't add a new status, got %+v", status)
+	}
+	if _, ok := LookupItemStatus("-"); !ok {
+		t.Error("LoadItemStatuses should keep the defaults.")
+	}
+
+	bad := write(`{"m": {"label": "Missing", "availability": "sometimes"}}`)
+	defer os.Remove(bad)
+	if err := LoadItemStatuses(bad); err == nil {
+		t.Error("LoadItemStatuses should reject an unknown availability.")
+	}
+
+	broken := write(`{"m": `)
+	defer os.Remove(broken)
+	if err := LoadItemStatuses(broken); err == nil {
+		t.Error("LoadItemStatuses should reject a broken file.")
+	}
+
+	if err := LoadItemStatuses("/does/not/exist.json"); err == nil {
+		t.Error("LoadItemStatuses should fail on a missing file.")
+	}
+}
+
+func TestItemRecordsSummarize(t *testing.T) {
+
+	due, _ := time.Parse(time.RFC3339, "2014-11-13T09:00:00Z")
+	later, _ := time.Parse(time.RFC3339, "2014-12-13T09:00:00Z")
+
+	items := ItemRecordsOut{
+		Entries: []ItemRecordOut{
+			ItemRecordOut{Location: "Floor 4 Books", Availability: Available},
+			ItemRecordOut{Location: "Floor 4 Books", Availability: Unavailable, DueDate: later},
+			ItemRecordOut{Location: "Reserves", Availability: Limited},
+			ItemRecordOut{Location: "Floor 4 Books", Availability: Available},
+			ItemRecordOut{Location: "Reserves", Availability: Unavailable, DueDate: due},
+		},
+	}
+
+	summary := items.Summarize()
+	if summary.Total != 5 || summary.Available != 2 || summary.Limited != 1 {
+		t.Errorf("Unexpected counts in %+v", summary)
+	}
+	if summary.EarliestDueDate == nil || !summary.EarliestDueDate.Equal(due) || summary.EarliestDue != "Due November 13, 2014" {
+		t.Errorf("Unexpected earliest due date in %+v", summary)
+	}
+	expected := []LocationSummary{
+		LocationSummary{Location: "Floor 4 Books", Total: 3, Available: 2},
+		LocationSummary{Location: "Reserves", Total: 2, Available: 0},
+	}
+	if !reflect.DeepEqual(summary.Locations, expected) {
+		t.Errorf("Unexpected locations %+v", summary.Locations)
+	}
+
+	empty := (&ItemRecordsOut{}).Summarize()
+	if empty.Total != 0 || empty.EarliestDueDate != nil {
+		t.Errorf("Unexpected summary of no items %+v", empty)
+	}
+}
+
+func TestItemRecordConvertLocations(t *testing.T) {
+
+	defer SetLocations(make(map[string]Location))
+
+	f, err := ioutil.TempFile("", "locations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"flr4 ": {"name": "Fourth Floor Books", "branch": "Main Library", "floor": "4", "mapURL": "https://library.example.com/maps/4"},
+		"ref": {"branch": "Main Library", "nonCirculating": true}}`)
+	f.Close()
+
+	if err := LoadLocations(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	in := ItemRecordIn{Location: CodedValue{Code: "flr4 ", Name: "4th flr Bks"}}
+	out := in.Convert()
+	if out.Location != "Fourth Floor Books" || out.LocationCode != "flr4" || out.Branch != "Main Library" ||
+		out.Floor != "4" || out.MapURL != "https://library.example.com/maps/4" || out.NonCirculating {
+		t.Errorf("Location not mapped properly, got %+v", out)
+	}
+
+	//Without a public name, the Sierra name is kept.
+	in = ItemRecordIn{Location: CodedValue{Code: "ref", Name: "Reference"}}
+	out = in.Convert()
+	if out.Location != "Reference" || !out.NonCirculating {
+		t.Errorf("Location not mapped properly, got %+v", out)
+	}
+
+	//Codes missing from the table fall back to the Sierra name.
+	in = ItemRecordIn{Location: CodedValue{Code: "mu", Name: "Music Library"}}
+	out = in.Convert()
+	if out.Location != "Music Library" || out.Branch != "" {
+		t.Errorf("Location not mapped properly, got %+v", out)
+	}
+
+	if err := LoadLocations("/does/not/exist.json"); err == nil {
+		t.Error("LoadLocations should fail on a missing file.")
+	}
+}
+
+func TestItemRecordsConvertShelfOrder(t *testing.T) {
+
+	exampleIn := ItemRecordsIn{
+		Entries: []ItemRecordIn{
+			ItemRecordIn{CallNumber: "|aQA76.73.G63|bD66 2016 v.10"},
+			ItemRecordIn{CallNumber: "|aQA76.73.G63|bD66 2016 v.2 c.2"},
+			ItemRecordIn{CallNumber: "|aQA76.73.G63|bD66 2016 v.2"},
+			ItemRecordIn{CallNumber: "|aQA76.73.G63|bD66 2016"},
+		},
+	}
+
+	expected := []string{
+		"QA76.73.G63 D66 2016",
+		"QA76.73.G63 D66 2016 v.2",
+		"QA76.73.G63 D66 2016 v.2 c.2",
+		"QA76.73.G63 D66 2016 v.10",
+	}
+
+	out := exampleIn.Convert()
+	for i, callNumber := range expected {
+		if out.Entries[i].CallNumber != callNumber {
+			t.Errorf("Entry %v is %q, expected %q", i, out.Entries[i].CallNumber, callNumber)
+		}
+	}
+}
+
+const exampleMarcJSON = `{
+	"leader": "00000cam  2200000 a 4500",
+	"fields": [
+		{"tag": "001", "data": "ocm12345678"},
+		{"tag": "008", "data": "070321s2007    nyu      b    001 0 eng  "},
+		{"tag": "020", "data": {"ind1": " ", "ind2": " ", "subfields": [{"code": "a", "data": "9780521875646 (hbk.)"}]}},
+		{"tag": "020", "data": {"ind1": " ", "ind2": " ", "subfields": [{"code": "a", "data": "0521875641"}]}},
+		{"tag": "245", "data": {"ind1": "1", "ind2": "0", "subfields": [
+			{"code": "a", "data": "Dangerous nation :"},
+			{"code": "b", "data": "America's place in the world /"},
+			{"code": "c", "data": "Robert Kagan."}]}},
+		{"tag": "250", "data": {"ind1": " ", "ind2": " ", "subfields": [{"code": "a", "data": "1st ed."}]}},
+		{"tag": "264", "data": {"ind1": " ", "ind2": "1", "subfields": [
+			{"code": "a", "data": "New York :"},
+			{"code": "b", "data": "Alfred A. Knopf,"},
+			{"code": "c", "data": "2006."}]}},
+		{"tag": "490", "data": {"ind1": "1", "ind2": " ", "subfields": [{"code": "a", "data": "American histories ;"}, {"code": "v", "data": "v. 1"}]}},
+		{"tag": "650", "data": {"ind1": " ", "ind2": "0", "subfields": [
+			{"code": "a", "data": "United States"},
+			{"code": "x", "data": "Foreign relations"},
+			{"code": "y", "data": "1783-1815."}]}},
+		{"tag": "650", "data": {"ind1": " ", "ind2": "0", "subfields": [{"code": "a", "data": "Imperialism."}]}}
+	]
+}`
+
+func TestMarcUnmarshal(t *testing.T) {
+
+	var m Marc
+	if err := json.Unmarshal([]byte(exampleMarcJSON), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Leader != "00000cam  2200000 a 4500" || len(m.Fields) != 10 {
+		t.Fatalf("Unexpected record %+v", m)
+	}
+	if m.ControlField("001") != "ocm12345678" || !m.Fields[0].IsControl() {
+		t.Error("Control field not decoded.")
+	}
+	field, ok := m.Field("245")
+	if !ok || field.Ind1 != "1" || field.Ind2 != "0" || len(field.Subfields) != 3 || field.IsControl() {
+		t.Errorf("Data field not decoded, %+v", field)
+	}
+	if field.Subfield("b") != "America's place in the world /" || field.Subfield("z") != "" {
+		t.Error("Subfield() returned the wrong value.")
+	}
+	if len(m.FieldsByTag("020", "650")) != 4 {
+		t.Error("FieldsByTag() returned the wrong fields.")
+	}
+
+	//Writing the record out and reading it back gives the same record.
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Marc
+	if err := json.Unmarshal(b, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, again) {
+		t.Errorf("Round trip through JSON changed the record, %v", string(b))
+	}
+}
+
+func TestMarcDescriptiveHelpers(t *testing.T) {
+
+	var m Marc
+	if err := json.Unmarshal([]byte(exampleMarcJSON), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"TitleProper":     m.TitleProper(),
+		"Subtitle":        m.Subtitle(),
+		"Responsibility":  m.Responsibility(),
+		"Edition":         m.Edition(),
+		"Publisher":       m.Publisher(),
+		"PublicationDate": m.PublicationDate(),
+	}
+	expected := map[string]string{
+		"TitleProper":     "Dangerous nation",
+		"Subtitle":        "America's place in the world",
+		"Responsibility":  "Robert Kagan",
+		"Edition":         "1st ed.",
+		"Publisher":       "Alfred A. Knopf",
+		"PublicationDate": "2006",
+	}
+	for name, value := range tests {
+		if value != expected[name] {
+			t.Errorf("%v() returned %q, expected %q", name, value, expected[name])
+		}
+	}
+
+	if !reflect.DeepEqual(m.Subjects(), []string{"United States -- Foreign relations -- 1783-1815", "Imperialism"}) {
+		t.Errorf("Unexpected subjects %q", m.Subjects())
+	}
+	if !reflect.DeepEqual(m.Series(), []string{"American histories ; v. 1"}) {
+		t.Errorf("Unexpected series %q", m.Series())
+	}
+	if !reflect.DeepEqual(m.ISBNs(), []string{"9780521875646", "0521875641"}) {
+		t.Errorf("Unexpected ISBNs %q", m.ISBNs())
+	}
+
+	//Without a 264 or 260, the date comes from the 008.
+	m.Fields = append(m.Fields[:6], m.Fields[7:]...)
+	if m.PublicationDate() != "2007" {
+		t.Errorf("PublicationDate() should fall back to the 008, got %q", m.PublicationDate())
+	}
+}
+
+func TestBibRecordConvert(t *testing.T) {
+
+	var in BibRecordIn
+	if err := json.Unmarshal([]byte(`{"id": 2536252, "marc": `+exampleMarcJSON+`}`), &in); err != nil {
+		t.Fatal(err)
+	}
+
+	out := in.Convert()
+	if out.BibID != 2536252 || out.Title != "Dangerous nation" || out.Publisher != "Alfred A. Knopf" || len(out.ISBNs) != 2 {
+		t.Errorf("Unexpected conversion %+v", out)
+	}
+	if out.TitleAndAuthor != "Dangerous nation : America's place in the world / Robert Kagan." {
+		t.Errorf("Unexpected TitleAndAuthor %q", out.TitleAndAuthor)
+	}
+}
+
+func TestCleanPunctuation(t *testing.T) {
+	tests := map[string]string{
+		"Dangerous nation :":  "Dangerous nation",
+		"Robert Kagan.":       "Robert Kagan",
+		"Smith, J.":           "Smith, J.",
+		"J.R.R. Tolkien.":     "J.R.R. Tolkien",
+		"2nd ed.":             "2nd ed.",
+		"Just say no.":        "Just say no",
+		"Oxford University, ": "Oxford University",
+		"":                    "",
+	}
+	for in, out := range tests {
+		if CleanPunctuation(in) != out {
+			t.Errorf("CleanPunctuation(%q) returned %q, expected %q", in, CleanPunctuation(in), out)
+		}
+	}
+}
+
+func TestBibRecordDetail(t *testing.T) {
+
+	in := BibRecordIn{ID: 2536252, MaterialType: FixedValue{Code: "a", Value: "BOOK"}}
+	if err := json.Unmarshal([]byte(exampleMarcJSON), &in.Marc); err != nil {
+		t.Fatal(err)
+	}
+	in.Marc.Fields = append(in.Marc.Fields,
+		MarcField{Tag: "035", Subfields: []MarcSubfield{{"a", "(OCoLC)ocm00012345"}}},
+		MarcField{Tag: "022", Subfields: []MarcSubfield{{"a", "1234-5678"}}},
+		MarcField{Tag: "100", Subfields: []MarcSubfield{{"a", "Kagan, Robert."}}},
+		MarcField{Tag: "700", Subfields: []MarcSubfield{{"a", "Kagan, Robert."}}},
+		MarcField{Tag: "700", Subfields: []MarcSubfield{{"a", "Smith, J.,"}, {"e", "editor."}}},
+		MarcField{Tag: "700", Subfields: []MarcSubfield{{"a", "Jones, A."}, {"t", "A related work."}}},
+		MarcField{Tag: "300", Subfields: []MarcSubfield{{"a", "xii, 300 p. :"}, {"b", "ill. ;"}, {"c", "24 cm."}}},
+		MarcField{Tag: "856", Subfields: []MarcSubfield{{"u", "https://example.com/a"}, {"3", "Table of contents"}}},
+	)
+
+	out := in.Detail()
+
+	if out.BibID != 2536252 || out.Title != "Dangerous nation" || out.Subtitle != "America's place in the world" {
+		t.Errorf("Unexpected titles %+v", out)
+	}
+	if !reflect.DeepEqual(out.Authors, []string{"Kagan, Robert", "Smith, J."}) {
+		t.Errorf("Unexpected authors %q", out.Authors)
+	}
+	if out.PublicationPlace != "New York" || out.Publisher != "Alfred A. Knopf" || out.PublicationDate != "2006" {
+		t.Errorf("Unexpected publication %+v", out)
+	}
+	if out.PhysicalDescription != "xii, 300 p. : ill. ; 24 cm" {
+		t.Errorf("Unexpected physical description %q", out.PhysicalDescription)
+	}
+	if out.OCLCNumber != "12345" || !reflect.DeepEqual(out.ISSNs, []string{"1234-5678"}) || len(out.ISBNs) != 2 {
+		t.Errorf("Unexpected identifiers %+v", out)
+	}
+	//Without Sierra's language, the language code comes from the 008.
+	if out.Language != "eng" || out.MaterialType != "BOOK" {
+		t.Errorf("Unexpected language or material type %+v", out)
+	}
+	if !reflect.DeepEqual(out.URLs, []URLOut{{"https://example.com/a", "Table of contents"}}) {
+		t.Errorf("Unexpected URLs %+v", out.URLs)
+	}
+
+	//A bib without a MARC record still has Sierra's title and author.
+	bare := BibRecordIn{ID: 1, Title: "A Title /", Author: "An Author."}
+	if out := bare.Detail(); out.Title != "A Title" || !reflect.DeepEqual(out.Authors, []string{"An Author"}) {
+		t.Errorf("Unexpected detail for a bib without MARC %+v", out)
+	}
+}
+
+func TestMarcISBNDetails(t *testing.T) {
+
+	m := Marc{Fields: []MarcField{
+		{Tag: "020", Subfields: []MarcSubfield{{"a", "0-521-87564-1 (pbk. : alk. paper)"}}},
+		{Tag: "020", Subfields: []MarcSubfield{{"a", "9780306406157"}, {"q", "hardcover ;"}}},
+		{Tag: "020", Subfields: []MarcSubfield{{"a", "9780521875646"}, {"q", "v. 2, pt. ;"}}},
+		{Tag: "020", Subfields: []MarcSubfield{{"a", "0521875642"}}},
+		{Tag: "020", Subfields: []MarcSubfield{{"z", "9780804429573 (ebook)"}}},
+	}}
+
+	expected := []ISBNOut{
+		{"0521875641", "0521875641", "9780521875646", "pbk. : alk. paper", true, false},
+		{"9780306406157", "0306406152", "9780306406157", "hardcover", true, false},
+		{"9780521875646", "0521875641", "9780521875646", "v. 2, pt.", true, false},
+		{"0521875642", "", "", "", false, false},
+		{"9780804429573", "080442957X", "9780804429573", "ebook", true, true},
+	}
+	if details := m.ISBNDetails(); !reflect.DeepEqual(details, expected) {
+		t.Errorf("Unexpected ISBN details %+v", details)
+	}
+
+	//Invalid and cancelled ISBNs are left out of the plain list.
+	if !reflect.DeepEqual(m.ISBNs(), []string{"0521875641", "9780306406157", "9780521875646"}) {
+		t.Errorf("Unexpected ISBNs %q", m.ISBNs())
+	}
+}
+
+func TestLookupNormalize(t *testing.T) {
+
+	tests := []struct {
+		kind, in, out string
+		ok            bool
+	}{
+		{"isbn", "0-521-87564-1", "9780521875646", true},
+		{"isbn", "0521875642", "", false},
+		{"issn", "1050124x", "1050-124X", true},
+		{"issn", "0378-5955", "0378-5955", true},
+		{"issn", "1234-5678", "", false},
+		{"issn", "123-45678", "", false},
+		{"oclc", "(OCoLC)ocm00012345", "12345", true},
+		{"oclc", "ocn123456789", "123456789", true},
+		{"oclc", "12345abc", "", false},
+	}
+	for _, test := range tests {
+		out, ok := Lookups[test.kind].Normalize(test.in)
+		if out != test.out || ok != test.ok {
+			t.Errorf("Normalizing %v %q returned %q, %v, expected %q, %v", test.kind, test.in, out, ok, test.out, test.ok)
+		}
+	}
+
+	bib := &BibRecordIn{Marc: Marc{Fields: []MarcField{
+		{Tag: "001", Value: "ocm00012345"},
+		{Tag: "022", Subfields: []MarcSubfield{{"a", "1050-124x"}}},
+	}}}
+	if !Lookups["oclc"].Matches(bib, "12345") || !Lookups["issn"].Matches(bib, "1050-124X") || Lookups["isbn"].Matches(bib, "9780521875646") {
+		t.Error("Matches() didn't check the MARC record.")
+	}
+}
+
+func TestAnyOf(t *testing.T) {
+
+	single := BarcodeQuery(" 39000000123456 ")
+	if query, ok := AnyOf(single).(Query); !ok || !reflect.DeepEqual(query, single) || query.Expr.Operands[0] != "39000000123456" {
+		t.Error("AnyOf() should return a single query as is.")
+	}
+
+	b, err := json.Marshal(AnyOf(Lookups["isbn"].Queries("9780521875646")...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"queries":[` +
+		`{"target":{"record":{"type":"bib"},"field":{"marcTag":"020","subfields":"a"}},"expr":{"op":"has","operands":["9780521875646"]}},"or",` +
+		`{"target":{"record":{"type":"bib"},"field":{"tag":"i"}},"expr":{"op":"has","operands":["9780521875646"]}},"or",` +
+		`{"target":{"record":{"type":"bib"},"field":{"marcTag":"020","subfields":"a"}},"expr":{"op":"has","operands":["0521875641"]}},"or",` +
+		`{"target":{"record":{"type":"bib"},"field":{"tag":"i"}},"expr":{"op":"has","operands":["0521875641"]}}]}`
+	if string(b) != expected {
+		t.Errorf("Unexpected query %v", string(b))
+	}
+
+	var results QueryResultsIn
+	if err := json.Unmarshal([]byte(`{"total":2,"entries":[{"link":"https://sierra/v1/items/111"},{"link":"bad"}]}`), &results); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results.IDs(), []int{111}) {
+		t.Errorf("Unexpected IDs %v", results.IDs())
+	}
+}
+
+func TestNewPage(t *testing.T) {
+
+	intPtr := func(i int) *int { return &i }
+
+	tests := []struct {
+		offset, limit, total int
+		next, previous       *int
+	}{
+		{0, 20, 45, intPtr(20), nil},
+		{20, 20, 45, intPtr(40), intPtr(0)},
+		{40, 20, 45, nil, intPtr(20)},
+		{10, 20, 45, intPtr(30), intPtr(0)},
+		{0, 20, 0, nil, nil},
+	}
+	for _, test := range tests {
+		page := NewPage(test.offset, test.limit, test.total)
+		if !reflect.DeepEqual(page.Next, test.next) || !reflect.DeepEqual(page.Previous, test.previous) {
+			t.Errorf("NewPage(%v, %v, %v) returned next %v, previous %v", test.offset, test.limit, test.total, page.Next, page.Previous)
+		}
+	}
+}
+
+func TestTotalURL(t *testing.T) {
+
+	u, err := url.Parse("https://sierra/v1/bibs?deleted=false&limit=50&offset=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := TotalURL(u)
+	if total.Query().Get("limit") != "1" || total.Query().Get("offset") != "0" || total.Query().Get("deleted") != "false" {
+		t.Errorf("Unexpected total URL %v", total)
+	}
+	if u.Query().Get("limit") != "50" {
+		t.Error("TotalURL() shouldn't change the original URL.")
+	}
+}
+
+func TestBibSearchResultsConvert(t *testing.T) {
+
+	var in BibSearchResultsIn
+	err := json.Unmarshal([]byte(`{"count":3,"total":43,"start":20,"entries":[
+		{"relevance":0.9,"bib":{"id":1,"marc":{"fields":[{"tag":"245","data":{"subfields":[{"code":"a","data":"A Title /"}]}}]}}},
+		{"relevance":0.8,"bib":{"id":2,"suppressed":true}},
+		{"relevance":0.7,"bib":{"id":3}}]}`), &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := in.Convert("a title", "title", 20)
+	if out.Query != "a title" || out.Field != "title" || out.Total != 43 || out.Offset != 20 || *out.Next != 40 || *out.Previous != 0 {
+		t.Errorf("Unexpected results %+v", out)
+	}
+	if len(out.Entries) != 2 || out.Entries[0].BibID != 1 || out.Entries[0].Title != "A Title" || out.Entries[1].BibID != 3 {
+		t.Errorf("Unexpected entries %+v", out.Entries)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+
+	parsed, err := ParseQuery(`item.location = flr4 and (item.status = m OR item.callnumber ^ "QA 76")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Record != "item" {
+		t.Errorf("Unexpected record type %v", parsed.Record)
+	}
+	b, err := json.Marshal(parsed.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"queries":[` +
+		`{"target":{"record":{"type":"item"},"id":79},"expr":{"op":"equals","operands":["flr4"]}},"and",` +
+		`{"queries":[` +
+		`{"target":{"record":{"type":"item"},"id":88},"expr":{"op":"equals","operands":["m"]}},"or",` +
+		`{"target":{"record":{"type":"item"},"field":{"tag":"c"}},"expr":{"op":"starts_with","operands":["QA 76"]}}]}]}`
+	if string(b) != expected {
+		t.Errorf("Unexpected query %v", string(b))
+	}
+
+	//and binds more tightly than or.
+	parsed, err = ParseQuery(`bib.lang = eng or bib.lang = fre and bib.mattype = a`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compound, ok := parsed.JSON.(CompoundQuery); !ok || len(compound.Queries) != 3 || compound.Queries[1] != "or" {
+		t.Errorf("Unexpected query %+v", parsed.JSON)
+	}
+
+	tests := map[string]interface{}{
+		`bib.marc:245ab ~ nation`:          MarcFieldQuery("bib", "245", "ab", "has", "nation"),
+		`item.fixed:64 >= 5`:               FixedFieldQuery("item", 64, "greater_or_equal", "5"),
+		`item.var:v = "v. 2"`:              VarFieldQuery("item", "v", "equals", "v. 2"),
+		`bib.fixed:83 between 2014 2015`:   FixedFieldQuery("bib", 83, "between", "2014", "2015"),
+		`(((item.barcode = "3900 0012")))`: BarcodeQuery("3900 0012"),
+	}
+	for s, expected := range tests {
+		parsed, err := ParseQuery(s)
+		if err != nil {
+			t.Errorf("Unable to parse %v, %v", s, err)
+			continue
+		}
+		if query, ok := parsed.JSON.(Query); !ok || !reflect.DeepEqual(query, expected) {
+			t.Errorf("Unexpected query for %v, %+v", s, parsed.JSON)
+		}
+	}
+
+	for _, s := range []string{
+		``,
+		`item.status`,
+		`item.status =`,
+		`item.status m`,
+		`item.status = m and`,
+		`item.status = m bib.lang = eng`,
+		`item.status = m and bib.lang = eng`,
+		`patron.status = m`,
+		`item.colour = red`,
+		`item.fixed:x = 1`,
+		`bib.marc:ab = 1`,
+		`(item.status = m`,
+		`item.status = m)`,
+		`item.status = "m`,
+		`item.status between m`,
+	} {
+		if _, err := ParseQuery(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestLoadSavedQueries(t *testing.T) {
+
+	file := func(content string) string {
+		f, err := ioutil.TempFile("", "tyroqueries")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+
+	good := file(`{"missing": {"description": "Missing items", "query": "item.status = m"}}`)
+	defer os.Remove(good)
+	saved, err := LoadSavedQueries(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing, ok := saved["missing"]; !ok || missing.Description != "Missing items" || missing.Parsed == nil || missing.Parsed.Record != "item" {
+		t.Errorf("Unexpected saved queries %+v", saved)
+	}
+
+	for _, content := range []string{
+		`{"missing": {"query": "item.status"}}`,
+		`{"a/b": {"query": "item.status = m"}}`,
+		`[]`,
+	} {
+		bad := file(content)
+		defer os.Remove(bad)
+		if _, err := LoadSavedQueries(bad); err == nil {
+			t.Errorf("Expected an error loading %v", content)
+		}
+	}
+}
+
+func TestLoadCourses(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "tyrocourses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{
+		" hist2100 ": {"name": "HIST 2100 Canada", "instructors": ["Smith, Jane", "Lee, Sam"], "items": [4000001, 4000002]},
+		"biol1010": {"name": "BIOL 1010 Cells"}
+	}`)
+	f.Close()
+
+	if err := LoadCourses(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetCourses(make(map[string]Course))
+
+	course, ok := LookupCourse("hist2100")
+	if !ok || course.Name != "HIST 2100 Canada" || !reflect.DeepEqual(course.ItemIDs, []int{4000001, 4000002}) {
+		t.Errorf("Unexpected course %+v", course)
+	}
+	if _, ok := LookupCourse("math1000"); ok {
+		t.Error("LookupCourse() should not find a course which isn't loaded.")
+	}
+
+	if list := Courses(""); len(list) != 2 || list[0].CourseID != "biol1010" || list[0].Instructors == nil || list[0].ItemIDs == nil {
+		t.Errorf("Unexpected courses %+v", list)
+	}
+	if list := Courses("smith"); len(list) != 1 || list[0].CourseID != "hist2100" {
+		t.Errorf("Unexpected courses taught by Smith %+v", list)
+	}
+}
+
+func TestWatchCourses(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "tyrocourses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"hist2100": {"name": "HIST 2100 Canada"}}`)
+	f.Close()
+
+	if err := LoadCourses(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer SetCourses(make(map[string]Course))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	WatchCourses(f.Name(), time.Millisecond*10, stop)
+
+	//A file which can't be loaded leaves the old courses in place.
+	write := func(content string, modified time.Time) {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.Name(), modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	now := time.Now()
+	write(`{"hist2100": `, now.Add(time.Minute))
+	if _, ok := LookupCourse("hist2100"); !ok {
+		t.Error("A broken courses file shouldn't replace the loaded courses.")
+	}
+
+	write(`{"biol1010": {"name": "BIOL 1010 Cells"}}`, now.Add(2*time.Minute))
+	if _, ok := LookupCourse("biol1010"); !ok {
+		t.Error("WatchCourses() should load the courses file when it changes.")
+	}
+	if _, ok := LookupCourse("hist2100"); ok {
+		t.Error("WatchCourses() should replace the old courses.")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Kevin Bowrin All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package sierraapi
+
+import (
+	"time"
+)
+
+//AvailabilitySummary counts the copies of a bib, for showing
+//one badge per record, like "2 of 5 available".
+type AvailabilitySummary struct {
+	Total           int
+	Available       int
+	Limited         int
+	EarliestDue     string
+	EarliestDueDate *time.Time
+	Holds           int
+	Locations       []LocationSummary
+}
+
+//LocationSummary counts the copies of a bib in one location.
+type LocationSummary struct {
+	Location  string
+	Total     int
+	Available int
+}
+
+//Summarize counts the items, overall and per location.
+//Locations are listed in the order they first appear.
+//Holds are not known from the items, and are left at 0.
+func (in *ItemRecordsOut) Summarize() *AvailabilitySummary {
+
+	out := new(AvailabilitySummary)
+	locations := make(map[string]int)
+
+	for _, item := range in.Entries {
+
+		i, seen := locations[item.Location]
+		if !seen {
+			i = len(out.Locations)
+			locations[item.Location] = i
+			out.Locations = append(out.Locations, LocationSummary{Location: item.Location})
+		}
+
+		out.Total++
+		out.Locations[i].Total++
+
+		switch item.Availability {
+		case Available:
+			out.Available++
+			out.Locations[i].Available++
+		case Limited:
+			out.Limited++
+		}
+
+		if !item.DueDate.IsZero() && (out.EarliestDueDate == nil || item.DueDate.Before(*out.EarliestDueDate)) {
+			due := item.DueDate
+			out.EarliestDueDate = &due
+			out.EarliestDue = FormatDueDate(due)
+		}
+	}
+
+	return out
+}